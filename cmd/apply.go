@@ -0,0 +1,98 @@
+/*
+Copyright © 2024 ThreatKey, Inc.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+// applyCmd represents the apply command
+var applyCmd = &cobra.Command{
+	Use:   "apply [plan.json]",
+	Short: "Plans and applies changes to Vault policies and auth roles",
+	Long: `Works in two phases, like Terraform:
+
+  hvresult gitops apply --plan plan.json
+
+compares the working copy to live Vault and writes every PUT, PATCH, and
+DELETE needed to make Vault match it to plan.json, which should be reviewed.
+
+  hvresult gitops apply plan.json
+
+executes exactly that plan, after checking that nothing it touches has changed
+in Vault since it was computed. Auth roles only have their policy fields
+patched, so bound claims, TTLs, etc. are left alone.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			ctx          = context.Background()
+			_f           = cmd.Flags()
+			directory, _ = _f.GetString("directory")
+			planPath, _  = _f.GetString("plan")
+		)
+		switch {
+		case planPath != "" && len(args) > 0:
+			log.Fatal().Msg("specify either --plan to write a plan or a plan to apply, not both")
+		case planPath != "":
+			plan, err := gitops.ComputePlan(ctx, mustVaultClient(), directory)
+			if err != nil {
+				log.Fatal().Err(err).Msg("error computing plan")
+			}
+			if err := gitops.WritePlan(planPath, plan); err != nil {
+				log.Fatal().Err(err).Send()
+			}
+			printPlan(plan)
+		case len(args) == 1:
+			plan, err := gitops.ReadPlan(args[0])
+			if err != nil {
+				log.Fatal().Err(err).Send()
+			}
+			if plan.Empty() {
+				fmt.Println("Nothing to apply.")
+				return
+			}
+			if err := gitops.ApplyPlan(ctx, mustVaultClient(), plan); err != nil {
+				log.Fatal().Err(err).Msg("error applying plan")
+			}
+			fmt.Printf("Applied %d operations.\n", len(plan.Operations))
+		default:
+			log.Fatal().Msg("specify --plan to write a plan or a plan to apply")
+		}
+	},
+}
+
+func printPlan(plan *gitops.Plan) {
+	if plan.Empty() {
+		fmt.Println("Vault already matches the working copy.")
+		return
+	}
+	fmt.Printf("%d operations planned:\n\n", len(plan.Operations))
+	for _, op := range plan.Operations {
+		fmt.Printf("* %s\n", op)
+	}
+}
+
+func init() {
+	gitopsCmd.AddCommand(applyCmd)
+	flags := applyCmd.Flags()
+	flags.String("plan", "", "write a plan to this file instead of applying one")
+}
@@ -18,30 +18,91 @@ package cmd
 
 import (
 	"context"
+	"os"
+	"strings"
 
+	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal"
 	"github.com/threatkey-oss/hvresult/internal/gitops"
 )
 
+// Exit code used when a diff fails a check, like --strict or --fail-on.
+const exitCodeDiffCheck = 2
+
 // diffCmd represents the diff command
 var diffCmd = &cobra.Command{
 	Use:   "diff",
 	Short: "Emits markdown of changes to the RSoP of a git repository",
 	Long: `Emits a markdown tables for changes to the RSoP of each auth principal
-modified in a git repository.`,
+modified in a git repository.
+
+By default the working copy is compared to the default branch. Use --base and
+--head to compare two git refs without checking either out, and --merge-base to
+compare --head to where it branched off of --base, like a pull request.
+
+Use --format json for a machine-readable report of the changed files and, for
+each affected principal, what caused the change, the added and removed
+capabilities, and metrics.
+
+Principals that reference policies that don't exist, added policies that
+nothing references, and deleted policies that are still referenced are reported
+as warnings. With --strict, they exit with code 2.
+
+Every change gets a risk severity, e.g. critical for gaining sudo on sys/ or
+high for write access to policies or auth roles. With --fail-on, changes at or
+above a severity exit with code 2, e.g. --fail-on high. Principals that can't
+be evaluated fail the command instead of counting as unchanged.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var (
 			ctx           = context.Background()
 			_f            = cmd.Flags()
 			directory, _  = _f.GetString("directory")
+			base, _       = _f.GetString("base")
+			head, _       = _f.GetString("head")
+			mergeBase, _  = _f.GetBool("merge-base")
+			format, _     = _f.GetString("format")
+			strict, _     = _f.GetBool("strict")
+			failOn, _     = _f.GetString("fail-on")
 			compareRef, _ = _f.GetString("compare-ref")
 		)
-		gitops.MustEmitMarkdownDiffs(ctx, directory, compareRef)
+		if base == "" {
+			base = compareRef
+		}
+		failSeverity := internal.SeverityNone
+		if failOn != "" {
+			var err error
+			if failSeverity, err = internal.ParseSeverity(failOn); err != nil || failSeverity == internal.SeverityNone {
+				log.Fatal().Err(err).Str("fail-on", failOn).Msg("--fail-on must be low, medium, high, or critical")
+			}
+		}
+		report := gitops.MustEmitDiffs(ctx, directory, gitops.DiffOptions{
+			Base:      base,
+			Head:      head,
+			MergeBase: mergeBase,
+			Format:    strings.ToLower(format),
+		})
+		if strict && !report.PolicyWarnings.Empty() {
+			log.Error().Msg("policy reference warnings with --strict")
+			os.Exit(exitCodeDiffCheck)
+		}
+		if failSeverity != internal.SeverityNone && report.Severity >= failSeverity {
+			log.Error().Stringer("severity", report.Severity).Stringer("fail-on", failSeverity).Msg("changes at or above --fail-on severity")
+			os.Exit(exitCodeDiffCheck)
+		}
 	},
 }
 
 func init() {
 	gitopsCmd.AddCommand(diffCmd)
 	flags := diffCmd.Flags()
-	flags.String("compare-ref", "", "if specified, compare to this git reference instead of the default branch (e.g. 'main')")
+	flags.String("base", "", "if specified, compare to this git reference instead of the default branch (e.g. 'main')")
+	flags.String("head", "", "if specified, compare this git reference instead of the working copy (e.g. 'feature-branch')")
+	flags.Bool("merge-base", false, "compare to the merge base of --base and --head, like a pull request")
+	flags.String("format", "markdown", "output format: markdown or json")
+	flags.Bool("strict", false, "exit with code 2 if there are dangling or unreferenced policies")
+	flags.String("fail-on", "", "exit with code 2 if any change is at least this severity: low, medium, high, or critical")
+	flags.String("compare-ref", "", "alias of --base")
+	_ = flags.MarkDeprecated("compare-ref", "use --base instead")
+	diffCmd.MarkFlagsMutuallyExclusive("base", "compare-ref")
 }
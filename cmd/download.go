@@ -35,24 +35,54 @@ current state of Vault auth roles and policies required in order to
 start using pull requests for Vault policy change management.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		var (
-			ctx          = context.Background()
-			_f           = cmd.Flags()
-			directory, _ = _f.GetString("directory")
+			ctx           = context.Background()
+			_f            = cmd.Flags()
+			directory, _  = _f.GetString("directory")
+			namespaces, _ = _f.GetBool("namespaces")
+			noPrune, _    = _f.GetBool("no-prune")
+			fullConfig, _ = _f.GetBool("full-config")
+			include, _    = _f.GetStringSlice("include-fields")
+			exclude, _    = _f.GetStringSlice("exclude-fields")
+			noIdentity, _ = _f.GetBool("no-identity")
+			opts          = gitops.DownloadOptions{
+				Identity:      !noIdentity,
+				Prune:         !noPrune,
+				FullConfig:    fullConfig,
+				IncludeFields: include,
+				ExcludeFields: exclude,
+			}
 		)
 		vc, err := vault.NewClient(vault.DefaultConfig())
 		if err != nil {
 			log.Fatal().Err(err).Msg("error creating Vault client from defaults")
 		}
 		// do the thing that's more error prone first
-		if err := gitops.DownloadAuth(ctx, vc, filepath.Join(directory, "auth")); err != nil {
+		if err := gitops.DownloadAuth(ctx, vc, filepath.Join(directory, "auth"), opts); err != nil {
 			log.Fatal().Err(err).Msg("error downloading auth mounts")
 		}
 		if err := gitops.DownloadPolicies(ctx, vc, filepath.Join(directory, "sys", "policies", "acl")); err != nil {
 			log.Fatal().Err(err).Msg("error downloading policies")
 		}
+		if opts.Identity {
+			if err := gitops.DownloadIdentity(ctx, vc, filepath.Join(directory, "identity"), opts); err != nil {
+				log.Fatal().Err(err).Msg("error downloading identity groups and entities")
+			}
+		}
+		if namespaces {
+			if err := gitops.DownloadNamespaces(ctx, vc, directory, opts); err != nil {
+				log.Fatal().Err(err).Msg("error downloading namespaces")
+			}
+		}
 	},
 }
 
 func init() {
 	gitopsCmd.AddCommand(downloadCmd)
+	flags := downloadCmd.Flags()
+	flags.Bool("namespaces", false, "also download every child namespace, recursively, to namespaces/<path>/")
+	flags.Bool("no-prune", false, "keep auth principal files for roles, mounts, and namespaces that no longer exist in Vault")
+	flags.Bool("no-identity", false, "don't download identity groups and entities")
+	flags.Bool("full-config", false, "write every field of each auth principal, e.g. bound claims and TTLs, not just its policies")
+	flags.StringSlice("include-fields", nil, "with --full-config, only write these fields besides policies")
+	flags.StringSlice("exclude-fields", nil, "with --full-config, never write these fields")
 }
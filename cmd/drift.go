@@ -0,0 +1,89 @@
+/*
+Copyright © 2024 ThreatKey, Inc.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+// Exit code used when live Vault doesn't match the repository.
+const exitCodeDrift = 2
+
+// driftCmd represents the drift command
+var driftCmd = &cobra.Command{
+	Use:   "drift",
+	Short: "Detects changes made to Vault outside of a git repository",
+	Long: `Reads every policy and auth principal from Vault without writing anything
+to disk, then emits markdown tables of how the RSoP of each auth principal in
+Vault differs from a git ref of the repository.
+
+Exits with code 2 if there is drift, so it can run on a schedule.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			ctx          = context.Background()
+			_f           = cmd.Flags()
+			directory, _ = _f.GetString("directory")
+			ref, _       = _f.GetString("ref")
+		)
+		drift, err := gitops.DetectDrift(ctx, mustVaultClient(), directory, ref)
+		if err != nil {
+			log.Fatal().Err(err).Msg("error detecting drift")
+		}
+		if drift.Empty() {
+			fmt.Printf("No drift from `%s`.\n", ref)
+			return
+		}
+		printDrift(drift)
+		os.Exit(exitCodeDrift)
+	},
+}
+
+func printDrift(drift *gitops.Drift) {
+	if len(drift.Policies) > 0 {
+		fmt.Printf("%d policies differ from the repository:\n\n", len(drift.Policies))
+		for _, name := range drift.Policies {
+			fmt.Printf("* `%s`\n", name)
+		}
+		fmt.Println()
+	}
+	principals := make([]string, 0, len(drift.Principals))
+	for principal := range drift.Principals {
+		principals = append(principals, principal)
+	}
+	sort.Strings(principals)
+	for _, principal := range principals {
+		diff := drift.Principals[principal]
+		for _, warning := range diff.Warnings {
+			fmt.Printf("> `%s`: %s\n\n", principal, warning)
+		}
+		fmt.Printf("%d effective changes to `%s` in Vault:\n\n", diff.Metrics().Total(), principal)
+		fmt.Println(diff.MarkdownTable())
+	}
+}
+
+func init() {
+	gitopsCmd.AddCommand(driftCmd)
+	flags := driftCmd.Flags()
+	flags.String("ref", "HEAD", "compare Vault to this git reference, or to the working copy if empty")
+}
@@ -0,0 +1,62 @@
+/*
+Copyright © 2024 ThreatKey, Inc.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/pflag"
+	"github.com/threatkey-oss/hvresult/internal"
+)
+
+var (
+	flagIdentityFile   string
+	flagIdentityEntity string
+)
+
+// Adds flags for rendering templated policy paths.
+func addIdentityFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&flagIdentityFile, "identity-file", "", "render templated policy paths with the entity and groups in this JSON file")
+	flags.StringVar(&flagIdentityEntity, "identity-entity", "", "render templated policy paths by looking up this entity ID and its groups in Vault")
+}
+
+// Renders templated policy paths if an identity was specified, otherwise returns rsop as is.
+func mustRenderIdentity(ctx context.Context, rsop *internal.RSoP) *internal.RSoP {
+	var (
+		identity *internal.IdentityContext
+		err      error
+	)
+	switch {
+	case flagIdentityFile != "" && flagIdentityEntity != "":
+		log.Fatal().Msg("--identity-file and --identity-entity are mutually exclusive")
+	case flagIdentityFile != "":
+		identity, err = internal.ReadIdentityContextFile(flagIdentityFile)
+	case flagIdentityEntity != "":
+		identity, err = internal.LookupIdentityContext(ctx, mustVaultClient(), flagIdentityEntity)
+	default:
+		return rsop
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("error loading identity context")
+	}
+	rendered, dropped := rsop.RenderTemplates(identity)
+	for _, path := range dropped {
+		log.Warn().Str("path", path).Str("entity", identity.Entity.ID).Msg("templated path could not be rendered for entity, dropping it like Vault would")
+	}
+	return rendered
+}
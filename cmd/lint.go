@@ -0,0 +1,135 @@
+/*
+Copyright © 2024 ThreatKey, Inc.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+// Exit code used when linting finds something the baseline doesn't accept.
+const exitCodeLint = 2
+
+// lintCmd represents the lint command
+var lintCmd = &cobra.Command{
+	Use:   "lint [gitops directory or policy file...]",
+	Short: "Checks policies for common mistakes",
+	Long: `Checks gitops directories or individual policy files for common mistakes,
+like duplicate path stanzas, paths that can never match a request, and
+policies that grant everything. Directories are also checked for principals
+that reference policies that don't exist and policies nothing references.
+
+Every finding has a stable rule ID like HVR001 and a file:line:column location.
+Exits with code 2 if there are findings.
+
+To accept existing findings, write them to a baseline with --write-baseline,
+commit it, and pass it to --baseline so only new findings are reported.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			_f               = cmd.Flags()
+			baselineFile, _  = _f.GetString("baseline")
+			writeBaseline, _ = _f.GetString("write-baseline")
+			format, _        = _f.GetString("format")
+		)
+		format = strings.ToLower(format)
+		if format != "text" && format != "json" {
+			log.Fatal().Str("format", format).Msg("--format must be text or json")
+		}
+		if len(args) == 0 {
+			args = []string{"vault-policy"}
+		}
+		var findings []internal.LintFinding
+		for _, arg := range args {
+			found, err := lintPath(arg)
+			if err != nil {
+				log.Fatal().Err(err).Str("path", arg).Msg("error linting")
+			}
+			findings = append(findings, found...)
+		}
+		internal.SortLintFindings(findings)
+		if writeBaseline != "" {
+			if err := internal.WriteLintBaseline(writeBaseline, internal.NewLintBaseline(findings)); err != nil {
+				log.Fatal().Err(err).Msg("error writing baseline")
+			}
+			log.Info().Int("findings", len(findings)).Str("baseline", writeBaseline).Msg("wrote lint baseline")
+			return
+		}
+		if baselineFile != "" {
+			baseline, err := internal.ReadLintBaseline(baselineFile)
+			if err != nil {
+				log.Fatal().Err(err).Msg("error reading baseline")
+			}
+			findings = baseline.Filter(findings)
+		}
+		if format == "json" {
+			if findings == nil {
+				findings = []internal.LintFinding{}
+			}
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(findings); err != nil {
+				log.Fatal().Err(err).Msg("error encoding findings")
+			}
+		} else {
+			for _, finding := range findings {
+				fmt.Println(finding)
+			}
+		}
+		if len(findings) > 0 {
+			os.Exit(exitCodeLint)
+		}
+	},
+}
+
+// Lints a gitops directory or a single policy file, locating findings relative to the working directory.
+func lintPath(path string) ([]internal.LintFinding, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return internal.LintPolicy(string(content), filepath.ToSlash(path)), nil
+	}
+	findings, err := gitops.Lint(path)
+	if err != nil {
+		return nil, err
+	}
+	for i := range findings {
+		findings[i].File = filepath.ToSlash(filepath.Join(path, filepath.FromSlash(findings[i].File)))
+	}
+	return findings, nil
+}
+
+func init() {
+	rootCmd.AddCommand(lintCmd)
+	flags := lintCmd.Flags()
+	flags.String("baseline", "", "don't report findings accepted in this baseline file")
+	flags.String("write-baseline", "", "accept every current finding by writing them to this baseline file, then exit")
+	flags.String("format", "text", "output format: text or json")
+}
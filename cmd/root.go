@@ -21,20 +21,27 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	vault "github.com/hashicorp/vault/api"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
 	"golang.org/x/term"
 )
 
 var (
-	cfgFile     string
-	flagVerbose bool
-	flagFormat  string
+	cfgFile        string
+	flagVerbose    bool
+	flagFormat     string
+	flagOfflineDir string
+	flagRef        string
+	flagCacheDir   string
+	flagCacheTTL   time.Duration
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -45,6 +52,9 @@ var rootCmd = &cobra.Command{
 path to a Vault role, or server path to a Vault entity/group/etc.
 
 By default, hvresult will evaluate and print the RSoP for each.
+
+With --offline-dir, auth principal paths like auth/gcp/role/foo are evaluated
+from a directory written by 'gitops download' without contacting Vault.
 `,
 	Args: cobra.MinimumNArgs(1),
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
@@ -68,29 +78,25 @@ By default, hvresult will evaluate and print the RSoP for each.
 		}
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		ctx := context.Background()
-		vc, err := vault.NewClient(vault.DefaultConfig())
-		if err != nil {
-			log.Fatal().Err(err).Msg("error creating Vault client from defaults")
-		}
-		if vc.Token() == "" {
-			log.Fatal().Msg("Vault client from defaults has no token - VAULT_TOKEN environment variable is probably empty")
-		}
-		pp, err := internal.NewReadthroughPolicyProvider("", vc)
-		if err != nil {
-			log.Fatal().Err(err).Msg("error creating PolicyProvider")
-		}
+		var (
+			ctx = context.Background()
+			pp  = mustPolicyProvider()
+		)
 		for _, arg := range args {
 			rsop, err := pp.GetRSoP(ctx, arg)
 			if err != nil {
 				log.Fatal().Err(err).Msg("error generating RSoP")
 			}
+			rsop = mustRenderIdentity(ctx, rsop)
 			log.Debug().EmbedObject(rsop).Msgf("printing as %s to stdout", flagFormat)
 			capmap := rsop.GetCapabilityMap()
 			switch flagFormat {
 			case "hcl":
-				fmt.Println(strings.TrimSpace(capmap.HCL()))
+				fmt.Println(strings.TrimSpace(rsop.HCL()))
 			case "table":
+				for _, warning := range rsop.Warnings() {
+					fmt.Printf("> %s\n\n", warning)
+				}
 				empty := &internal.RSoPCapMap{}
 				diff := empty.Diff(capmap)
 				log.Debug().Any("diff", diff).Msg("generated diff")
@@ -100,6 +106,59 @@ By default, hvresult will evaluate and print the RSoP for each.
 	},
 }
 
+// Creates a Vault client from the environment or exits.
+func mustVaultClient() *vault.Client {
+	vc, err := vault.NewClient(vault.DefaultConfig())
+	if err != nil {
+		log.Fatal().Err(err).Msg("error creating Vault client from defaults")
+	}
+	if vc.Token() == "" {
+		log.Fatal().Msg("Vault client from defaults has no token - VAULT_TOKEN environment variable is probably empty")
+	}
+	return vc
+}
+
+// Adds flags for evaluating principals without a Vault cluster.
+func addOfflineFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&flagOfflineDir, "offline-dir", "", "read principals and policies from a directory written by 'gitops download' instead of Vault")
+	flags.StringVar(&flagRef, "ref", "", "with --offline-dir, read from this git ref instead of the working copy")
+}
+
+// Adds flags for caching policies read from Vault.
+func addCacheFlags(flags *pflag.FlagSet) {
+	flags.StringVar(&flagCacheDir, "cache-dir", "", "cache policies read from Vault in this directory")
+	flags.DurationVar(&flagCacheTTL, "cache-ttl", internal.DefaultPolicyCacheTTL, "revalidate cached policies against Vault after this long, or every time if 0")
+}
+
+// Creates a PolicyProvider from the environment or exits.
+func mustPolicyProvider() internal.PolicyProvider {
+	var (
+		pp  internal.PolicyProvider
+		err error
+	)
+	switch {
+	case flagOfflineDir != "":
+		pp, err = gitops.NewOfflinePolicyProvider(flagOfflineDir, flagRef)
+	case flagRef != "":
+		log.Fatal().Msg("--ref requires --offline-dir")
+	default:
+		var (
+			cache  *internal.PolicyCache
+			client = mustVaultClient()
+		)
+		if flagCacheDir != "" {
+			if cache, err = internal.NewPolicyCache(flagCacheDir, client.Address(), client.Namespace(), flagCacheTTL); err != nil {
+				log.Fatal().Err(err).Msg("error creating policy cache")
+			}
+		}
+		pp, err = internal.NewReadthroughPolicyProvider(cache, client)
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("error creating PolicyProvider")
+	}
+	return pp
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -112,10 +171,13 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 	persistent := rootCmd.PersistentFlags()
-	persistent.StringVar(&cfgFile, "config", "", "config file (default is $HOME/.hvaa.yaml)")
+	persistent.StringVar(&cfgFile, "config", "", "config file (default is $HOME/.hvap.yaml)")
 	persistent.BoolVarP(&flagVerbose, "verbose", "v", false, "print debug level logs")
 	flags := rootCmd.Flags()
 	flags.StringVar(&flagFormat, "format", "hcl", "output format")
+	addIdentityFlags(flags)
+	addOfflineFlags(flags)
+	addCacheFlags(flags)
 	flags.BoolP("toggle", "t", false, "Help message for toggle")
 }
 
@@ -141,4 +203,13 @@ func initConfig() {
 	if err := viper.ReadInConfig(); err == nil {
 		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
+
+	// custom auth plugins, or overrides for built-in auth methods
+	var authMountTypes map[string]gitops.AuthMountType
+	if err := viper.UnmarshalKey("auth_mount_types", &authMountTypes); err != nil {
+		log.Fatal().Err(err).Msg("error decoding auth_mount_types from config")
+	}
+	if err := gitops.SetAuthMountTypes(authMountTypes); err != nil {
+		log.Fatal().Err(err).Msg("error configuring auth mount types")
+	}
 }
@@ -0,0 +1,85 @@
+/*
+Copyright © 2024 ThreatKey, Inc.
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU Affero General Public License as published
+by the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU Affero General Public License for more details.
+
+You should have received a copy of the GNU Affero General Public License
+along with this program.  If not, see <https://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+// whoCanCmd represents the who-can command
+var whoCanCmd = &cobra.Command{
+	Use:   "who-can <capability|HTTP verb> <request-path>",
+	Short: "Lists every auth principal that can perform an operation on a path",
+	Long: `Evaluates the RSoP of every auth principal against a single request path
+and lists the ones that are granted access, along with the policy and path
+stanza that grants it. Principals that would be granted access if not for a
+deny are listed too.
+
+Principals are read from the auth/ and identity/ directories written by
+'gitops download' when --offline-dir is set, including its namespaces/, and
+from a git ref of it with --ref. Otherwise
+every auth principal, identity group, and entity is read from Vault, in the
+client's namespace and, with --namespaces, every namespace below it.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var (
+			ctx                = context.Background()
+			_f                 = cmd.Flags()
+			namespaces, _      = _f.GetBool("namespaces")
+			operation, reqPath = args[0], strings.TrimPrefix(args[1], "/")
+		)
+		caps, err := internal.ParseOperation(operation)
+		if err != nil {
+			log.Fatal().Err(err).Send()
+		}
+		var rsops map[string]*internal.RSoP
+		if flagOfflineDir != "" {
+			rsops, err = gitops.ReadPrincipalRSoPs(flagOfflineDir, flagRef)
+		} else {
+			rsops, err = gitops.LivePrincipalRSoPs(ctx, mustVaultClient(), mustPolicyProvider(), namespaces)
+		}
+		if err != nil {
+			log.Fatal().Err(err).Msg("error reading auth principals")
+		}
+		log.Debug().Int("principals", len(rsops)).Msg("evaluating principals")
+		report := gitops.WhoCan(rsops, reqPath, caps)
+		for _, warning := range report.Warnings() {
+			fmt.Printf("> %s\n\n", warning)
+		}
+		table := report.MarkdownTable()
+		if table == "" {
+			fmt.Printf("no principal can %s on %q\n", joinCapabilities(caps, " or "), reqPath)
+			return
+		}
+		fmt.Println(table)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(whoCanCmd)
+	flags := whoCanCmd.Flags()
+	addOfflineFlags(flags)
+	flags.Bool("namespaces", false, "also read principals from every child namespace in Vault, recursively")
+	addCacheFlags(flags)
+}
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"sort"
+	"strings"
+
+	mdtf "github.com/fbiville/markdown-table-formatter/pkg/markdown"
+)
+
+// Access is the outcome of evaluating an RSoP against a single request.
+type Access struct {
+	// Whether any of the requested capabilities is granted.
+	Allowed bool
+	// The capability that was granted, if any.
+	Capability Capability
+	// Whether the root policy granted the request.
+	Root bool
+	// The stanza Vault would use, or nil if nothing matches.
+	Match *PathMatch
+	// Stanzas that would grant the request if it weren't for a deny.
+	Blocked []BlockedGrant
+}
+
+// BlockedGrant is a capability that a deny keeps from taking effect.
+type BlockedGrant struct {
+	// The path granting the capability.
+	Path       string
+	Capability Capability
+	Policies   []string
+	// The path the deny is on, which is Path when both are in the same stanza.
+	DenyPath string
+	Deniers  []string
+}
+
+// Evaluate checks a request against the RSoP, granting it if any of caps is allowed.
+//
+// When the request is denied by a deny stanza, the grants Vault would otherwise use are collected in Blocked.
+func (r *RSoP) Evaluate(requestPath string, caps []Capability) *Access {
+	requestPath = strings.TrimPrefix(requestPath, "/")
+	if r.IsRoot() {
+		access := &Access{Allowed: true, Root: true}
+		if len(caps) > 0 {
+			access.Capability = caps[0]
+		}
+		return access
+	}
+	var (
+		capmap = r.GetCapabilityMap()
+		access = &Access{}
+	)
+	if len(caps) == 0 {
+		return access
+	}
+	access.Match = capmap.MatchOperation(requestPath, caps[0])
+	if !access.Match.Denied() {
+		for _, cap := range caps {
+			if access.Match.Allows(cap) {
+				access.Allowed, access.Capability = true, cap
+				break
+			}
+		}
+		return access
+	}
+	// walk down the priority order until finding the grants the deny cancels
+	var (
+		match     = access.Match
+		remaining = make(RSoPCapMap, len(capmap))
+	)
+	for path, entry := range capmap {
+		remaining[path] = entry
+	}
+	for match.Denied() {
+		for _, cap := range caps {
+			if preemption := match.Preempted[cap]; preemption != nil {
+				access.Blocked = append(access.Blocked, BlockedGrant{
+					Path:       match.Path,
+					Capability: cap,
+					Policies:   preemption.Policies,
+					DenyPath:   match.Path,
+					Deniers:    preemption.Deniers,
+				})
+			}
+		}
+		if len(access.Blocked) > 0 {
+			break
+		}
+		delete(remaining, match.Path)
+		next := remaining.MatchOperation(requestPath, caps[0])
+		if next == nil {
+			break
+		}
+		if !next.Denied() {
+			for _, cap := range caps {
+				if next.Allows(cap) {
+					access.Blocked = append(access.Blocked, BlockedGrant{
+						Path:       next.Path,
+						Capability: cap,
+						Policies:   next.Capabilities[cap],
+						DenyPath:   access.Match.Path,
+						Deniers:    access.Match.Capabilities[Deny],
+					})
+				}
+			}
+		}
+		match = next
+	}
+	return access
+}
+
+// PrincipalAccess is the Access of a single auth principal.
+type PrincipalAccess struct {
+	Principal string
+	*Access
+}
+
+// AccessReport answers who can perform a request across many principals.
+type AccessReport []PrincipalAccess
+
+// Whether the principal is worth reporting: it's either allowed or only kept out by a deny.
+func (a PrincipalAccess) Relevant() bool {
+	return a.Access != nil && (a.Allowed || len(a.Blocked) > 0)
+}
+
+// Warnings returns things about principals that need attention before their access, like having the root policy.
+func (r AccessReport) Warnings() []string {
+	var warnings []string
+	for _, access := range r {
+		if access.Access != nil && access.Root {
+			warnings = append(warnings, "WARNING: `"+access.Principal+"` has the root policy attached, which bypasses every ACL check including deny")
+		}
+	}
+	return warnings
+}
+
+// Emits a GitHub-flavored markdown table of relevant principals or the empty string if there are none.
+func (r AccessReport) MarkdownTable() string {
+	relevant := make(AccessReport, 0, len(r))
+	for _, access := range r {
+		if access.Relevant() {
+			relevant = append(relevant, access)
+		}
+	}
+	if len(relevant) == 0 {
+		return ""
+	}
+	sort.Slice(relevant, func(i, j int) bool {
+		return relevant[i].Principal < relevant[j].Principal
+	})
+	var (
+		builder = mdtf.NewTableFormatterBuilder().
+			WithPrettyPrint().
+			Build("Principal", "Access", "Path", "Capability", "Policy / Policies")
+		rows = make([][]string, 0, len(relevant))
+	)
+	for _, access := range relevant {
+		switch {
+		case access.Root:
+			rows = append(rows, []string{access.Principal, "✅", "*", string(access.Capability), "`" + RootPolicyName + "`"})
+		case access.Allowed:
+			rows = append(rows, []string{
+				access.Principal,
+				"✅",
+				"`" + access.Match.Path + "`",
+				string(access.Capability),
+				"`" + strings.Join(access.Match.Capabilities[access.Capability], "` , `") + "`",
+			})
+		}
+		for _, blocked := range access.Blocked {
+			rows = append(rows, []string{
+				access.Principal,
+				"🚫",
+				"`" + blocked.Path + "`",
+				string(blocked.Capability),
+				"`" + strings.Join(blocked.Policies, "` , `") + "` (denied by: " +
+					strings.Join(blocked.Deniers, ", ") + " on `" + blocked.DenyPath + "`)",
+			})
+		}
+	}
+	table, err := builder.Format(rows)
+	if err != nil {
+		panic(err)
+	}
+	return table
+}
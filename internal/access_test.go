@@ -0,0 +1,61 @@
+package internal_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal"
+)
+
+func TestEvaluate(t *testing.T) {
+	t.Parallel()
+	granter := &internal.Policy{
+		Name: "granter",
+		Paths: []internal.PathConfig{
+			{Path: "secret/*", Capabilities: []internal.Capability{"read"}},
+			{Path: "secret/locked", Capabilities: []internal.Capability{"read"}},
+		},
+	}
+	denier := &internal.Policy{
+		Name: "denier",
+		Paths: []internal.PathConfig{
+			{Path: "secret/locked", Capabilities: []internal.Capability{"deny"}},
+			{Path: "secret/shadowed", Capabilities: []internal.Capability{"deny"}},
+		},
+	}
+	rsop := &internal.RSoP{Policies: []*internal.Policy{granter, denier}}
+	read := []internal.Capability{internal.Read}
+	if access := rsop.Evaluate("/secret/open", read); !access.Allowed || access.Match.Path != "secret/*" {
+		t.Fatalf("expected read on secret/open, got %+v", access)
+	}
+	if access := rsop.Evaluate("other/path", read); access.Allowed || access.Match != nil {
+		t.Fatalf("expected no match, got %+v", access)
+	}
+	// the deny and the grant are in the same stanza
+	access := rsop.Evaluate("secret/locked", read)
+	if access.Allowed || len(access.Blocked) != 1 {
+		t.Fatalf("expected one blocked grant, got %+v", access)
+	}
+	if blocked := access.Blocked[0]; blocked.Path != "secret/locked" || blocked.DenyPath != "secret/locked" || blocked.Policies[0] != "granter" {
+		t.Fatalf("unexpected blocked grant: %+v", blocked)
+	}
+	// the deny is more specific than the grant
+	access = rsop.Evaluate("secret/shadowed", read)
+	if access.Allowed || len(access.Blocked) != 1 || access.Blocked[0].Path != "secret/*" || access.Blocked[0].Deniers[0] != "denier" {
+		t.Fatalf("expected secret/* to be blocked, got %+v", access)
+	}
+	root := &internal.RSoP{Policies: []*internal.Policy{internal.BuiltinPolicy(internal.RootPolicyName)}}
+	if access := root.Evaluate("anything", read); !access.Allowed || !access.Root {
+		t.Fatalf("expected root to be allowed, got %+v", access)
+	}
+	if warnings := (internal.AccessReport{{Principal: "auth/token/roles/admin", Access: root.Evaluate("anything", read)}}).Warnings(); len(warnings) != 1 || !strings.Contains(warnings[0], "auth/token/roles/admin") {
+		t.Fatalf("expected a root warning, got %v", warnings)
+	}
+	table := internal.AccessReport{
+		{Principal: "auth/token/roles/granter", Access: rsop.Evaluate("secret/shadowed", read)},
+		{Principal: "auth/token/roles/nobody", Access: rsop.Evaluate("other/path", read)},
+	}.MarkdownTable()
+	if !strings.Contains(table, "🚫") || !strings.Contains(table, "denied by: denier on `secret/shadowed`") || strings.Contains(table, "nobody") {
+		t.Fatalf("unexpected table:\n%s", table)
+	}
+}
@@ -0,0 +1,79 @@
+package internal
+
+const (
+	// Attached to every token unless token_no_default_policy is set.
+	DefaultPolicyName = "default"
+	// Bypasses ACLs entirely and isn't a real document.
+	RootPolicyName = "root"
+	// Attached to response-wrapping tokens and isn't a real document.
+	ResponseWrappingPolicyName = "response-wrapping"
+)
+
+// IsRole is whether an auth principal read from Vault is a role, which gets the default policy unless it sets
+// token_no_default_policy. Vault returns token_policies for every role, even when it's empty.
+func IsRole(data map[string]any) bool {
+	_, exists := data["token_policies"]
+	return exists
+}
+
+// AttachesDefaultPolicy is whether Vault attaches the default policy to tokens from a role that lists these policies,
+// which it does unless the role sets token_no_default_policy.
+func AttachesDefaultPolicy(policies []string, tokenNoDefaultPolicy bool) bool {
+	return !tokenNoDefaultPolicy && !contains(DefaultPolicyName, policies...)
+}
+
+// as defined by responseWrappingPolicy in Vault's vault/policy_store.go
+const responseWrappingPolicyHCL = `
+path "cubbyhole/response" {
+    capabilities = ["create", "read"]
+}
+
+path "sys/wrapping/unwrap" {
+    capabilities = ["update"]
+}
+`
+
+// BuiltinPolicy returns policies that exist in Vault without a readable document, or nil.
+//
+// The root policy is approximated as every capability on every path, but since it also ignores
+// deny, callers should check RSoP.IsRoot() when that matters.
+func BuiltinPolicy(name string) *Policy {
+	switch name {
+	case RootPolicyName:
+		return &Policy{
+			Name: RootPolicyName,
+			Paths: []PathConfig{{
+				Path:         "*",
+				Capabilities: []Capability{Create, Read, Update, Patch, Delete, List, Sudo, Subscribe},
+			}},
+		}
+	case ResponseWrappingPolicyName:
+		policy, err := ParsePolicy(responseWrappingPolicyHCL, ResponseWrappingPolicyName)
+		if err != nil {
+			panic(err)
+		}
+		return policy
+	}
+	return nil
+}
+
+// Whether the RSoP includes the root policy, which makes every other policy moot.
+//
+// The root policy only exists in the root namespace.
+func (r *RSoP) IsRoot() bool {
+	for _, policy := range r.Policies {
+		if policy.Name == RootPolicyName && policy.Namespace == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Warnings returns things about the RSoP that need attention before anything else.
+func (r *RSoP) Warnings() []string {
+	var warnings []string
+	if r.IsRoot() {
+		warnings = append(warnings, "WARNING: the root policy is attached, which bypasses every ACL check including deny")
+	}
+	return warnings
+}
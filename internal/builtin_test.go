@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBuiltinPolicy(t *testing.T) {
+	t.Parallel()
+	if BuiltinPolicy(DefaultPolicyName) != nil {
+		t.Fatal("the default policy is a real document and should be read from Vault")
+	}
+	wrapping := BuiltinPolicy(ResponseWrappingPolicyName)
+	if diff := cmp.Diff(capsOnly(map[string]map[Capability][]string{
+		"cubbyhole/response":  {Create: {"response-wrapping"}, Read: {"response-wrapping"}},
+		"sys/wrapping/unwrap": {Update: {"response-wrapping"}},
+	}), (&RSoP{Policies: []*Policy{wrapping}}).GetCapabilityMap()); diff != "" {
+		t.Fatal(diff)
+	}
+	root := &RSoP{Policies: []*Policy{BuiltinPolicy(RootPolicyName), wrapping}}
+	if !root.IsRoot() {
+		t.Fatal("expected IsRoot()")
+	}
+	if !root.GetCapabilityMap().Match("anything/at/all").Allows(Sudo) {
+		t.Fatal("expected root to allow sudo anywhere")
+	}
+	denied := &RSoP{Policies: []*Policy{BuiltinPolicy(RootPolicyName), {Name: "denier", Paths: []PathConfig{{
+		Path:         "*",
+		Capabilities: []Capability{Deny},
+	}}}}}
+	if entry := denied.GetCapabilityMap()["*"]; len(entry.Preempted) != 0 || len(entry.Capabilities[Sudo]) == 0 {
+		t.Fatalf("expected deny not to preempt root: %+v", entry)
+	}
+	if hcl := root.HCL(); !strings.Contains(hcl, "# WARNING: the root policy is attached") {
+		t.Fatalf("expected a warning in HCL output:\n%s", hcl)
+	}
+	if warnings := (&RSoP{Policies: []*Policy{wrapping}}).Warnings(); len(warnings) != 0 {
+		t.Fatalf("unexpected warnings: %v", warnings)
+	}
+}
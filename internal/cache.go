@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The default amount of time a cached policy is used before revalidating it against Vault.
+const DefaultPolicyCacheTTL = time.Hour
+
+var (
+	ErrCacheCorrupt = errors.New("cached policy is corrupt")
+)
+
+// PolicyCache persists policies fetched from Vault to a directory.
+type PolicyCache struct {
+	dir string
+	ttl time.Duration
+	// overridden in tests
+	now func() time.Time
+}
+
+// A single cached policy, stored as JSON in <dir>/<cluster>/<name>.json, where <cluster> is a hash of the Vault address
+// and namespace the policy was read from.
+//
+// Names qualified by a namespace are stored in subdirectories, e.g. <dir>/<cluster>/eng/team/<name>.json.
+type policyCacheEntry struct {
+	Name string `json:"name"`
+	// hex-encoded SHA-256 of HCL
+	SHA256    string    `json:"sha256"`
+	FetchedAt time.Time `json:"fetched_at"`
+	HCL       string    `json:"hcl"`
+}
+
+// Creates a PolicyCache in dir, which is created if it doesn't exist, for policies read from the Vault at address with a
+// client in namespace. Clusters and namespaces that share dir never see each other's policies.
+//
+// Entries older than ttl are revalidated against Vault. A ttl of 0 always revalidates.
+func NewPolicyCache(dir, address, namespace string, ttl time.Duration) (*PolicyCache, error) {
+	sum := sha256.Sum256([]byte(address + "\x00" + NormalizeNamespace(namespace)))
+	dir = filepath.Join(dir, hex.EncodeToString(sum[:8]))
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, fmt.Errorf("error creating policy cache directory: %w", err)
+	}
+	return &PolicyCache{dir: dir, ttl: ttl, now: time.Now}, nil
+}
+
+func (c *PolicyCache) path(name string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(name)+".json")
+}
+
+// Reads a cache entry, which is nil on a miss.
+//
+// Entries whose content doesn't match their hash return ErrCacheCorrupt.
+func (c *PolicyCache) get(name string) (*policyCacheEntry, error) {
+	data, err := os.ReadFile(c.path(name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading cached policy: %w", err)
+	}
+	var entry policyCacheEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCacheCorrupt, err)
+	}
+	if entry.Name != name || entry.SHA256 != hashPolicy(entry.HCL) {
+		return nil, fmt.Errorf("%w: name or hash mismatch", ErrCacheCorrupt)
+	}
+	return &entry, nil
+}
+
+// Writes a cache entry fetched now, replacing any existing one.
+func (c *PolicyCache) put(name, hcl string) error {
+	data, err := json.MarshalIndent(policyCacheEntry{
+		Name:      name,
+		SHA256:    hashPolicy(hcl),
+		FetchedAt: c.now().UTC(),
+		HCL:       hcl,
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding cached policy: %w", err)
+	}
+	path := c.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return fmt.Errorf("error creating policy cache directory: %w", err)
+	}
+	// write then rename so concurrent readers never see a partial entry
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("error creating cached policy: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing cached policy: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing cached policy: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error writing cached policy: %w", err)
+	}
+	return nil
+}
+
+// Whether an entry is young enough to be used without revalidating it.
+func (c *PolicyCache) fresh(entry *policyCacheEntry) bool {
+	return c.now().Sub(entry.FetchedAt) < c.ttl
+}
+
+func hashPolicy(hcl string) string {
+	sum := sha256.Sum256([]byte(hcl))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPolicyCache(t *testing.T) {
+	t.Parallel()
+	const hcl = `
+path "secret/b" { capabilities = ["read"] }
+path "secret/a" { capabilities = ["list"] }
+`
+	cache, err := NewPolicyCache(t.TempDir(), "https://vault.example.com:8200", "", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+	if entry, err := cache.get("reader"); entry != nil || err != nil {
+		t.Fatalf("expected a miss, got %+v, %v", entry, err)
+	}
+	if err := cache.put("reader", hcl); err != nil {
+		t.Fatal(err)
+	}
+	entry, err := cache.get("reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cache.fresh(entry) {
+		t.Fatal("expected a fresh entry")
+	}
+	// cached policies must come back exactly like live ones
+	pp := &ReadthroughPolicyProvider{cache: cache}
+	cached, err := pp.GetPolicy(context.Background(), "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	live, err := ParsePolicy(hcl, "reader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(live, cached, cmp.FilterPath(func(p cmp.Path) bool {
+		return p.String() == "Paths.Other"
+	}, cmp.Ignore())); diff != "" {
+		t.Fatal(diff)
+	}
+	// stale entries are still used when Vault can't be asked
+	now = now.Add(2 * time.Hour)
+	if cache.fresh(entry) {
+		t.Fatal("expected a stale entry")
+	}
+	if _, err := pp.GetPolicy(context.Background(), "reader"); err != nil {
+		t.Fatalf("expected the stale entry to be used, got %v", err)
+	}
+	if _, err := pp.GetPolicy(context.Background(), "uncached"); err == nil {
+		t.Fatal("expected an error for an uncached policy without a Vault client")
+	}
+	// tampering is caught by the hash
+	data, err := os.ReadFile(cache.path("reader"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = []byte(string(data[:len(data)-3]) + "x\"\n}")
+	if err := os.WriteFile(cache.path("reader"), data, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.get("reader"); !errors.Is(err, ErrCacheCorrupt) {
+		t.Fatalf("expected ErrCacheCorrupt, got %v", err)
+	}
+}
+
+func TestPolicyCacheScope(t *testing.T) {
+	t.Parallel()
+	var (
+		dir  = t.TempDir()
+		open = func(address, namespace string, ttl time.Duration) *PolicyCache {
+			t.Helper()
+			cache, err := NewPolicyCache(dir, address, namespace, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return cache
+		}
+		cache = open("https://vault-a:8200", "", time.Hour)
+	)
+	if err := cache.put("reader", `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+	// another cluster or namespace sharing the directory doesn't see it
+	for _, other := range []*PolicyCache{
+		open("https://vault-b:8200", "", time.Hour),
+		open("https://vault-a:8200", "eng", time.Hour),
+	} {
+		if entry, err := other.get("reader"); entry != nil || err != nil {
+			t.Fatalf("expected a miss, got %+v, %v", entry, err)
+		}
+	}
+	// but the same one does, and a TTL of 0 always revalidates
+	again := open("https://vault-a:8200", "/", 0)
+	entry, err := again.get("reader")
+	if err != nil || entry == nil {
+		t.Fatalf("expected a hit, got %+v, %v", entry, err)
+	}
+	if again.fresh(entry) {
+		t.Fatal("expected a TTL of 0 to never be fresh")
+	}
+}
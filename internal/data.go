@@ -1,25 +1,53 @@
 package internal
 
 import (
+	"encoding/json"
 	"fmt"
+	"slices"
 	"sort"
+	"strings"
+	"time"
 
+	"github.com/hashicorp/go-secure-stdlib/parseutil"
 	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
 	"github.com/hashicorp/hcl/v2/hclsimple"
 	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/zclconf/go-cty/cty"
+	ctyjson "github.com/zclconf/go-cty/cty/json"
 )
 
 // Policy represents a Vault policy document.
 type Policy struct {
 	// The name of the policy in Vault - this attribute is not in the document.
 	Name string `hcl:",optional"`
+	// The namespace the policy is in, e.g. "eng/team/", or "" for the root namespace - this attribute is not in the document.
+	Namespace string
+	// How the policy was attached to a principal, if known - this attribute is not in the document.
+	Sources []PolicySource
 	// All of the path {} declarations. These should be sorted by PathConfig.Path, ascending.
 	Paths []PathConfig `hcl:"path,block"`
 }
 
+// QualifiedName is the name of the policy prefixed by its namespace, e.g. "eng/team/reader".
+func (p *Policy) QualifiedName() string {
+	return p.Namespace + p.Name
+}
+
 // MarshalZerologObject implements zerolog.LogObjectMarshaler.
 func (p Policy) MarshalZerologObject(e *zerolog.Event) {
 	e.Str("Name", p.Name)
+	if p.Namespace != "" {
+		e.Str("Namespace", p.Namespace)
+	}
+	if len(p.Sources) > 0 {
+		sources := make([]string, len(p.Sources))
+		for i, source := range p.Sources {
+			sources[i] = source.String()
+		}
+		e.Strs("Sources", sources)
+	}
 	arr := zerolog.Arr()
 	for _, p := range p.Paths {
 		arr.Object(p)
@@ -27,11 +55,55 @@ func (p Policy) MarshalZerologObject(e *zerolog.Event) {
 	e.Array("Paths", arr)
 }
 
+// Kinds of PolicySource.
+const (
+	SourceToken  = "token"
+	SourceRole   = "role"
+	SourceEntity = "entity"
+	SourceGroup  = "group"
+	// Attached by Vault without being asked for, like the default policy.
+	SourceImplicit = "implicit"
+	// Granted by a group in another namespace, which is the only element of Via.
+	SourceNamespace = "namespace"
+)
+
+// PolicySource describes how a policy was attached to a principal.
+type PolicySource struct {
+	// One of the Source* constants.
+	Kind string
+	// Names of the entity or groups the policy was reached through, starting closest to the principal.
+	Via []string `json:",omitempty"`
+}
+
+// e.g. "group devs -> engineering"
+func (s PolicySource) String() string {
+	if len(s.Via) == 0 {
+		return s.Kind
+	}
+	return s.Kind + " " + strings.Join(s.Via, " -> ")
+}
+
 // PathConfig represents a Vault path block
 type PathConfig struct {
 	Path         string       `hcl:"path,label"`
 	Capabilities []Capability `hcl:"capabilities"`
 
+	// The following are populated by ParsePolicy from Other.
+
+	// Parameter name -> JSON-encoded values allowed. An empty slice allows any value.
+	AllowedParameters map[string][]string
+	// Parameter name -> JSON-encoded values denied. An empty slice denies any value.
+	DeniedParameters map[string][]string
+	// Parameters that must be present in a request.
+	RequiredParameters []string
+	// Bounds on the TTL of a response-wrapped request, zero if unset.
+	MinWrappingTTL time.Duration
+	MaxWrappingTTL time.Duration
+	// Names of MFA methods that must be satisfied.
+	MFAMethods []string
+	// Authorizations required before a request is allowed.
+	ControlGroup *ControlGroup
+
 	// Captures other arguments we don't care about yet.
 	// https://github.com/hashicorp/vault/blob/9bb4f9e996eb6d35617a0624f2c1232e25d75f3c/vault/policy.go#L129-L147
 	Other hcl.Body `hcl:",remain"`
@@ -41,6 +113,140 @@ type PathConfig struct {
 func (p PathConfig) MarshalZerologObject(e *zerolog.Event) {
 	e.Str("Path", p.Path)
 	e.Any("Capabilities", p.Capabilities)
+	if len(p.AllowedParameters) > 0 {
+		e.Any("AllowedParameters", p.AllowedParameters)
+	}
+	if len(p.DeniedParameters) > 0 {
+		e.Any("DeniedParameters", p.DeniedParameters)
+	}
+	if len(p.RequiredParameters) > 0 {
+		e.Strs("RequiredParameters", p.RequiredParameters)
+	}
+	if p.MinWrappingTTL > 0 {
+		e.Dur("MinWrappingTTL", p.MinWrappingTTL)
+	}
+	if p.MaxWrappingTTL > 0 {
+		e.Dur("MaxWrappingTTL", p.MaxWrappingTTL)
+	}
+	if len(p.MFAMethods) > 0 {
+		e.Strs("MFAMethods", p.MFAMethods)
+	}
+	if p.ControlGroup != nil {
+		e.Any("ControlGroup", p.ControlGroup)
+	}
+}
+
+// the arguments of a path block that need massaging before they're useful
+type pathConstraintsHCL struct {
+	AllowedParameters  cty.Value `hcl:"allowed_parameters,optional"`
+	DeniedParameters   cty.Value `hcl:"denied_parameters,optional"`
+	RequiredParameters []string  `hcl:"required_parameters,optional"`
+	MinWrappingTTL     cty.Value `hcl:"min_wrapping_ttl,optional"`
+	MaxWrappingTTL     cty.Value `hcl:"max_wrapping_ttl,optional"`
+	MFAMethods         []string  `hcl:"mfa_methods,optional"`
+
+	ControlGroup *struct {
+		TTL     cty.Value `hcl:"ttl,optional"`
+		Factors []struct {
+			Name     string `hcl:"name,label"`
+			Identity *struct {
+				GroupIDs   []string `hcl:"group_ids,optional"`
+				GroupNames []string `hcl:"group_names,optional"`
+				Approvals  int      `hcl:"approvals,optional"`
+			} `hcl:"identity,block"`
+			ControlledCapabilities []Capability `hcl:"controlled_capabilities,optional"`
+		} `hcl:"factor,block"`
+	} `hcl:"control_group,block"`
+
+	Other hcl.Body `hcl:",remain"`
+}
+
+// Decodes constraints out of PathConfig.Other into their typed fields.
+func (p *PathConfig) decodeConstraints() error {
+	if p.Other == nil {
+		return nil
+	}
+	var raw pathConstraintsHCL
+	if diags := gohcl.DecodeBody(p.Other, nil, &raw); diags.HasErrors() {
+		return diags
+	}
+	var err error
+	if p.AllowedParameters, err = decodeParameters(raw.AllowedParameters); err != nil {
+		return fmt.Errorf("error decoding allowed_parameters of path '%s': %w", p.Path, err)
+	}
+	if p.DeniedParameters, err = decodeParameters(raw.DeniedParameters); err != nil {
+		return fmt.Errorf("error decoding denied_parameters of path '%s': %w", p.Path, err)
+	}
+	p.RequiredParameters = raw.RequiredParameters
+	if p.MinWrappingTTL, err = decodeDuration(raw.MinWrappingTTL); err != nil {
+		return fmt.Errorf("error decoding min_wrapping_ttl of path '%s': %w", p.Path, err)
+	}
+	if p.MaxWrappingTTL, err = decodeDuration(raw.MaxWrappingTTL); err != nil {
+		return fmt.Errorf("error decoding max_wrapping_ttl of path '%s': %w", p.Path, err)
+	}
+	p.MFAMethods = raw.MFAMethods
+	if cg := raw.ControlGroup; cg != nil {
+		p.ControlGroup = &ControlGroup{}
+		if p.ControlGroup.TTL, err = decodeDuration(cg.TTL); err != nil {
+			return fmt.Errorf("error decoding control_group ttl of path '%s': %w", p.Path, err)
+		}
+		for _, factor := range cg.Factors {
+			f := ControlGroupFactor{
+				Name:                   factor.Name,
+				ControlledCapabilities: factor.ControlledCapabilities,
+			}
+			if factor.Identity != nil {
+				f.GroupIDs = factor.Identity.GroupIDs
+				f.GroupNames = factor.Identity.GroupNames
+				f.Approvals = factor.Identity.Approvals
+			}
+			p.ControlGroup.Factors = append(p.ControlGroup.Factors, f)
+		}
+	}
+	p.Other = raw.Other
+	return nil
+}
+
+// Decodes a duration that's either a string like "300s" or a number of seconds, like Vault does.
+func decodeDuration(val cty.Value) (time.Duration, error) {
+	if val == cty.NilVal || val.IsNull() {
+		return 0, nil
+	}
+	switch val.Type() {
+	case cty.String:
+		return parseutil.ParseDurationSecond(val.AsString())
+	case cty.Number:
+		return parseutil.ParseDurationSecond(json.Number(val.AsBigFloat().Text('f', -1)))
+	}
+	return 0, fmt.Errorf("expected a string or number, got %s", val.Type().FriendlyName())
+}
+
+// Turns an object of parameter name -> list of values into a map of JSON-encoded values.
+func decodeParameters(val cty.Value) (map[string][]string, error) {
+	if val == cty.NilVal || val.IsNull() {
+		return nil, nil
+	}
+	if !val.Type().IsObjectType() && !val.Type().IsMapType() {
+		return nil, fmt.Errorf("expected an object, got %s", val.Type().FriendlyName())
+	}
+	params := make(map[string][]string, val.LengthInt())
+	for it := val.ElementIterator(); it.Next(); {
+		key, values := it.Element()
+		if !values.CanIterateElements() {
+			return nil, fmt.Errorf("expected a list of values for '%s', got %s", key.AsString(), values.Type().FriendlyName())
+		}
+		encoded := make([]string, 0, values.LengthInt())
+		for vit := values.ElementIterator(); vit.Next(); {
+			_, value := vit.Element()
+			data, err := ctyjson.Marshal(value, value.Type())
+			if err != nil {
+				return nil, fmt.Errorf("error encoding value of '%s': %w", key.AsString(), err)
+			}
+			encoded = append(encoded, string(data))
+		}
+		params[key.AsString()] = encoded
+	}
+	return params, nil
 }
 
 // ParsePolicy creates a Policy object and sorts by path.
@@ -49,6 +255,16 @@ func ParsePolicy(policyData, name string) (*Policy, error) {
 	if err := hclsimple.Decode(name+".hcl", []byte(policyData), nil, &policy); err != nil {
 		return nil, fmt.Errorf("error parsing policy HCL: %w", err)
 	}
+	for i := range policy.Paths {
+		if err := policy.Paths[i].decodeConstraints(); err != nil {
+			return nil, fmt.Errorf("error parsing policy HCL: %w", err)
+		}
+		// Vault accepts policies with templates it can't render and drops those paths per request, and so does
+		// RenderTemplates
+		if err := validateTemplates(policy.Paths[i].Path); err != nil {
+			log.Warn().Err(err).Str("policy", name).Msg("templated path can never be rendered")
+		}
+	}
 	// sort by path
 	sort.Slice(policy.Paths, func(i, j int) bool {
 		return policy.Paths[i].Path < policy.Paths[j].Path
@@ -57,9 +273,52 @@ func ParsePolicy(policyData, name string) (*Policy, error) {
 	return &policy, nil
 }
 
+// ControlGroup represents a control_group block.
+//
+// https://developer.hashicorp.com/vault/docs/enterprise/control-groups
 type ControlGroup struct {
-	TTL     any
-	Factors map[string]any
+	TTL     time.Duration
+	Factors []ControlGroupFactor
+}
+
+// ControlGroupFactor represents a factor block of a control group.
+type ControlGroupFactor struct {
+	Name       string   `json:"name"`
+	GroupIDs   []string `json:"group_ids,omitempty"`
+	GroupNames []string `json:"group_names,omitempty"`
+	// Approvals required from the identity groups above.
+	Approvals int `json:"approvals"`
+	// If set, the control group only applies to these capabilities.
+	ControlledCapabilities []Capability `json:"controlled_capabilities,omitempty"`
+}
+
+// Whether two factors are identical.
+func (f ControlGroupFactor) Equal(other ControlGroupFactor) bool {
+	return f.Name == other.Name &&
+		f.Approvals == other.Approvals &&
+		slices.Equal(f.GroupIDs, other.GroupIDs) &&
+		slices.Equal(f.GroupNames, other.GroupNames) &&
+		slices.Equal(f.ControlledCapabilities, other.ControlledCapabilities)
+}
+
+// Describes the factor on a single line.
+func (f ControlGroupFactor) String() string {
+	var requirements []string
+	if len(f.GroupNames) > 0 {
+		requirements = append(requirements, "group_names: "+strings.Join(f.GroupNames, ", "))
+	}
+	if len(f.GroupIDs) > 0 {
+		requirements = append(requirements, "group_ids: "+strings.Join(f.GroupIDs, ", "))
+	}
+	requirements = append(requirements, fmt.Sprintf("approvals: %d", f.Approvals))
+	if len(f.ControlledCapabilities) > 0 {
+		caps := make([]string, len(f.ControlledCapabilities))
+		for i, cap := range f.ControlledCapabilities {
+			caps[i] = string(cap)
+		}
+		requirements = append(requirements, "controlled_capabilities: "+strings.Join(caps, ", "))
+	}
+	return fmt.Sprintf("%q (%s)", f.Name, strings.Join(requirements, "; "))
 }
 
 // Capabilities declare what a token can do to a path.
@@ -71,6 +330,7 @@ const (
 	Create    Capability = "create"
 	Read      Capability = "read"
 	Update    Capability = "update"
+	Patch     Capability = "patch"
 	Delete    Capability = "delete"
 	List      Capability = "list"
 	Sudo      Capability = "sudo"
@@ -84,8 +344,10 @@ func (c Capability) Less(other Capability) bool {
 	case Create:
 		return other != Create
 	case Read:
-		return contains(other, Update, Delete, List, Sudo, Deny, Subscribe)
+		return contains(other, Update, Patch, Delete, List, Sudo, Deny, Subscribe)
 	case Update:
+		return contains(other, Patch, Delete, List, Sudo, Deny, Subscribe)
+	case Patch:
 		return contains(other, Delete, List, Sudo, Deny, Subscribe)
 	case Delete:
 		return contains(other, List, Sudo, Deny, Subscribe)
@@ -99,6 +361,30 @@ func (c Capability) Less(other Capability) bool {
 	panic(fmt.Sprintf("unsupported comparison capability: '%s'", other))
 }
 
+// ParseOperation turns a capability name or HTTP verb into the capabilities that would satisfy it.
+//
+// POST and PUT are either a create or an update depending on whether the path exists, so both are returned.
+func ParseOperation(operation string) ([]Capability, error) {
+	switch strings.ToUpper(operation) {
+	case "GET":
+		return []Capability{Read}, nil
+	case "LIST":
+		return []Capability{List}, nil
+	case "POST", "PUT":
+		return []Capability{Create, Update}, nil
+	case "PATCH":
+		return []Capability{Patch}, nil
+	case "DELETE":
+		return []Capability{Delete}, nil
+	}
+	cap := Capability(strings.ToLower(operation))
+	switch cap {
+	case Create, Read, Update, Patch, Delete, List, Sudo, Subscribe:
+		return []Capability{cap}, nil
+	}
+	return nil, fmt.Errorf("unknown capability or HTTP verb: '%s'", operation)
+}
+
 func contains[T comparable](needle T, haystack ...T) bool {
 	for _, item := range haystack {
 		if needle == item {
@@ -3,6 +3,7 @@ package internal_test
 import (
 	_ "embed"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/hashicorp/hcl/v2/hclsimple"
@@ -38,3 +39,106 @@ func TestHCL(t *testing.T) {
 		t.Fatal(diff)
 	}
 }
+
+func TestParseOperation(t *testing.T) {
+	for op, expected := range map[string][]internal.Capability{
+		"GET":    {internal.Read},
+		"list":   {internal.List},
+		"PUT":    {internal.Create, internal.Update},
+		"patch":  {internal.Patch},
+		"sudo":   {internal.Sudo},
+		"Delete": {internal.Delete},
+	} {
+		caps, err := internal.ParseOperation(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(expected, caps); diff != "" {
+			t.Fatalf("%s: %s", op, diff)
+		}
+	}
+	if _, err := internal.ParseOperation("deny"); err == nil {
+		t.Fatal("expected an error for deny")
+	}
+}
+
+//go:embed testdata/upstream.hcl
+var upstreamHCL string
+
+func TestParsePolicyParameters(t *testing.T) {
+	policy, err := internal.ParsePolicy(upstreamHCL, "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := map[string]internal.PathConfig{}
+	for _, path := range policy.Paths {
+		path.Other = nil
+		paths[path.Path] = path
+	}
+	if diff := cmp.Diff(internal.PathConfig{
+		Path:         "test/types",
+		Capabilities: []internal.Capability{internal.Create, internal.Sudo},
+		AllowedParameters: map[string][]string{
+			"int": {"1", "2"},
+			"map": {`{"good":"one"}`},
+		},
+		DeniedParameters: map[string][]string{
+			"bool":   {"false"},
+			"string": {`"test"`},
+		},
+	}, paths["test/types"]); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff([]string{"foo"}, paths["test/req"].RequiredParameters); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff(map[string][]string{"zip": {}, "zap": {}}, paths["baz/bar"].DeniedParameters); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestParsePolicyConstraints(t *testing.T) {
+	policy, err := internal.ParsePolicy(upstreamHCL+`
+path "test/control-group" {
+	capabilities = ["read"]
+	control_group {
+		ttl = "4h"
+		factor "ops_manager" {
+			identity {
+				group_names = ["managers"]
+				approvals = 1
+			}
+			controlled_capabilities = ["read"]
+		}
+	}
+}`, "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths := map[string]internal.PathConfig{}
+	for _, path := range policy.Paths {
+		path.Other = nil
+		// foo/bar is declared twice
+		if existing, exists := paths[path.Path]; exists && existing.MinWrappingTTL > 0 {
+			continue
+		}
+		paths[path.Path] = path
+	}
+	if foobar := paths["foo/bar"]; foobar.MinWrappingTTL != 300*time.Second || foobar.MaxWrappingTTL != time.Hour {
+		t.Fatalf("unexpected wrapping TTLs: %s, %s", foobar.MinWrappingTTL, foobar.MaxWrappingTTL)
+	}
+	if diff := cmp.Diff([]string{"my_totp", "my_totp2"}, paths["test/mfa"].MFAMethods); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff(&internal.ControlGroup{
+		TTL: 4 * time.Hour,
+		Factors: []internal.ControlGroupFactor{{
+			Name:                   "ops_manager",
+			GroupNames:             []string{"managers"},
+			Approvals:              1,
+			ControlledCapabilities: []internal.Capability{internal.Read},
+		}},
+	}, paths["test/control-group"].ControlGroup); diff != "" {
+		t.Fatal(diff)
+	}
+}
@@ -0,0 +1,411 @@
+package gitops
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+	"github.com/threatkey-oss/hvresult/internal"
+)
+
+var (
+	ErrPlanStale = errors.New("live Vault state changed since the plan was computed")
+)
+
+// Plan is the set of operations that make Vault match a gitops directory.
+type Plan struct {
+	// The gitops directory the plan was computed from.
+	Directory  string          `json:"directory"`
+	CreatedAt  time.Time       `json:"created_at"`
+	Operations []PlanOperation `json:"operations"`
+}
+
+// PlanOperation is a single request to Vault.
+type PlanOperation struct {
+	// PUT, PATCH, or DELETE.
+	Method string `json:"method"`
+	// Relative to Namespace, e.g. "sys/policies/acl/devs" or "auth/gcp/role/foo".
+	Path      string `json:"path"`
+	Namespace string `json:"namespace,omitempty"`
+	// The request body, if any.
+	Data map[string]any `json:"data,omitempty"`
+	// SHA-256 of the live state the operation was planned against, or "" if it didn't exist.
+	LiveSHA256 string `json:"live_sha256"`
+}
+
+// Like "PUT eng/sys/policies/acl/devs".
+func (o PlanOperation) String() string {
+	return o.Method + " " + o.Namespace + o.Path
+}
+
+// Whether the plan changes nothing.
+func (p *Plan) Empty() bool {
+	return p == nil || len(p.Operations) == 0
+}
+
+// ReadPlan reads a plan written by WritePlan.
+func ReadPlan(path string) (*Plan, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading plan: %w", err)
+	}
+	var plan Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("error unmarshalling plan: %w", err)
+	}
+	return &plan, nil
+}
+
+// WritePlan writes a plan as indented JSON.
+func WritePlan(path string, plan *Plan) error {
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding plan: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o640); err != nil {
+		return fmt.Errorf("error writing plan: %w", err)
+	}
+	return nil
+}
+
+// ComputePlan compares the working copy of a gitops directory to live Vault.
+//
+// Policies are created, updated, and deleted to match sys/policies/acl. Auth principals are only patched
+// when their policy fields differ, since the directory doesn't have enough to create or delete them.
+// Namespaces are only considered if they're in the directory.
+func ComputePlan(ctx context.Context, vc *vault.Client, directory string) (*Plan, error) {
+	namespaces, err := localNamespaces(directory)
+	if err != nil {
+		return nil, err
+	}
+	var puts, patches, deletes []PlanOperation
+	for _, namespace := range namespaces {
+		nsClient := internal.NamespacedClient(vc, namespace)
+		policyPuts, policyDeletes, err := planPolicies(ctx, nsClient, namespace, filepath.Join(directory, namespacePolicyDirectory(namespace)))
+		if err != nil {
+			return nil, err
+		}
+		principalPatches, err := planPrincipals(ctx, nsClient, namespace, directory)
+		if err != nil {
+			return nil, err
+		}
+		puts = append(puts, policyPuts...)
+		patches = append(patches, principalPatches...)
+		deletes = append(deletes, policyDeletes...)
+	}
+	// create policies before principals reference them, and delete them after they don't
+	return &Plan{
+		Directory:  directory,
+		CreatedAt:  time.Now().UTC(),
+		Operations: append(append(puts, patches...), deletes...),
+	}, nil
+}
+
+// Lists the namespaces in a gitops directory, starting with the root namespace "".
+func localNamespaces(directory string) ([]string, error) {
+	var (
+		namespaces = []string{""}
+		seen       = map[string]bool{"": true}
+		walkRoot   = filepath.Join(directory, namespacesDirectory)
+	)
+	// namespaces nest, so look for every directory with a sys/ or auth/ in it
+	err := filepath.WalkDir(walkRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == walkRoot && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() || (d.Name() != "sys" && d.Name() != "auth") {
+			return nil
+		}
+		relPath, err := filepath.Rel(directory, path)
+		if err != nil {
+			return err
+		}
+		if namespace, _ := SplitNamespace(relPath); !seen[namespace] {
+			seen[namespace] = true
+			namespaces = append(namespaces, namespace)
+		}
+		return filepath.SkipDir
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error walking namespace directory: %w", err)
+	}
+	return namespaces, nil
+}
+
+func planPolicies(ctx context.Context, vc *vault.Client, namespace, policyDirectory string) (puts, deletes []PlanOperation, err error) {
+	local := map[string]string{}
+	entries, err := os.ReadDir(policyDirectory)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, fmt.Errorf("error reading policy directory: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(policyDirectory, entry.Name()))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading policy file: %w", err)
+		}
+		local[entry.Name()] = string(data)
+	}
+	vaultSys := vc.Sys()
+	liveNames, err := vaultSys.ListPoliciesWithContext(ctx)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing Vault policies: %w", err)
+	}
+	live := make(map[string]string, len(liveNames))
+	for _, name := range liveNames {
+		if live[name], err = vaultSys.GetPolicyWithContext(ctx, name); err != nil {
+			return nil, nil, fmt.Errorf("error reading policy '%s': %w", name, err)
+		}
+	}
+	for _, name := range sortedKeys(local) {
+		liveHCL, exists := live[name]
+		if exists && strings.TrimSpace(liveHCL) == strings.TrimSpace(local[name]) {
+			continue
+		}
+		if _, err := internal.ParsePolicy(local[name], name); err != nil {
+			return nil, nil, fmt.Errorf("refusing to plan invalid policy '%s': %w", name, err)
+		}
+		op := PlanOperation{
+			Method:    http.MethodPut,
+			Path:      "sys/policies/acl/" + name,
+			Namespace: namespace,
+			Data:      map[string]any{"policy": local[name]},
+		}
+		if exists {
+			op.LiveSHA256 = hashState(liveHCL)
+		}
+		puts = append(puts, op)
+	}
+	for _, name := range sortedKeys(live) {
+		// Vault won't delete these
+		if _, exists := local[name]; exists || name == internal.DefaultPolicyName || name == internal.RootPolicyName {
+			continue
+		}
+		deletes = append(deletes, PlanOperation{
+			Method:     http.MethodDelete,
+			Path:       "sys/policies/acl/" + name,
+			Namespace:  namespace,
+			LiveSHA256: hashState(live[name]),
+		})
+	}
+	return puts, deletes, nil
+}
+
+func planPrincipals(ctx context.Context, vc *vault.Client, namespace, directory string) ([]PlanOperation, error) {
+	var (
+		patches      []PlanOperation
+		vaultLogical = vc.Logical()
+		walkRoot     = filepath.Join(directory, namespacePrincipalDirectory(namespace))
+	)
+	err := filepath.WalkDir(walkRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == walkRoot && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		relPath, err := filepath.Rel(directory, path)
+		if err != nil {
+			return fmt.Errorf("error getting relative path to auth principal: %w", err)
+		}
+		_, vaultPath := SplitNamespace(relPath)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading auth principal file: %w", err)
+		}
+		var local authPrincipalData
+		if err := json.Unmarshal(content, &local); err != nil {
+			return fmt.Errorf("error unmarshalling %s as auth principal data: %w", relPath, err)
+		}
+		secret, err := vaultLogical.ReadWithContext(ctx, vaultPath)
+		if err != nil {
+			return fmt.Errorf("error reading auth principal '%s': %w", vaultPath, err)
+		}
+		if secret == nil || secret.Data == nil {
+			log.Warn().Str("path", namespace+vaultPath).Msg("auth principal doesn't exist in Vault and can't be created without its full configuration, skipping")
+			return nil
+		}
+		live, err := decodeAuthPrincipal(secret.Data, knownPolicyFields)
+		if err != nil {
+			return fmt.Errorf("error decoding auth principal '%s': %w", vaultPath, err)
+		}
+		if data := policyFieldChanges(live, local, secret.Data); len(data) > 0 {
+			patches = append(patches, PlanOperation{
+				Method:     http.MethodPatch,
+				Path:       vaultPath,
+				Namespace:  namespace,
+				Data:       data,
+				LiveSHA256: hashPrincipal(live),
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error planning auth principals: %w", err)
+	}
+	return patches, nil
+}
+
+// Returns the policy fields of local that differ from live, limited to fields the live principal has.
+func policyFieldChanges(live, local authPrincipalData, liveData map[string]any) map[string]any {
+	changes := map[string]any{}
+	for field, values := range map[string][2][]string{
+		"policies":         {live.Policies, local.Policies},
+		"token_policies":   {live.TokenPolicies, local.TokenPolicies},
+		"allowed_policies": {live.AllowedPolicies, local.AllowedPolicies},
+	} {
+		if _, supported := liveData[field]; !supported {
+			continue
+		}
+		if !sameStrings(values[0], values[1]) {
+			changes[field] = nonNil(values[1])
+		}
+	}
+	// GitHub team and user maps
+	if _, supported := liveData["value"]; supported && !sameStrings(live.Policies, local.Policies) {
+		changes["value"] = strings.Join(local.Policies, ",")
+	}
+	if _, supported := liveData["token_no_default_policy"]; supported && live.TokenNoDefaultPolicy != local.TokenNoDefaultPolicy {
+		changes["token_no_default_policy"] = local.TokenNoDefaultPolicy
+	}
+	return changes
+}
+
+// ApplyPlan checks that live Vault still matches what the plan was computed against, then executes it.
+//
+// Nothing is written if any operation is stale.
+func ApplyPlan(ctx context.Context, vc *vault.Client, plan *Plan) error {
+	var stale []string
+	for _, op := range plan.Operations {
+		current, err := liveStateHash(ctx, vc, op)
+		if err != nil {
+			return err
+		}
+		if current != op.LiveSHA256 {
+			stale = append(stale, op.String())
+		}
+	}
+	if len(stale) > 0 {
+		return fmt.Errorf("%w, compute a new plan: %s", ErrPlanStale, strings.Join(stale, ", "))
+	}
+	for _, op := range plan.Operations {
+		logger := log.With().Stringer("operation", op).Logger()
+		logical := internal.NamespacedClient(vc, op.Namespace).Logical()
+		var err error
+		switch op.Method {
+		case http.MethodPut:
+			_, err = logical.WriteWithContext(ctx, op.Path, op.Data)
+		case http.MethodDelete:
+			_, err = logical.DeleteWithContext(ctx, op.Path)
+		case http.MethodPatch:
+			err = patchPrincipal(ctx, logical, op)
+		default:
+			err = fmt.Errorf("unknown method '%s'", op.Method)
+		}
+		if err != nil {
+			return fmt.Errorf("error applying %s: %w", op, err)
+		}
+		logger.Info().Msg("applied")
+	}
+	return nil
+}
+
+// Patches only the policy fields of a principal so bound claims, TTLs, etc. are left alone.
+func patchPrincipal(ctx context.Context, logical *vault.Logical, op PlanOperation) error {
+	_, err := logical.JSONMergePatch(ctx, op.Path, op.Data)
+	var respErr *vault.ResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusMethodNotAllowed {
+		return err
+	}
+	// most auth methods don't support PATCH, but treat a write to an existing role as a partial update. Writing back the
+	// rest of the role would send computed fields and deprecated aliases, and undo changes made since the stale check.
+	log.Debug().Stringer("operation", op).Msg("PATCH unsupported, writing only the policy fields instead")
+	_, err = logical.WriteWithContext(ctx, op.Path, op.Data)
+	return err
+}
+
+// Hashes the live state an operation affects, the same way it was hashed when planned.
+func liveStateHash(ctx context.Context, vc *vault.Client, op PlanOperation) (string, error) {
+	nsClient := internal.NamespacedClient(vc, op.Namespace)
+	if name, isPolicy := strings.CutPrefix(op.Path, "sys/policies/acl/"); isPolicy {
+		hcl, err := nsClient.Sys().GetPolicyWithContext(ctx, name)
+		if err != nil {
+			return "", fmt.Errorf("error reading policy '%s': %w", name, err)
+		}
+		// not found
+		if hcl == "" {
+			return "", nil
+		}
+		return hashState(hcl), nil
+	}
+	secret, err := nsClient.Logical().ReadWithContext(ctx, op.Path)
+	if err != nil {
+		return "", fmt.Errorf("error reading auth principal '%s': %w", op.Path, err)
+	}
+	if secret == nil || secret.Data == nil {
+		return "", nil
+	}
+	live, err := decodeAuthPrincipal(secret.Data, knownPolicyFields)
+	if err != nil {
+		return "", fmt.Errorf("error decoding auth principal '%s': %w", op.Path, err)
+	}
+	return hashPrincipal(live), nil
+}
+
+// Hashes only the policy fields, which are all a plan changes.
+func hashPrincipal(data authPrincipalData) string {
+	data.Config = nil
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		panic(err)
+	}
+	return hashState(string(encoded))
+}
+
+func hashState(state string) string {
+	sum := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(sum[:])
+}
+
+func sameStrings(a, b []string) bool {
+	a, b = append([]string{}, a...), append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return strings.Join(a, "\x00") == strings.Join(b, "\x00")
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
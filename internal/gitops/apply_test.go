@@ -0,0 +1,111 @@
+package gitops_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+	"github.com/threatkey-oss/hvresult/internal/testcluster"
+)
+
+func TestApply(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		client    = testcluster.NewTestCluster(t)
+		directory = t.TempDir()
+	)
+	for name, hcl := range map[string]string{
+		"old":   `path "secret/old" { capabilities = ["read"] }`,
+		"stale": `path "secret/stale" { capabilities = ["read"] }`,
+	} {
+		if err := client.Sys().PutPolicy(name, hcl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := client.Logical().Write("auth/token/roles/app", map[string]any{
+		"allowed_policies": []string{"old"},
+		"orphan":           true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gitops.DownloadAuth(ctx, client, filepath.Join(directory, "auth"), gitops.DownloadOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitops.DownloadPolicies(ctx, client, filepath.Join(directory, "sys", "policies", "acl")); err != nil {
+		t.Fatal(err)
+	}
+	// nothing changed yet
+	plan, err := gitops.ComputePlan(ctx, client, directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.Empty() {
+		t.Fatalf("expected an empty plan, got %v", plan.Operations)
+	}
+	// add a policy, assign it, and delete one
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(directory, filepath.FromSlash(path)), []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("sys/policies/acl/new", `path "secret/new" { capabilities = ["read"] }`)
+	write("auth/token/roles/app", `{"allowed_policies": ["new"]}`)
+	if err := os.Remove(filepath.Join(directory, "sys", "policies", "acl", "stale")); err != nil {
+		t.Fatal(err)
+	}
+	plan, err = gitops.ComputePlan(ctx, client, directory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []string
+	for _, op := range plan.Operations {
+		ops = append(ops, op.String())
+	}
+	expected := []string{"PUT sys/policies/acl/new", "PATCH auth/token/roles/app", "DELETE sys/policies/acl/stale"}
+	if len(ops) != len(expected) || ops[0] != expected[0] || ops[1] != expected[1] || ops[2] != expected[2] {
+		t.Fatalf("expected %v, got %v", expected, ops)
+	}
+	planPath := filepath.Join(t.TempDir(), "plan.json")
+	if err := gitops.WritePlan(planPath, plan); err != nil {
+		t.Fatal(err)
+	}
+	if plan, err = gitops.ReadPlan(planPath); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Stale", func(t *testing.T) {
+		if err := client.Sys().PutPolicy("stale", `path "secret/changed" { capabilities = ["read"] }`); err != nil {
+			t.Fatal(err)
+		}
+		if err := gitops.ApplyPlan(ctx, client, plan); !errors.Is(err, gitops.ErrPlanStale) {
+			t.Fatalf("expected ErrPlanStale, got %v", err)
+		}
+		// nothing was written
+		if hcl, _ := client.Sys().GetPolicy("new"); hcl != "" {
+			t.Fatal("expected no writes from a stale plan")
+		}
+		if err := client.Sys().PutPolicy("stale", `path "secret/stale" { capabilities = ["read"] }`); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if err := gitops.ApplyPlan(ctx, client, plan); err != nil {
+		t.Fatal(err)
+	}
+	role, err := client.Logical().Read("auth/token/roles/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policies := role.Data["allowed_policies"].([]any); len(policies) != 1 || policies[0] != "new" {
+		t.Fatalf("expected allowed_policies to be patched, got %v", policies)
+	}
+	if role.Data["orphan"] != true {
+		t.Fatalf("expected orphan to be left alone, got %v", role.Data["orphan"])
+	}
+	if hcl, _ := client.Sys().GetPolicy("stale"); hcl != "" {
+		t.Fatal("expected the stale policy to be deleted")
+	}
+}
@@ -0,0 +1,282 @@
+package gitops
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// BindingChange is a change to a field of an auth principal other than its policies, like a bound claim or token TTL.
+type BindingChange struct {
+	Field string `json:"field"`
+	// nil when the field didn't exist
+	Old any `json:"old"`
+	// nil when the field was removed
+	New any `json:"new"`
+	// Whether the principal accepts logins it didn't before, e.g. a binding became a wildcard or was removed.
+	Widened bool `json:"widened"`
+	// Describes a widened binding, e.g. "now accepts any service account in namespace `prod`".
+	description string
+}
+
+func (c BindingChange) String() string {
+	switch {
+	case c.description != "":
+		return c.description
+	case c.Old == nil:
+		return fmt.Sprintf("`%s` set to %s", c.Field, formatBinding(c.New))
+	case c.New == nil:
+		return fmt.Sprintf("`%s` removed (was %s)", c.Field, formatBinding(c.Old))
+	default:
+		return fmt.Sprintf("`%s` changed from %s to %s", c.Field, formatBinding(c.Old), formatBinding(c.New))
+	}
+}
+
+// MarshalJSON includes the description from String().
+func (c BindingChange) MarshalJSON() ([]byte, error) {
+	type bindingChangeJSON BindingChange
+	return json.Marshal(struct {
+		bindingChangeJSON
+		Description string `json:"description"`
+	}{bindingChangeJSON(c), c.String()})
+}
+
+// What each bound_* field restricts, for describing changes to it.
+var bindingNouns = map[string]string{
+	"bound_account_id":                 "account",
+	"bound_ami_id":                     "AMI",
+	"bound_audiences":                  "audience",
+	"bound_cidrs":                      "source address",
+	"bound_claims":                     "claim",
+	"bound_group_ids":                  "group",
+	"bound_groups":                     "group",
+	"bound_iam_principal_arn":          "IAM principal",
+	"bound_iam_role_arn":               "IAM role",
+	"bound_projects":                   "project",
+	"bound_resource_groups":            "resource group",
+	"bound_service_account_names":      "service account",
+	"bound_service_account_namespaces": "namespace",
+	"bound_service_accounts":           "service account",
+	"bound_subject":                    "subject",
+	"bound_subscription_ids":           "subscription",
+	"secret_id_bound_cidrs":            "source address",
+	"token_bound_cidrs":                "source address",
+}
+
+// Bindings that are only meaningful within another, e.g. service account names within namespaces.
+var bindingScopes = map[string]string{
+	"bound_service_account_names": "bound_service_account_namespaces",
+}
+
+// Values that match anything.
+var bindingWildcards = []string{"*", "0.0.0.0/0", "::/0"}
+
+func isBindingField(field string) bool {
+	_, known := bindingNouns[field]
+	return known || strings.HasPrefix(field, "bound_")
+}
+
+func bindingNoun(field string) string {
+	if noun, known := bindingNouns[field]; known {
+		return noun
+	}
+	return strings.ReplaceAll(strings.TrimPrefix(field, "bound_"), "_", " ")
+}
+
+// DiffBindings compares the Config of 2 versions of an auth principal.
+func DiffBindings(old, new map[string]any) []BindingChange {
+	fields := map[string]bool{}
+	for field := range old {
+		fields[field] = true
+	}
+	for field := range new {
+		fields[field] = true
+	}
+	var changes []BindingChange
+	for _, field := range sortedKeys(fields) {
+		oldValue, newValue := old[field], new[field]
+		if reflect.DeepEqual(oldValue, newValue) {
+			continue
+		}
+		change := BindingChange{Field: field, Old: oldValue, New: newValue}
+		if isBindingField(field) {
+			describeWidening(&change, new)
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// Sets Widened and a description if a binding accepts more than it did.
+func describeWidening(change *BindingChange, newConfig map[string]any) {
+	var (
+		noun           = bindingNoun(change.Field)
+		oldValues, _   = bindingValues(change.Old)
+		newValues, ok  = bindingValues(change.New)
+		wasRestricted  = len(oldValues) > 0 && !hasWildcard(oldValues)
+		oldKeys        = bindingKeys(change.Old)
+		newKeys        = bindingKeys(change.New)
+		removedMapKeys []string
+	)
+	for _, key := range oldKeys {
+		if !slices.Contains(newKeys, key) {
+			removedMapKeys = append(removedMapKeys, key)
+		}
+	}
+	switch {
+	case len(removedMapKeys) > 0:
+		change.Widened = true
+		change.description = fmt.Sprintf("no longer restricts %s %s", noun, formatBinding(removedMapKeys))
+	case !ok:
+		// something that isn't a list, e.g. a map that gained keys
+	case wasRestricted && len(newValues) == 0:
+		change.Widened = true
+		change.description = fmt.Sprintf("no longer restricts %s (`%s` was %s)", pluralize(noun, 2), change.Field, formatBinding(change.Old))
+	case wasRestricted && hasWildcard(newValues):
+		change.Widened = true
+		change.description = fmt.Sprintf("now accepts any %s%s", noun, bindingScope(change.Field, newConfig))
+	default:
+		var added []string
+		for _, value := range newValues {
+			if !slices.Contains(oldValues, value) {
+				added = append(added, value)
+			}
+		}
+		if len(added) > 0 && len(oldValues) > 0 {
+			change.Widened = true
+			change.description = fmt.Sprintf("now also accepts %s %s%s", pluralize(noun, len(added)), formatBinding(added), bindingScope(change.Field, newConfig))
+		}
+	}
+}
+
+// Describes where a binding applies, e.g. " in namespace `prod`".
+func bindingScope(field string, config map[string]any) string {
+	scopeField, scoped := bindingScopes[field]
+	if !scoped {
+		return ""
+	}
+	values, ok := bindingValues(config[scopeField])
+	if !ok || len(values) == 0 {
+		return ""
+	}
+	if hasWildcard(values) {
+		return fmt.Sprintf(" in any %s", bindingNoun(scopeField))
+	}
+	return fmt.Sprintf(" in %s %s", pluralize(bindingNoun(scopeField), len(values)), formatBinding(values))
+}
+
+// Reads a binding as a list of strings, which Vault sometimes returns as a comma-separated string.
+func bindingValues(value any) ([]string, bool) {
+	switch value := value.(type) {
+	case nil:
+		return nil, true
+	case string:
+		var values []string
+		for _, v := range strings.Split(value, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+		return values, true
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			s, isString := v.(string)
+			if !isString {
+				return nil, false
+			}
+			values = append(values, s)
+		}
+		return values, true
+	case []string:
+		return value, true
+	default:
+		return nil, false
+	}
+}
+
+// Keys of a binding that's a map, like bound_claims.
+func bindingKeys(value any) []string {
+	m, isMap := value.(map[string]any)
+	if !isMap {
+		return nil
+	}
+	return sortedKeys(m)
+}
+
+func hasWildcard(values []string) bool {
+	for _, value := range values {
+		if slices.Contains(bindingWildcards, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func pluralize(noun string, count int) string {
+	if count == 1 {
+		return noun
+	}
+	if strings.HasSuffix(noun, "s") {
+		return noun + "es"
+	}
+	return noun + "s"
+}
+
+func formatBinding(value any) string {
+	if values, ok := bindingValues(value); ok {
+		if len(values) == 0 {
+			return "nothing"
+		}
+		formatted := make([]string, len(values))
+		for i, v := range values {
+			formatted[i] = "`" + v + "`"
+		}
+		return strings.Join(formatted, ", ")
+	}
+	switch value := value.(type) {
+	case map[string]any, []any:
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Sprintf("`%v`", value)
+		}
+		return "`" + string(encoded) + "`"
+	default:
+		return fmt.Sprintf("`%v`", value)
+	}
+}
+
+// GetAuthPrincipalBindingChanges compares the Config of an auth principal at currentGitRef, or in the working copy when
+// it's empty, to a historical git ref.
+//
+// Principals that were added have all of their Config reported, while deleted ones have nothing to report. Renamed
+// principals are compared to their old path.
+func GetAuthPrincipalBindingChanges(repositoryPath string, change ChangedFile, historicalGitRef, currentGitRef string) ([]BindingChange, error) {
+	if change.Mutation == Delete {
+		return nil, nil
+	}
+	git := Git{Dir: repositoryPath}
+	current, err := readPrincipalData(git, change.Path, currentGitRef)
+	if err != nil {
+		return nil, err
+	}
+	var historical authPrincipalData
+	if change.Mutation != Add {
+		historicalPath := change.Path
+		if change.Mutation == Rename {
+			historicalPath = change.OldPath
+		}
+		if historical, err = readPrincipalData(git, historicalPath, historicalGitRef); err != nil {
+			return nil, err
+		}
+	}
+	changes := DiffBindings(historical.Config, current.Config)
+	// widened bindings first, since they're the ones worth reviewing
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Widened && !changes[j].Widened
+	})
+	return changes, nil
+}
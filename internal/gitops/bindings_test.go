@@ -0,0 +1,112 @@
+package gitops_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestDiffBindings(t *testing.T) {
+	for name, tc := range map[string]struct {
+		old, new map[string]any
+		expected string
+		widened  bool
+	}{
+		"Wildcard": {
+			old:      map[string]any{"bound_service_account_names": []any{"app"}, "bound_service_account_namespaces": []any{"prod"}},
+			new:      map[string]any{"bound_service_account_names": []any{"*"}, "bound_service_account_namespaces": []any{"prod"}},
+			expected: "now accepts any service account in namespace `prod`",
+			widened:  true,
+		},
+		"Added": {
+			old:      map[string]any{"bound_audiences": []any{"vault"}},
+			new:      map[string]any{"bound_audiences": []any{"vault", "other"}},
+			expected: "now also accepts audience `other`",
+			widened:  true,
+		},
+		"Removed": {
+			old:      map[string]any{"token_bound_cidrs": []any{"10.0.0.0/8"}},
+			new:      map[string]any{},
+			expected: "no longer restricts source addresses (`token_bound_cidrs` was `10.0.0.0/8`)",
+			widened:  true,
+		},
+		"Claim": {
+			old:      map[string]any{"bound_claims": map[string]any{"repository": "org/repo", "ref": "main"}},
+			new:      map[string]any{"bound_claims": map[string]any{"repository": "org/repo"}},
+			expected: "no longer restricts claim `ref`",
+			widened:  true,
+		},
+		"Narrowed": {
+			old:      map[string]any{"bound_audiences": []any{"vault", "other"}},
+			new:      map[string]any{"bound_audiences": []any{"vault"}},
+			expected: "`bound_audiences` changed from `vault`, `other` to `vault`",
+		},
+		"TTL": {
+			old:      map[string]any{"token_ttl": float64(3600)},
+			new:      map[string]any{"token_ttl": float64(86400)},
+			expected: "`token_ttl` changed from `3600` to `86400`",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			changes := gitops.DiffBindings(tc.old, tc.new)
+			if len(changes) != 1 {
+				t.Fatalf("expected 1 change, got %v", changes)
+			}
+			if actual := changes[0].String(); actual != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+			if changes[0].Widened != tc.widened {
+				t.Errorf("expected Widened to be %t", tc.widened)
+			}
+		})
+	}
+}
+
+func TestGetAuthPrincipalBindingChanges(t *testing.T) {
+	var (
+		repo  = t.TempDir()
+		write = func(content string) {
+			t.Helper()
+			path := filepath.Join(repo, "auth", "kubernetes", "role", "app")
+			if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+				t.Fatal(err)
+			}
+		}
+		git  = gitops.Git{Dir: repo}
+		must = mustT[string](t)
+	)
+	write(`{"token_policies": ["app"], "bound_service_account_names": ["app"], "bound_service_account_namespaces": ["prod"], "token_ttl": 3600}`)
+	must(git.CombinedOutput("init"))
+	must(git.CombinedOutput("config", "user.email", "go-test@localhost"))
+	must(git.CombinedOutput("config", "user.name", "Go Test"))
+	must(git.CombinedOutput("config", "commit.gpgsign", "false"))
+	must(git.CombinedOutput("add", "."))
+	must(git.CombinedOutput("commit", "-m", "init"))
+	write(`{"token_policies": ["other"], "bound_service_account_names": ["*"], "bound_service_account_namespaces": ["prod"], "token_ttl": 86400}`)
+
+	changes, err := gitops.GetAuthPrincipalBindingChanges(repo, gitops.ChangedFile{
+		Path:      "auth/kubernetes/role/app",
+		Mutation:  gitops.Change,
+		Principal: true,
+	}, "HEAD", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"now accepts any service account in namespace `prod`",
+		"`token_ttl` changed from `3600` to `86400`",
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, changes)
+	}
+	for i := range expected {
+		if actual := changes[i].String(); actual != expected[i] {
+			t.Errorf("expected %q, got %q", expected[i], actual)
+		}
+	}
+}
@@ -2,89 +2,396 @@ package gitops
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 	"github.com/threatkey-oss/hvresult/internal"
 )
 
-// Prints RSoPDifferential tables for all changes made to auth principals and policies between `compareRef` and the current working copy.
-//
-// Uses log.Fatal() instead of returning an error because it's directly called by a command.
-func MustEmitMarkdownDiffs(ctx context.Context, gitDirectory, compareRef string) {
-	changes, compareRef, err := GetChangedFiles(ctx, gitDirectory, compareRef)
+// DiffOptions are the git refs to compare and how to print the result.
+type DiffOptions struct {
+	// Leave blank to use the default branch.
+	Base string
+	// Leave blank to use the working copy.
+	Head string
+	// Compare Head to where it branched off of Base, like a pull request, instead of to Base itself.
+	MergeBase bool
+	// "markdown" (the default) or "json".
+	Format string
+}
+
+// DiffReport is every change to auth principals, identity groups, and entities between 2 refs.
+type DiffReport struct {
+	// The ref compared to, which is a commit when comparing to a merge base.
+	Base string `json:"base"`
+	// Empty for the working copy.
+	Head           string          `json:"head,omitempty"`
+	ChangedFiles   []ChangedFile   `json:"changed_files"`
+	Principals     []PrincipalDiff `json:"principals"`
+	PolicyWarnings PolicyWarnings  `json:"policy_warnings"`
+	// The highest severity of any principal.
+	Severity internal.Severity `json:"severity"`
+}
+
+// PrincipalDiff is the change to the RSoP of an auth principal, identity group, or entity.
+type PrincipalDiff struct {
+	Path string `json:"path"`
+	// The path before a rename.
+	OldPath string `json:"old_path,omitempty"`
+	// Why the RSoP changed, in the order they were found.
+	Causes         []DiffCause              `json:"causes"`
+	Added          internal.RSoPCapMap      `json:"added"`
+	Removed        internal.RSoPCapMap      `json:"removed"`
+	Metrics        internal.RSoPDiffMetrics `json:"metrics"`
+	BindingChanges []BindingChange          `json:"binding_changes,omitempty"`
+	// Changes with a severity, highest first.
+	Risks    []internal.RiskyChange `json:"risks"`
+	Severity internal.Severity      `json:"severity"`
+	// Whether the principal has the root policy, which bypasses every ACL check.
+	Root bool `json:"root"`
+	// Things about the principal that need attention before its changes, like Root.
+	Warnings []string `json:"warnings"`
+}
+
+// The kinds of DiffCause.
+const (
+	CausePrincipal = "principal"
+	CausePolicy    = "policy"
+	CauseIdentity  = "identity"
+)
+
+// DiffCause is a changed file that affects a principal.
+type DiffCause struct {
+	// CausePrincipal for edits to the principal itself, CausePolicy for a policy it references, or CauseIdentity for
+	// identity groups and entities.
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+	// The name of the policy for CausePolicy.
+	Policy string `json:"policy,omitempty"`
+}
+
+func (d *PrincipalDiff) differential() *internal.RSoPDifferential {
+	return &internal.RSoPDifferential{Added: d.Added, Removed: d.Removed}
+}
+
+// GetDiffReport computes the changes to every auth principal, identity group, and entity between the refs in opts.
+func GetDiffReport(ctx context.Context, gitDirectory string, opts DiffOptions) (*DiffReport, error) {
+	compareRef, headRef := opts.Base, opts.Head
+	if opts.MergeBase {
+		mergeBase, err := MergeBase(gitDirectory, compareRef, headRef)
+		if err != nil {
+			return nil, err
+		}
+		log.Info().Str("base", compareRef).Str("head", headRef).Str("commit", mergeBase).Msg("comparing to merge base")
+		compareRef = mergeBase
+	}
+	changes, compareRef, err := GetChangedFiles(ctx, gitDirectory, compareRef, headRef)
 	if err != nil {
-		log.Fatal().Err(err).Msg("error getting changed files")
+		return nil, fmt.Errorf("error getting changed files: %w", err)
 	}
 	log.Info().Int("count", len(changes)).Msg("detected changes to files")
-	policyDirectory := filepath.Join(gitDirectory, "sys", "policies", "acl")
-	if _, err := os.Stat(policyDirectory); err != nil {
-		logger := log.With().Str("path", policyDirectory).Logger()
-		if errors.Is(err, os.ErrNotExist) {
-			logger.Fatal().Msg("policy directory nonexistent - wrong directory specified?")
+	if headRef == "" {
+		policyDirectory := filepath.Join(gitDirectory, "sys", "policies", "acl")
+		if _, err := os.Stat(policyDirectory); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("policy directory %s nonexistent - wrong directory specified?", policyDirectory)
+			}
+			return nil, fmt.Errorf("error checking policy directory: %w", err)
 		}
-		logger.Fatal().Err(err).Msg("error checking policy directory")
+	} else if output, err := (Git{Dir: gitDirectory}).CombinedOutput("cat-file", "-e", headRef+":sys/policies/acl"); err != nil {
+		return nil, fmt.Errorf("policy directory nonexistent at %s - wrong directory or ref specified?: %s", headRef, output)
 	}
 	var (
-		relativePolicyDirectory = filepath.Join("sys", "policies", "acl")
-		changedPaths            = []string{}
-		diffs                   = map[string]*internal.RSoPDifferential{}
+		report = &DiffReport{
+			Base:         compareRef,
+			Head:         headRef,
+			ChangedFiles: changes,
+			Principals:   []PrincipalDiff{},
+		}
+		// path -> index in report.Principals
+		indexes = map[string]int{}
+		// principal path -> path it was renamed from
+		renamedFrom = map[string]string{}
+		// identity changes are evaluated for a whole namespace at once
+		identityNamespaces = map[string]bool{}
 	)
+	if report.ChangedFiles == nil {
+		report.ChangedFiles = []ChangedFile{}
+	}
+	// adds a differential unless one was already computed, and the cause either way
+	addPrincipal := func(path string, diff *internal.RSoPDifferential, cause DiffCause) *PrincipalDiff {
+		i, exists := indexes[path]
+		if !exists {
+			if diff == nil {
+				diff = &internal.RSoPDifferential{}
+			}
+			principal := PrincipalDiff{
+				Path:     path,
+				OldPath:  renamedFrom[path],
+				Added:    diff.Added,
+				Removed:  diff.Removed,
+				Metrics:  diff.Metrics(),
+				Risks:    diff.Risks(),
+				Root:     diff.Root,
+				Warnings: diff.Warnings,
+			}
+			if principal.Risks == nil {
+				principal.Risks = []internal.RiskyChange{}
+			}
+			if principal.Warnings == nil {
+				principal.Warnings = []string{}
+			}
+			for _, risk := range principal.Risks {
+				principal.Severity = max(principal.Severity, risk.Severity)
+			}
+			report.Severity = max(report.Severity, principal.Severity)
+			// stable schema: never null
+			if principal.Added == nil {
+				principal.Added = internal.RSoPCapMap{}
+			}
+			if principal.Removed == nil {
+				principal.Removed = internal.RSoPCapMap{}
+			}
+			i = len(report.Principals)
+			indexes[path] = i
+			report.Principals = append(report.Principals, principal)
+		}
+		principal := &report.Principals[i]
+		principal.Causes = append(principal.Causes, cause)
+		return principal
+	}
 	for _, change := range changes {
-		if _, exists := diffs[change.Path]; exists {
-			continue
+		if change.Principal && change.Mutation == Rename {
+			renamedFrom[change.Path] = change.OldPath
 		}
+	}
+	for _, change := range changes {
 		logger := log.With().Str("path", change.Path).Logger()
 		if change.Principal {
 			logger.Info().Msg("processing principal change")
-			diff, err := GetAuthPrincipalDifferential(gitDirectory, change.Path, relativePolicyDirectory, compareRef)
+			var (
+				diff *internal.RSoPDifferential
+				err  error
+			)
+			// a policy change may have gotten to it first
+			if _, exists := indexes[change.Path]; !exists {
+				if change.Mutation == Rename {
+					diff, err = GetMovedAuthPrincipalDifferential(gitDirectory, change.OldPath, change.Path, compareRef, headRef)
+				} else {
+					diff, err = GetAuthPrincipalDifferential(gitDirectory, change.Path, namespacePolicyDirectory(change.Namespace), compareRef, headRef)
+				}
+				// reporting the principal as unchanged would hide whatever it gained
+				if err != nil {
+					return nil, fmt.Errorf("error getting differential for auth principal %s: %w", change.Path, err)
+				}
+				logger.Debug().Any("diff", diff).Msg("computed differential")
+			}
+			principal := addPrincipal(change.Path, diff, DiffCause{Kind: CausePrincipal, Path: change.Path})
+			if principal.BindingChanges, err = GetAuthPrincipalBindingChanges(gitDirectory, change, compareRef, headRef); err != nil {
+				return nil, fmt.Errorf("error getting binding changes for auth principal %s: %w", change.Path, err)
+			}
+		} else if change.Identity {
+			if identityNamespaces[change.Namespace] {
+				continue
+			}
+			identityNamespaces[change.Namespace] = true
+			logger.Info().Msg("processing identity change")
+			affected, err := GetIdentityDifferentials(gitDirectory, change.Namespace, nil, compareRef, headRef)
 			if err != nil {
-				log.Err(err).Msg("error getting differential for auth principal")
+				return nil, fmt.Errorf("error getting differentials for identity change to %s: %w", change.Path, err)
+			}
+			var causes []DiffCause
+			for _, other := range changes {
+				if other.Identity && other.Namespace == change.Namespace {
+					causes = append(causes, DiffCause{Kind: CauseIdentity, Path: other.Path})
+				}
+			}
+			for _, path := range sortedKeys(affected) {
+				for _, cause := range causes {
+					addPrincipal(path, affected[path], cause)
+				}
 			}
-			logger.Debug().Any("diff", diff).Msg("computed differential")
-			changedPaths = append(changedPaths, change.Path)
-			diffs[change.Path] = diff
 		} else if change.Policy {
 			logger.Info().Msg("processing policy change")
-			affected, err := GetPolicyChangeDifferentials(changes, gitDirectory, filepath.Base(change.Path), relativePolicyDirectory, "auth", compareRef)
+			policyName := filepath.Base(change.Path)
+			affected, err := GetPolicyChangeDifferentials(
+				changes, gitDirectory, policyName,
+				namespacePolicyDirectory(change.Namespace), namespacePrincipalDirectory(change.Namespace),
+				compareRef, headRef,
+			)
 			if err != nil {
-				logger.Fatal().Err(err).Msg("error getting differentials for policy change")
-			}
-			// keeps the output deterministic
-			keys := make([]string, 0, len(affected))
-			for path := range affected {
-				// skip already computed
-				// TODO: easy optimization for the thoughtful
-				if _, exists := diffs[path]; exists {
-					continue
-				}
-				keys = append(keys, path)
+				return nil, fmt.Errorf("error getting differentials for policy change to %s: %w", change.Path, err)
 			}
-			sort.StringSlice(keys).Sort()
-			for _, path := range keys {
-				changedPaths = append(changedPaths, path)
-				diffs[path] = affected[path]
+			// sorted keeps the output deterministic
+			for _, path := range sortedKeys(affected) {
+				addPrincipal(path, affected[path], DiffCause{Kind: CausePolicy, Path: change.Path, Policy: policyName})
 			}
 		}
 	}
-	for _, path := range changedPaths {
-		diff := diffs[path]
-		if diff.Empty() {
-			fmt.Printf("0 effective changes to `%s` (policy assignment change is a no-op).\n\n", path)
+	affectedPrincipals := make([]string, len(report.Principals))
+	for i, principal := range report.Principals {
+		affectedPrincipals[i] = principal.Path
+	}
+	if report.PolicyWarnings, err = GetPolicyWarnings(gitDirectory, changes, affectedPrincipals, headRef); err != nil {
+		return nil, fmt.Errorf("error checking policy references: %w", err)
+	}
+	for _, ref := range report.PolicyWarnings.Dangling {
+		log.Warn().Str("principal", ref.Principal).Str("policy", ref.Policy).Msg("principal references a policy that doesn't exist")
+	}
+	for _, ref := range report.PolicyWarnings.DeletedReferenced {
+		log.Warn().Str("principal", ref.Principal).Str("policy", ref.Policy).Msg("principal still references a deleted policy")
+	}
+	for _, path := range report.PolicyWarnings.Unreferenced {
+		log.Warn().Str("path", path).Msg("added policy isn't referenced by any principal")
+	}
+	return report, nil
+}
+
+// Prints a diff report in the format in opts and returns it.
+//
+// Uses log.Fatal() instead of returning an error because it's directly called by a command.
+func MustEmitDiffs(ctx context.Context, gitDirectory string, opts DiffOptions) *DiffReport {
+	report, err := GetDiffReport(ctx, gitDirectory, opts)
+	if err != nil {
+		log.Fatal().Err(err).Msg("error computing diff")
+	}
+	switch opts.Format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatal().Err(err).Msg("error encoding diff as JSON")
+		}
+	case "markdown", "":
+		report.PrintMarkdown()
+	default:
+		log.Fatal().Str("format", opts.Format).Msg("unknown diff format")
+	}
+	return report
+}
+
+// Prints RSoPDifferential tables for every principal in the report.
+func (r *DiffReport) PrintMarkdown() {
+	printPolicyWarnings(r.PolicyWarnings)
+	r.printRiskSummary()
+	for _, change := range r.ChangedFiles {
+		if change.Policy && change.OldPath != "" {
+			fmt.Printf("Policy `%s` renamed to `%s`, which deletes `%s` and creates `%s` in Vault.\n\n",
+				change.OldPath, change.Path, filepath.Base(change.OldPath), filepath.Base(change.Path))
+		}
+	}
+	for i := range r.Principals {
+		var (
+			principal = &r.Principals[i]
+			diff      = principal.differential()
+			bindings  = principal.BindingChanges
+			label     = "`" + principal.Path + "`"
+		)
+		if principal.OldPath != "" {
+			label = "`" + principal.OldPath + "` → `" + principal.Path + "`"
+		}
+		for _, warning := range principal.Warnings {
+			fmt.Printf("> %s: %s\n\n", label, warning)
+		}
+		if diff.Empty() && len(bindings) > 0 {
+			fmt.Printf("0 effective changes to %s (only login bindings changed).\n\n", label)
+			printBindingChanges(bindings)
+		} else if diff.Empty() {
+			fmt.Printf("0 effective changes to %s (policy assignment change is a no-op).\n\n", label)
+		} else if metrics := principal.Metrics; metrics.Total() == 0 {
+			fmt.Printf("0 effective changes to %s (only capabilities cancelled by deny changed).\n\n", label)
+			printBindingChanges(bindings)
+			printPreemptionSummary(diff)
+			fmt.Println(diff.MarkdownTable())
 		} else {
-			metrics := diff.Metrics()
 			var changeWord string
-			if metrics.CapabilityChanges == 1 {
+			if metrics.Total() == 1 {
 				changeWord = "change"
 			} else {
 				changeWord = "changes"
 			}
-			fmt.Printf("%d effective %s to `%s`.\n\n", metrics.CapabilityChanges, changeWord, path)
+			fmt.Printf("%d effective %s to %s.\n\n", metrics.Total(), changeWord, label)
+			printBindingChanges(bindings)
+			printPreemptionSummary(diff)
 			fmt.Println(diff.MarkdownTable())
 		}
 	}
 }
+
+// Prints the highest severity, how many changes have each severity, and every change that's at least medium.
+func (r *DiffReport) printRiskSummary() {
+	if len(r.Principals) == 0 {
+		return
+	}
+	type riskyLine struct {
+		severity internal.Severity
+		line     string
+	}
+	var (
+		counts = map[internal.Severity]int{}
+		risky  []riskyLine
+	)
+	for _, principal := range r.Principals {
+		for _, risk := range principal.Risks {
+			counts[risk.Severity]++
+			if risk.Severity < internal.SeverityMedium {
+				continue
+			}
+			change := "➕"
+			if risk.Removed {
+				change = "➖"
+			}
+			risky = append(risky, riskyLine{risk.Severity, fmt.Sprintf("**%s** `%s`: %s `%s` on `%s` from `%s` (%s)",
+				risk.Severity, principal.Path, change, risk.What, risk.Path, strings.Join(risk.Policies, "`, `"), risk.Reason)})
+		}
+	}
+	var summary []string
+	for severity := internal.SeverityCritical; severity > internal.SeverityNone; severity-- {
+		if counts[severity] > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", counts[severity], severity))
+		}
+	}
+	if len(summary) == 0 {
+		fmt.Printf("Highest risk: **%s**.\n\n", r.Severity)
+		return
+	}
+	fmt.Printf("Highest risk: **%s** (%s).\n\n", r.Severity, strings.Join(summary, ", "))
+	// highest first, like each principal's risks
+	sort.SliceStable(risky, func(i, j int) bool {
+		return risky[i].severity > risky[j].severity
+	})
+	for _, entry := range risky {
+		fmt.Printf("* %s\n", entry.line)
+	}
+	if len(risky) > 0 {
+		fmt.Println()
+	}
+}
+
+func printBindingChanges(changes []BindingChange) {
+	if len(changes) == 0 {
+		return
+	}
+	fmt.Println("Login bindings changed:")
+	fmt.Println()
+	for _, change := range changes {
+		fmt.Printf("* %s\n", change)
+	}
+	fmt.Println()
+}
+
+func printPreemptionSummary(diff *internal.RSoPDifferential) {
+	summary := diff.PreemptionSummary()
+	for _, line := range summary {
+		fmt.Printf("* %s\n", line)
+	}
+	if len(summary) > 0 {
+		fmt.Println()
+	}
+}
@@ -0,0 +1,309 @@
+package gitops_test
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestGetDiffReport(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		repo  = t.TempDir()
+		write = func(path, content string) {
+			t.Helper()
+			path = filepath.Join(repo, filepath.FromSlash(path))
+			if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+				t.Fatal(err)
+			}
+		}
+		git  = gitops.Git{Dir: repo}
+		must = mustT[string](t)
+	)
+	write("sys/policies/acl/reader", `path "secret/*" { capabilities = ["read"] }`)
+	write("sys/policies/acl/writer", `path "secret/*" { capabilities = ["update"] }`)
+	write("auth/kubernetes/role/app", `{"token_policies": ["reader"], "bound_service_account_names": ["app"]}`)
+	write("auth/kubernetes/role/ops", `{"token_policies": ["writer"]}`)
+	must(git.CombinedOutput("init"))
+	must(git.CombinedOutput("config", "user.email", "go-test@localhost"))
+	must(git.CombinedOutput("config", "user.name", "Go Test"))
+	must(git.CombinedOutput("config", "commit.gpgsign", "false"))
+	must(git.CombinedOutput("add", "."))
+	must(git.CombinedOutput("commit", "-m", "init"))
+	// app gets a wildcard binding and loses reader's read through a policy change, ops is untouched
+	write("auth/kubernetes/role/app", `{"token_policies": ["reader"], "bound_service_account_names": ["*"]}`)
+	write("sys/policies/acl/reader", `path "secret/*" {
+  capabilities     = ["list"]
+  min_wrapping_ttl = "1h"
+}`)
+
+	report, err := gitops.GetDiffReport(ctx, repo, gitops.DiffOptions{Base: "HEAD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.ChangedFiles) != 2 {
+		t.Fatalf("expected 2 changed files, got %+v", report.ChangedFiles)
+	}
+	if len(report.Principals) != 1 {
+		t.Fatalf("expected only app to be affected, got %+v", report.Principals)
+	}
+	principal := report.Principals[0]
+	if diff := cmp.Diff([]gitops.DiffCause{
+		{Kind: gitops.CausePrincipal, Path: "auth/kubernetes/role/app"},
+		{Kind: gitops.CausePolicy, Path: "sys/policies/acl/reader", Policy: "reader"},
+	}, principal.Causes); diff != "" {
+		t.Fatal(diff)
+	}
+	if principal.Metrics.CapabilityChanges != 2 {
+		t.Fatalf("expected read removed and list added, got %+v", principal.Metrics)
+	}
+	if len(principal.BindingChanges) != 1 || !principal.BindingChanges[0].Widened {
+		t.Fatalf("expected a widened binding, got %+v", principal.BindingChanges)
+	}
+	// list on secret/* covers the whole subtree, while losing read isn't risky
+	if principal.Severity != internal.SeverityMedium || report.Severity != internal.SeverityMedium {
+		t.Fatalf("expected medium severity, got %s for the principal and %s for the report", principal.Severity, report.Severity)
+	}
+	if len(principal.Risks) != 1 || principal.Risks[0].What != "list" {
+		t.Fatalf("expected only adding list to be risky, got %+v", principal.Risks)
+	}
+
+	// the JSON schema is what bots consume
+	encoded, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Base         string `json:"base"`
+		ChangedFiles []struct {
+			Path     string `json:"path"`
+			Mutation string `json:"mutation"`
+		} `json:"changed_files"`
+		Principals []struct {
+			Path  string `json:"path"`
+			Added map[string]struct {
+				Capabilities   map[string][]string `json:"capabilities"`
+				MinWrappingTTL struct {
+					Duration string `json:"duration"`
+				} `json:"min_wrapping_ttl"`
+			} `json:"added"`
+			Removed map[string]struct {
+				Capabilities map[string][]string `json:"capabilities"`
+			} `json:"removed"`
+			Metrics struct {
+				CapabilityChanges int `json:"capability_changes"`
+			} `json:"metrics"`
+			BindingChanges []struct {
+				Field       string `json:"field"`
+				Description string `json:"description"`
+			} `json:"binding_changes"`
+		} `json:"principals"`
+	}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Base != "HEAD" || decoded.ChangedFiles[0].Mutation != "Change" {
+		t.Fatalf("unexpected report: %s", encoded)
+	}
+	got := decoded.Principals[0]
+	if got.Added["secret/*"].Capabilities["list"][0] != "reader" || got.Removed["secret/*"].Capabilities["read"][0] != "reader" {
+		t.Fatalf("expected list added and read removed by reader, got %s", encoded)
+	}
+	if got.Metrics.CapabilityChanges != 2 || got.BindingChanges[0].Description == "" {
+		t.Fatalf("expected metrics and described binding changes, got %s", encoded)
+	}
+	if got.Added["secret/*"].MinWrappingTTL.Duration != "1h0m0s" {
+		t.Fatalf("expected a duration string, got %s", encoded)
+	}
+	// every key is snake_case, however deep
+	if key := regexp.MustCompile(`"[A-Z]\w*":`).Find(encoded); key != nil {
+		t.Fatalf("unexpected key %s in %s", key, encoded)
+	}
+}
+
+func TestGetDiffReportPolicyWarnings(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		repo  = t.TempDir()
+		write = func(path, content string) {
+			t.Helper()
+			path = filepath.Join(repo, filepath.FromSlash(path))
+			if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+				t.Fatal(err)
+			}
+		}
+		git  = gitops.Git{Dir: repo}
+		must = mustT[string](t)
+	)
+	write("sys/policies/acl/reader", `path "secret/*" { capabilities = ["read"] }`)
+	write("sys/policies/acl/old", `path "old/*" { capabilities = ["read"] }`)
+	write("auth/kubernetes/role/app", `{"token_policies": ["reader"]}`)
+	write("auth/kubernetes/role/legacy", `{"token_policies": ["old"]}`)
+	write("identity/group/name/oldies", `{"id": "g-old", "name": "oldies", "type": "internal", "policies": ["old"]}`)
+	must(git.CombinedOutput("init"))
+	must(git.CombinedOutput("config", "user.email", "go-test@localhost"))
+	must(git.CombinedOutput("config", "user.name", "Go Test"))
+	must(git.CombinedOutput("config", "commit.gpgsign", "false"))
+	must(git.CombinedOutput("add", "."))
+	must(git.CombinedOutput("commit", "-m", "init"))
+	// a typo, a policy deleted out from under its principals, and a policy nothing uses
+	write("auth/kubernetes/role/app", `{"token_policies": ["raeder"]}`)
+	must(git.CombinedOutput("rm", "-q", "sys/policies/acl/old"))
+	write("sys/policies/acl/new", `path "new/*" { capabilities = ["read"] }`)
+	must(git.CombinedOutput("add", "."))
+
+	report, err := gitops.GetDiffReport(ctx, repo, gitops.DiffOptions{Base: "HEAD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(gitops.PolicyWarnings{
+		Dangling: []gitops.PolicyReference{
+			{Principal: "auth/kubernetes/role/app", Policy: "raeder"},
+		},
+		Unreferenced: []string{"sys/policies/acl/new"},
+		DeletedReferenced: []gitops.PolicyReference{
+			{Principal: "auth/kubernetes/role/legacy", Policy: "old"},
+			{Principal: "identity/group/name/oldies", Policy: "old"},
+		},
+	}, report.PolicyWarnings); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestGetDiffReportMissingPolicyAtRef(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		repo  = t.TempDir()
+		write = func(path, content string) {
+			t.Helper()
+			path = filepath.Join(repo, filepath.FromSlash(path))
+			if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+				t.Fatal(err)
+			}
+		}
+		git  = gitops.Git{Dir: repo}
+		must = mustT[string](t)
+	)
+	write("sys/policies/acl/reader", `path "secret/*" { capabilities = ["read"] }`)
+	write("auth/kubernetes/role/app", `{"token_policies": ["reader"]}`)
+	must(git.CombinedOutput("init"))
+	must(git.CombinedOutput("config", "user.email", "go-test@localhost"))
+	must(git.CombinedOutput("config", "user.name", "Go Test"))
+	must(git.CombinedOutput("config", "commit.gpgsign", "false"))
+	must(git.CombinedOutput("add", "."))
+	must(git.CombinedOutput("commit", "-m", "init"))
+	must(git.CombinedOutput("branch", "-M", "main"))
+	// the branch grants admin alongside a misspelled policy, which doesn't exist at either ref
+	must(git.CombinedOutput("checkout", "-q", "-b", "feature"))
+	write("sys/policies/acl/admin", `path "sys/*" { capabilities = ["update", "sudo"] }`)
+	write("auth/kubernetes/role/app", `{"token_policies": ["reader", "admin", "raeder"]}`)
+	must(git.CombinedOutput("add", "."))
+	must(git.CombinedOutput("commit", "-m", "feature"))
+	must(git.CombinedOutput("checkout", "-q", "main"))
+
+	report, err := gitops.GetDiffReport(ctx, repo, gitops.DiffOptions{Base: "main", Head: "feature"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Principals) != 1 || report.Principals[0].Metrics.CapabilityChanges == 0 {
+		t.Fatalf("expected app to gain admin's capabilities, got %+v", report.Principals)
+	}
+	if report.Severity != internal.SeverityCritical {
+		t.Fatalf("expected sudo on sys/* to be critical, got %s", report.Severity)
+	}
+}
+
+func TestGetDiffReportDifferentialError(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		repo  = t.TempDir()
+		write = func(path, content string) {
+			t.Helper()
+			path = filepath.Join(repo, filepath.FromSlash(path))
+			if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+				t.Fatal(err)
+			}
+		}
+		git  = gitops.Git{Dir: repo}
+		must = mustT[string](t)
+	)
+	write("sys/policies/acl/reader", `path "secret/*" { capabilities = ["read"] }`)
+	write("sys/policies/acl/broken", `path "sys/*" { capabilities = ["sudo"]`)
+	write("auth/kubernetes/role/app", `{"token_policies": ["reader"]}`)
+	must(git.CombinedOutput("init"))
+	must(git.CombinedOutput("config", "user.email", "go-test@localhost"))
+	must(git.CombinedOutput("config", "user.name", "Go Test"))
+	must(git.CombinedOutput("config", "commit.gpgsign", "false"))
+	must(git.CombinedOutput("add", "."))
+	must(git.CombinedOutput("commit", "-m", "init"))
+	// a principal that can't be evaluated must not look unchanged, or --fail-on would pass it
+	write("auth/kubernetes/role/app", `{"token_policies": ["reader", "broken"]}`)
+
+	report, err := gitops.GetDiffReport(ctx, repo, gitops.DiffOptions{Base: "HEAD"})
+	if err == nil {
+		t.Fatalf("expected an error, got a report with severity %s: %+v", report.Severity, report.Principals)
+	}
+}
+
+func TestGetDiffReportRoot(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		repo  = t.TempDir()
+		write = func(path, content string) {
+			t.Helper()
+			path = filepath.Join(repo, filepath.FromSlash(path))
+			if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+				t.Fatal(err)
+			}
+		}
+		git  = gitops.Git{Dir: repo}
+		must = mustT[string](t)
+	)
+	write("sys/policies/acl/locked", `path "*" { capabilities = ["deny"] }`)
+	write("auth/kubernetes/role/app", `{"token_policies": ["locked"]}`)
+	must(git.CombinedOutput("init"))
+	must(git.CombinedOutput("config", "user.email", "go-test@localhost"))
+	must(git.CombinedOutput("config", "user.name", "Go Test"))
+	must(git.CombinedOutput("config", "commit.gpgsign", "false"))
+	must(git.CombinedOutput("add", "."))
+	must(git.CombinedOutput("commit", "-m", "init"))
+	write("auth/kubernetes/role/app", `{"token_policies": ["locked", "root"]}`)
+
+	report, err := gitops.GetDiffReport(ctx, repo, gitops.DiffOptions{Base: "HEAD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Principals) != 1 {
+		t.Fatalf("expected 1 principal, got %+v", report.Principals)
+	}
+	principal := report.Principals[0]
+	if !principal.Root || len(principal.Warnings) == 0 {
+		t.Fatalf("expected a root warning, got %+v", principal)
+	}
+	// root ignores deny, so its capabilities aren't cancelled
+	if added := principal.Added["*"]; added == nil || len(added.Capabilities[internal.Sudo]) == 0 {
+		t.Fatalf("expected root's capabilities to be added, got %+v", principal.Added)
+	}
+}
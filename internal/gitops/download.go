@@ -3,15 +3,21 @@ package gitops
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 
 	vault "github.com/hashicorp/vault/api"
 	"github.com/mitchellh/mapstructure"
 	"github.com/rs/zerolog/log"
+	"github.com/threatkey-oss/hvresult/internal"
 	"golang.org/x/sync/errgroup"
 )
 
@@ -23,6 +29,64 @@ type authPrincipalData struct {
 	Policies        []string `mapstructure:"policies,omitempty" json:"policies,omitempty"`
 	TokenPolicies   []string `mapstructure:"token_policies,omitempty" json:"token_policies,omitempty"`
 	AllowedPolicies []string `mapstructure:"allowed_policies,omitempty" json:"allowed_policies,omitempty"`
+	// Only meaningful for roles, which otherwise attach the default policy.
+	TokenNoDefaultPolicy bool `mapstructure:"token_no_default_policy,omitempty" json:"token_no_default_policy,omitempty"`
+	// Every other field of the principal, e.g. bound claims and token TTLs, which decide who can log in as it.
+	//
+	// Stored alongside the policy fields rather than nested.
+	Config map[string]any `mapstructure:"-" json:"-"`
+}
+
+// The JSON fields of authPrincipalData that aren't part of its Config.
+var authPrincipalFields = []string{"policies", "token_policies", "allowed_policies", "token_no_default_policy"}
+
+// authPrincipalData without its JSON methods.
+type authPrincipalJSON authPrincipalData
+
+func (a authPrincipalData) MarshalJSON() ([]byte, error) {
+	fields, err := json.Marshal(authPrincipalJSON(a))
+	if err != nil || (len(a.Config) == 0 && !(a.isRole() && len(a.TokenPolicies) == 0)) {
+		return fields, err
+	}
+	merged := map[string]any{}
+	for key, value := range a.Config {
+		merged[key] = value
+	}
+	// an empty token_policies is how roles without policies are told apart
+	if a.isRole() {
+		merged["token_policies"] = a.TokenPolicies
+	}
+	var rawFields map[string]json.RawMessage
+	if err := json.Unmarshal(fields, &rawFields); err != nil {
+		return nil, err
+	}
+	for key, value := range rawFields {
+		merged[key] = value
+	}
+	return json.Marshal(merged)
+}
+
+func (a *authPrincipalData) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, (*authPrincipalJSON)(a)); err != nil {
+		return err
+	}
+	var config map[string]any
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	for _, field := range authPrincipalFields {
+		delete(config, field)
+	}
+	a.Config = nil
+	if len(config) > 0 {
+		a.Config = config
+	}
+	return nil
+}
+
+// Whether the principal is a role, which decodeAuthPrincipal decides from its mount type.
+func (a authPrincipalData) isRole() bool {
+	return a.TokenPolicies != nil
 }
 
 // Merges and sorts TokenPolicies, AllowedPolicies, and Policies.
@@ -38,123 +102,208 @@ func (a authPrincipalData) AllPolicies() []string {
 	return all
 }
 
-func DownloadAuth(ctx context.Context, vc *vault.Client, authDirectory string) error {
+// An auth mount endpoint that principals can be listed from, e.g. auth/gcp/roles -> auth/gcp/role/.
+type authEndpoint struct {
+	// mount name with a trailing slash, e.g. "gcp/"
+	mount          string
+	listPath       string
+	readPathPrefix string
+	policyFields   []string
+}
+
+// Where the endpoint's principals go relative to the auth directory, e.g. gcp/role or github/map/teams.
+func (e authEndpoint) directory() string {
+	return strings.Trim(strings.TrimPrefix(e.readPathPrefix, "auth/"), "/")
+}
+
+// Lists the endpoints of every auth mount, sorted by list path, and the names of mounts that were skipped because
+// their type isn't supported, e.g. "radius/".
+func listAuthEndpoints(ctx context.Context, vc *vault.Client) (endpoints []authEndpoint, skipped []string, err error) {
 	mounts, err := vc.Sys().ListAuthWithContext(ctx)
 	if err != nil {
-		return fmt.Errorf("error listing auth mounts: %w", err)
+		return nil, nil, fmt.Errorf("error listing auth mounts: %w", err)
 	}
-	vaultLogical := vc.Logical()
 	for name, mount := range mounts {
 		log.Debug().Str("name", name).Any("mount", mount).Send()
 		abspath := strings.TrimRight(fmt.Sprintf("auth/%s", name), "/")
-		// map of auth/mount/endpointToList -> auth/mount/endpointToGet/{roleName}
-		var rolePaths map[string]string
-		switch mount.Type {
-		// all "official" mounts first
-		case "aws", "gcp":
-			rolePaths = map[string]string{
-				abspath + "/roles": abspath + "/role/",
-			}
-		case "azure", "kubernetes", "oidc", "oci", "saml":
-			rolePaths = map[string]string{
-				abspath + "/role": abspath + "/role/",
-			}
-		case "kerberos":
-			rolePaths = map[string]string{
-				abspath + "/groups": abspath + "/groups/",
-			}
-		case "ldap", "okta":
-			rolePaths = map[string]string{
-				abspath + "/groups": abspath + "/groups/",
-				abspath + "/users":  abspath + "/users/",
-			}
-		case "radius":
-			rolePaths = map[string]string{
-				abspath + "/users": abspath + "/users/",
-			}
-		case "token":
-			rolePaths = map[string]string{
-				abspath + "/roles": abspath + "/roles/",
+		mountEndpoints, err := authMountEndpoints(name, abspath, mount.Type)
+		if err != nil {
+			if errors.Is(err, ErrUnsupportedAuthMount) {
+				log.Warn().Err(err).Str("mount", abspath).Msg("skipping auth mount")
+				skipped = append(skipped, name)
+				continue
 			}
-		// TODO: support cert mount
+			return nil, nil, err
+		}
+		endpoints = append(endpoints, mountEndpoints...)
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].listPath < endpoints[j].listPath
+	})
+	sort.Strings(skipped)
+	return endpoints, skipped, nil
+}
+
+// Lists the principal names at an auth mount endpoint, which is nil when there are none.
+func listAuthPrincipals(ctx context.Context, vaultLogical *vault.Logical, listPath string) ([]string, error) {
+	secret, err := vaultLogical.ListWithContext(ctx, listPath)
+	if err != nil {
+		return nil, fmt.Errorf("error listing auth mount identities: %w", err)
+	}
+	if secret == nil {
+		log.Warn().Any("secret", secret).Str("listPath", listPath).Msg("LIST path returned empty response, skipping")
+		return nil, nil
+	}
+	var listData authListData
+	if err := mapstructure.Decode(secret.Data, &listData); err != nil {
+		return nil, fmt.Errorf("error decoding auth mount LIST response: %w", err)
+	}
+	return listData.Keys, nil
+}
+
+// Reads an auth principal from Vault. Principals deleted since they were listed are reported as os.ErrNotExist.
+func readAuthPrincipal(ctx context.Context, vaultLogical *vault.Logical, getPath string, policyFields []string) (authPrincipalData, error) {
+	var getData authPrincipalData
+	log.Debug().Str("getPath", getPath).Msg("reading remote auth principal")
+	secret, err := vaultLogical.ReadWithContext(ctx, getPath)
+	if err != nil {
+		return getData, fmt.Errorf("error reading auth prinicpal: %w", err)
+	}
+	if secret == nil || secret.Data == nil {
+		return getData, fmt.Errorf("auth principal '%s': %w", getPath, os.ErrNotExist)
+	}
+	return decodeAuthPrincipal(secret.Data, policyFields)
+}
+
+// Decodes the policy fields of an auth principal from a Vault response.
+func decodeAuthPrincipal(data map[string]any, policyFields []string) (authPrincipalData, error) {
+	var decoded authPrincipalData
+	if noDefault, exists := data["token_no_default_policy"]; exists {
+		if err := mapstructure.Decode(noDefault, &decoded.TokenNoDefaultPolicy); err != nil {
+			return decoded, fmt.Errorf("error decoding token_no_default_policy: %w", err)
+		}
+	}
+	for _, field := range policyFields {
+		policies, err := decodePolicyList(data[field])
+		if err != nil {
+			return decoded, fmt.Errorf("error decoding %s: %w", field, err)
+		}
+		switch field {
+		case "token_policies":
+			decoded.TokenPolicies = policies
+		case "allowed_policies":
+			decoded.AllowedPolicies = policies
 		default:
-			return fmt.Errorf("unknown paths for listing Vault identities for this mount type: '%s'", mount.Type)
-		}
-		var mountPrincipalCount int
-		for listPath, readPathPrefix := range rolePaths {
-			var targetDir string
-			if filepath.Separator == '/' {
-				targetDir = filepath.Join(authDirectory, name, filepath.Base(readPathPrefix))
-			} else {
-				lp := strings.ReplaceAll(readPathPrefix, "/", string(filepath.Separator))
-				targetDir = filepath.Join(authDirectory, name, filepath.Base(lp))
+			decoded.Policies = append(decoded.Policies, policies...)
+		}
+	}
+	// roles have token_policies even without any policies
+	if slices.Contains(policyFields, "token_policies") && internal.IsRole(data) {
+		decoded.TokenPolicies = nonNil(decoded.TokenPolicies)
+	}
+	for key, value := range data {
+		if slices.Contains(authPrincipalFields, key) || slices.Contains(policyFields, key) {
+			continue
+		}
+		if decoded.Config == nil {
+			decoded.Config = map[string]any{}
+		}
+		decoded.Config[key] = value
+	}
+	return decoded, nil
+}
+
+// Decodes a list of policies or a comma-separated string of them, like GitHub team maps have.
+func decodePolicyList(value any) ([]string, error) {
+	var policies []string
+	switch value := value.(type) {
+	case nil:
+	case string:
+		for _, policy := range strings.Split(value, ",") {
+			if policy = strings.TrimSpace(policy); policy != "" {
+				policies = append(policies, policy)
 			}
-			if err := os.MkdirAll(targetDir, 0o750); err != nil {
-				return fmt.Errorf("error creating auth mount directory: %w", err)
+		}
+	default:
+		if err := mapstructure.Decode(value, &policies); err != nil {
+			return nil, fmt.Errorf("expected a list or a comma-separated string: %w", err)
+		}
+	}
+	if len(policies) == 0 {
+		return nil, nil
+	}
+	return policies, nil
+}
+
+// Lists and reads every principal at an auth mount endpoint, keyed by name.
+func fetchAuthPrincipals(ctx context.Context, vaultLogical *vault.Logical, endpoint authEndpoint) (map[string]authPrincipalData, error) {
+	// LIST
+	keys, err := listAuthPrincipals(ctx, vaultLogical, endpoint.listPath)
+	if err != nil {
+		return nil, err
+	}
+	// GET
+	var (
+		eg         errgroup.Group
+		mutex      sync.Mutex
+		principals = make(map[string]authPrincipalData, len(keys))
+	)
+	eg.SetLimit(5)
+	for i := range keys {
+		key := keys[i]
+		eg.Go(func() error {
+			getData, err := readAuthPrincipal(ctx, vaultLogical, endpoint.readPathPrefix+key, endpoint.policyFields)
+			if errors.Is(err, os.ErrNotExist) {
+				// deleted since it was listed
+				log.Debug().Err(err).Msg("skipping auth principal")
+				return nil
 			}
-			// LIST
-			secret, err := vaultLogical.ListWithContext(ctx, listPath)
 			if err != nil {
-				return fmt.Errorf("error listing auth mount identities: %w", err)
-			}
-			if secret == nil {
-				log.Warn().Any("secret", secret).Str("listPath", listPath).Msg("LIST path returned empty response, skipping")
-				continue
-			}
-			var listData authListData
-			if err := mapstructure.Decode(secret.Data, &listData); err != nil {
-				return fmt.Errorf("error decoding auth mount LIST response: %w", err)
-			}
-			// GET
-			var eg errgroup.Group
-			eg.SetLimit(5)
-			for i := range listData.Keys {
-				key := listData.Keys[i]
-				eg.Go(func() error {
-					getPath := readPathPrefix + key
-					log.Debug().Str("getPath", getPath).Msg("reading remote auth principal")
-					secret, err := vaultLogical.ReadWithContext(ctx, getPath)
-					if err != nil {
-						return fmt.Errorf("error reading auth prinicpal: %w", err)
-					}
-					var getData authPrincipalData
-					if err := mapstructure.Decode(secret.Data, &getData); err != nil {
-						return fmt.Errorf("error decoding auth mount GET response: %w", err)
-					}
-					path := filepath.Join(targetDir, key)
-					f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
-					if err != nil {
-						return fmt.Errorf("error opening auth prinicpal file for writing: %w", err)
-					}
-					defer f.Close()
-					enc := json.NewEncoder(f)
-					enc.SetIndent("", "  ") // 2 spaces
-					if err := enc.Encode(getData); err != nil {
-						return fmt.Errorf("error encoding auth prinicpal GET data: %w", err)
-					}
-					return nil
-				})
-			}
-			if err := eg.Wait(); err != nil {
 				return err
 			}
-			mountPrincipalCount += len(listData.Keys)
+			mutex.Lock()
+			defer mutex.Unlock()
+			principals[key] = getData
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return principals, nil
+}
+
+// Reads every auth principal in Vault, keyed by where DownloadAuth would write it, e.g. auth/gcp/role/foo.
+func fetchAuth(ctx context.Context, vc *vault.Client) (map[string]authPrincipalData, error) {
+	endpoints, _, err := listAuthEndpoints(ctx, vc)
+	if err != nil {
+		return nil, err
+	}
+	all := map[string]authPrincipalData{}
+	for _, endpoint := range endpoints {
+		principals, err := fetchAuthPrincipals(ctx, vc.Logical(), endpoint)
+		if err != nil {
+			return nil, err
+		}
+		for key, data := range principals {
+			all[path.Join("auth", endpoint.directory(), key)] = data
 		}
-		log.Info().Str("mount", "auth/"+name).Int("count", mountPrincipalCount).Msg("downloaded all auth principals")
 	}
-	return nil
+	return all, nil
 }
 
-func DownloadPolicies(ctx context.Context, vc *vault.Client, policyDirectory string) error {
+// Reads every policy in Vault, keyed by name.
+func fetchPolicies(ctx context.Context, vc *vault.Client) (map[string]string, error) {
 	vaultSys := vc.Sys()
 	policyNames, err := vaultSys.ListPoliciesWithContext(ctx)
 	if err != nil {
-		return fmt.Errorf("error listing Vault policies: %w", err)
+		return nil, fmt.Errorf("error listing Vault policies: %w", err)
 	}
-	if err := os.MkdirAll(policyDirectory, 0o755); err != nil {
-		return fmt.Errorf("error creating directory: %w", err)
-	}
-	var eg errgroup.Group
+	var (
+		eg       errgroup.Group
+		mutex    sync.Mutex
+		policies = make(map[string]string, len(policyNames))
+	)
 	eg.SetLimit(5)
 	for i := range policyNames {
 		policyName := policyNames[i]
@@ -164,27 +313,182 @@ func DownloadPolicies(ctx context.Context, vc *vault.Client, policyDirectory str
 			if err != nil {
 				return fmt.Errorf("error reading policy: %w", err)
 			}
-			// TODO: find out if this is a decent Windows SACL
-			err = os.WriteFile(
-				filepath.Join(policyDirectory, policyName),
-				[]byte(hclData),
-				0o640,
-			)
-			if err != nil {
-				return fmt.Errorf("error writing Vault policy to file: %w", err)
-			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			policies[policyName] = hclData
 			return nil
 		})
 	}
 	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// DownloadOptions controls what gets downloaded.
+type DownloadOptions struct {
+	// Also download identity groups and entities with DownloadNamespaces.
+	Identity bool
+	// Remove files for principals and mounts that no longer exist in Vault.
+	Prune bool
+	// Write every field of each principal instead of only its policies.
+	FullConfig bool
+	// With FullConfig, only write these fields, if any are set.
+	IncludeFields []string
+	// With FullConfig, never write these fields.
+	ExcludeFields []string
+}
+
+// Returns the principal as it should be written to disk.
+func (o DownloadOptions) filter(data authPrincipalData) authPrincipalData {
+	if !o.FullConfig {
+		data.Config = nil
+		return data
+	}
+	config := map[string]any{}
+	for key, value := range data.Config {
+		if (len(o.IncludeFields) > 0 && !slices.Contains(o.IncludeFields, key)) || slices.Contains(o.ExcludeFields, key) {
+			continue
+		}
+		config[key] = value
+	}
+	data.Config = config
+	return data
+}
+
+// DownloadAuth writes every auth principal in Vault to authDirectory as <mount>/<endpoint>/<name>.
+func DownloadAuth(ctx context.Context, vc *vault.Client, authDirectory string, opts DownloadOptions) error {
+	endpoints, skipped, err := listAuthEndpoints(ctx, vc)
+	if err != nil {
 		return err
 	}
-	log.Info().Int("count", len(policyNames)).Msg("downloaded all policies")
-	// delete anything extraenous
-	justDownloadedPolicyNames := make(map[string]bool, len(policyNames))
-	for _, name := range policyNames {
-		justDownloadedPolicyNames[name] = true
+	var (
+		mountPrincipalCounts = map[string]int{}
+		// relative paths of everything that exists in Vault, including directories for endpoints without principals
+		downloaded = map[string]bool{}
+		// mounts that exist in Vault but weren't listed, so what's on disk for them can't be known to be stale
+		unlisted = map[string]bool{}
+	)
+	for _, mount := range skipped {
+		unlisted[path.Clean(mount)] = true
+	}
+	for _, endpoint := range endpoints {
+		downloaded[path.Clean(endpoint.mount)] = true
+		downloaded[endpoint.directory()] = true
+		targetDir := filepath.Join(authDirectory, filepath.FromSlash(endpoint.directory()))
+		if err := os.MkdirAll(targetDir, 0o750); err != nil {
+			return fmt.Errorf("error creating auth mount directory: %w", err)
+		}
+		principals, err := fetchAuthPrincipals(ctx, vc.Logical(), endpoint)
+		if err != nil {
+			return err
+		}
+		for key, getData := range principals {
+			if err := writeJSONFile(filepath.Join(targetDir, key), opts.filter(getData)); err != nil {
+				return err
+			}
+			downloaded[path.Join(endpoint.directory(), key)] = true
+		}
+		mountPrincipalCounts[endpoint.mount] += len(principals)
+	}
+	for _, mount := range sortedKeys(mountPrincipalCounts) {
+		log.Info().Str("mount", "auth/"+mount).Int("count", mountPrincipalCounts[mount]).Msg("downloaded all auth principals")
+	}
+	if !opts.Prune {
+		return nil
 	}
+	return pruneDirectory(authDirectory, downloaded, unlisted)
+}
+
+// Removes every file below directory that wasn't just downloaded, then any other directories left empty. Directories
+// in keep are left alone entirely.
+//
+// Keys of downloaded and keep are slash-separated paths relative to directory.
+func pruneDirectory(directory string, downloaded, keep map[string]bool) error {
+	var directories []string
+	err := filepath.WalkDir(directory, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(directory, filePath)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && keep[filepath.ToSlash(relPath)] {
+			log.Info().Str("path", filePath).Msg("keeping directory that isn't pruned")
+			return filepath.SkipDir
+		}
+		if d.IsDir() {
+			if relPath != "." && !downloaded[filepath.ToSlash(relPath)] {
+				directories = append(directories, filePath)
+			}
+			return nil
+		}
+		if downloaded[filepath.ToSlash(relPath)] {
+			return nil
+		}
+		log.Info().Str("path", filePath).Msg("removing stale file")
+		if err := os.Remove(filePath); err != nil {
+			return fmt.Errorf("error removing stale file '%s': %w", filePath, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("error pruning %s: %w", directory, err)
+	}
+	// deepest first, so vanished mounts go away entirely
+	for i := len(directories) - 1; i >= 0; i-- {
+		entries, err := os.ReadDir(directories[i])
+		if err != nil {
+			return fmt.Errorf("error reading directory: %w", err)
+		}
+		if len(entries) > 0 {
+			continue
+		}
+		log.Info().Str("path", directories[i]).Msg("removing empty directory")
+		if err := os.Remove(directories[i]); err != nil {
+			return fmt.Errorf("error removing empty directory '%s': %w", directories[i], err)
+		}
+	}
+	return nil
+}
+
+// Writes data as indented JSON, like auth principals and identity groups are stored.
+func writeJSONFile(path string, data any) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o640)
+	if err != nil {
+		return fmt.Errorf("error opening %s for writing: %w", path, err)
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ") // 2 spaces
+	if err := enc.Encode(data); err != nil {
+		return fmt.Errorf("error encoding %s: %w", path, err)
+	}
+	return nil
+}
+
+func DownloadPolicies(ctx context.Context, vc *vault.Client, policyDirectory string) error {
+	policies, err := fetchPolicies(ctx, vc)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(policyDirectory, 0o755); err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+	for policyName, hclData := range policies {
+		// TODO: find out if this is a decent Windows SACL
+		err = os.WriteFile(
+			filepath.Join(policyDirectory, policyName),
+			[]byte(hclData),
+			0o640,
+		)
+		if err != nil {
+			return fmt.Errorf("error writing Vault policy to file: %w", err)
+		}
+	}
+	log.Info().Int("count", len(policies)).Msg("downloaded all policies")
+	// delete anything extraenous
 	entries, err := os.ReadDir(policyDirectory)
 	if err != nil {
 		return fmt.Errorf("error reading policy directory: %w", err)
@@ -193,7 +497,7 @@ func DownloadPolicies(ctx context.Context, vc *vault.Client, policyDirectory str
 		if entry.IsDir() {
 			continue
 		}
-		if !justDownloadedPolicyNames[entry.Name()] {
+		if _, justDownloaded := policies[entry.Name()]; !justDownloaded {
 			toRemove := filepath.Join(policyDirectory, entry.Name())
 			log.Info().Str("path", toRemove).Msg("removing extraneous file path")
 			if err := os.Remove(toRemove); err != nil {
@@ -0,0 +1,203 @@
+package gitops_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+	"github.com/threatkey-oss/hvresult/internal/testcluster"
+)
+
+func TestDownloadAuthPrune(t *testing.T) {
+	var (
+		ctx           = context.Background()
+		client        = testcluster.NewTestCluster(t)
+		authDirectory = filepath.Join(t.TempDir(), "auth")
+	)
+	if err := client.Sys().EnableAuthWithOptions("ldap", &vault.EnableAuthOptions{Type: "ldap"}); err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range map[string]map[string]any{
+		"auth/token/roles/app":  {"allowed_policies": []string{"default"}},
+		"auth/token/roles/gone": {"allowed_policies": []string{"default"}},
+		"auth/ldap/groups/devs": {"policies": []string{"default"}},
+	} {
+		if _, err := client.Logical().Write(path, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gitops.DownloadAuth(ctx, client, authDirectory, gitops.DownloadOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	exists := func(path string) bool {
+		t.Helper()
+		_, err := os.Stat(filepath.Join(authDirectory, filepath.FromSlash(path)))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			t.Fatal(err)
+		}
+		return err == nil
+	}
+	for _, path := range []string{"token/roles/app", "token/roles/gone", "ldap/groups/devs"} {
+		if !exists(path) {
+			t.Fatalf("expected %s to be downloaded", path)
+		}
+	}
+	if _, err := client.Logical().Delete("auth/token/roles/gone"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Sys().DisableAuth("ldap"); err != nil {
+		t.Fatal(err)
+	}
+	t.Run("NoPrune", func(t *testing.T) {
+		if err := gitops.DownloadAuth(ctx, client, authDirectory, gitops.DownloadOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if !exists("token/roles/gone") || !exists("ldap/groups/devs") {
+			t.Fatal("expected stale principals to be kept")
+		}
+	})
+	t.Run("Prune", func(t *testing.T) {
+		if err := gitops.DownloadAuth(ctx, client, authDirectory, gitops.DownloadOptions{Prune: true}); err != nil {
+			t.Fatal(err)
+		}
+		if !exists("token/roles/app") {
+			t.Fatal("expected token/roles/app to be kept")
+		}
+		if exists("token/roles/gone") {
+			t.Fatal("expected token/roles/gone to be removed")
+		}
+		if exists("ldap") {
+			t.Fatal("expected the ldap mount directory to be removed")
+		}
+	})
+	t.Run("UnsupportedMount", func(t *testing.T) {
+		// pcf is the deprecated name of cf, which hvresult doesn't know, so the mount is skipped rather than listed
+		if err := client.Sys().EnableAuthWithOptions("legacy", &vault.EnableAuthOptions{Type: "pcf"}); err != nil {
+			t.Skipf("this Vault can't enable pcf: %v", err)
+		}
+		tracked := filepath.Join(authDirectory, "legacy", "roles", "app")
+		if err := os.MkdirAll(filepath.Dir(tracked), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(tracked, []byte(`{"token_policies": ["app"]}`), 0o640); err != nil {
+			t.Fatal(err)
+		}
+		if err := gitops.DownloadAuth(ctx, client, authDirectory, gitops.DownloadOptions{Prune: true}); err != nil {
+			t.Fatal(err)
+		}
+		if !exists("legacy/roles/app") {
+			t.Fatal("expected principals of a mount that wasn't listed to be kept")
+		}
+	})
+}
+
+func TestDownloadNamespacesPrune(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		client    = testcluster.NewTestCluster(t)
+		directory = t.TempDir()
+		stale     = filepath.Join(directory, "namespaces", "gone", "auth", "token", "roles", "app")
+	)
+	// the test cluster has no namespaces, so every namespace on disk is gone from Vault
+	if err := os.MkdirAll(filepath.Dir(stale), 0o750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(stale, []byte(`{"allowed_policies": ["default"]}`), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitops.DownloadNamespaces(ctx, client, directory, gitops.DownloadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); err != nil {
+		t.Fatalf("expected the namespace to be kept without pruning: %v", err)
+	}
+	if err := gitops.DownloadNamespaces(ctx, client, directory, gitops.DownloadOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(directory, "namespaces", "gone")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected the namespace to be removed, got %v", err)
+	}
+}
+
+func TestDownloadAuthMounts(t *testing.T) {
+	var (
+		ctx           = context.Background()
+		client        = testcluster.NewTestCluster(t)
+		authDirectory = filepath.Join(t.TempDir(), "auth")
+	)
+	for _, mountType := range []string{"approle", "userpass", "github", "cert", "jwt"} {
+		if err := client.Sys().EnableAuthWithOptions(mountType, &vault.EnableAuthOptions{Type: mountType}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for path, data := range map[string]map[string]any{
+		"auth/approle/role/ci":         {"token_policies": []string{"ci"}},
+		"auth/approle/role/empty":      {"token_ttl": "1h"},
+		"auth/userpass/users/alice":    {"password": "hunter2", "token_policies": []string{"alice"}},
+		"auth/github/map/teams/admins": {"value": "admin, audit"},
+		"auth/jwt/role/deploy":         {"role_type": "jwt", "user_claim": "sub", "bound_audiences": []string{"vault"}, "token_policies": []string{"deploy"}},
+	} {
+		if _, err := client.Logical().Write(path, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := gitops.DownloadAuth(ctx, client, authDirectory, gitops.DownloadOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{
+		"approle/role/ci": `"token_policies": [` + "\n" + `    "ci"`,
+		// roles keep an empty token_policies, so they still get the default policy offline
+		"approle/role/empty":      `"token_policies": []`,
+		"userpass/users/alice":    `"alice"`,
+		"github/map/teams/admins": `"policies": [` + "\n" + `    "admin",` + "\n" + `    "audit"`,
+		"jwt/role/deploy":         `"deploy"`,
+	} {
+		content, err := os.ReadFile(filepath.Join(authDirectory, filepath.FromSlash(path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("expected %s to contain %s, got %s", path, expected, content)
+		}
+	}
+}
+
+func TestDownloadIdentity(t *testing.T) {
+	var (
+		ctx               = context.Background()
+		client            = testcluster.NewTestCluster(t)
+		identityDirectory = filepath.Join(t.TempDir(), "identity")
+	)
+	entity, err := client.Logical().Write("identity/entity", map[string]any{"name": "alice", "policies": []string{"alice"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Logical().Write("identity/group", map[string]any{
+		"name":              "engineers",
+		"policies":          []string{"reader"},
+		"member_entity_ids": []string{entity.Data["id"].(string)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gitops.DownloadIdentity(ctx, client, identityDirectory, gitops.DownloadOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	for path, expected := range map[string]string{
+		"group/name/engineers": entity.Data["id"].(string),
+		"entity/name/alice":    `"alice"`,
+	} {
+		content, err := os.ReadFile(filepath.Join(identityDirectory, filepath.FromSlash(path)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(content), expected) {
+			t.Errorf("expected %s to contain %s, got %s", path, expected, content)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+	"github.com/threatkey-oss/hvresult/internal"
+)
+
+// Drift is how live Vault differs from a gitops directory.
+type Drift struct {
+	// Principal path in the directory -> effective changes from the directory to live Vault.
+	//
+	// Principals without effective changes aren't included.
+	Principals map[string]*internal.RSoPDifferential
+	// Policies whose documents differ, qualified by namespace.
+	//
+	// These may not change any principal's RSoP, e.g. if they're only attached to tokens.
+	Policies []string
+}
+
+// Whether live Vault matches the directory.
+func (d *Drift) Empty() bool {
+	return d == nil || (len(d.Principals) == 0 && len(d.Policies) == 0)
+}
+
+// DetectDrift reads every policy and auth principal from Vault and compares them to a gitops directory at a git ref.
+//
+// An empty ref compares to the working copy. Namespaces are only considered if they're in the directory.
+func DetectDrift(ctx context.Context, vc *vault.Client, directory, ref string) (*Drift, error) {
+	repo, err := newOfflinePolicyProvider(directory, ref)
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := repo.namespaces()
+	if err != nil {
+		return nil, err
+	}
+	drift := &Drift{Principals: map[string]*internal.RSoPDifferential{}}
+	for _, namespace := range namespaces {
+		if err := detectNamespaceDrift(ctx, internal.NamespacedClient(vc, namespace), repo, namespace, drift); err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(drift.Policies)
+	return drift, nil
+}
+
+func detectNamespaceDrift(ctx context.Context, vc *vault.Client, repo *OfflinePolicyProvider, namespace string, drift *Drift) error {
+	logger := log.With().Str("namespace", namespace).Logger()
+	livePolicies, err := fetchPolicies(ctx, vc)
+	if err != nil {
+		return err
+	}
+	liveAuth, err := fetchAuth(ctx, vc)
+	if err != nil {
+		return err
+	}
+	logger.Info().Int("policies", len(livePolicies)).Int("principals", len(liveAuth)).Msg("read live Vault")
+	// policy documents
+	var (
+		policyDirectory = filepath.ToSlash(namespacePolicyDirectory(namespace))
+		repoPolicies    = map[string]bool{}
+	)
+	policyFiles, err := repo.listFiles(policyDirectory)
+	if err != nil {
+		return err
+	}
+	for _, file := range policyFiles {
+		name := path.Base(file)
+		repoPolicies[name] = true
+		content, err := repo.readFile(file)
+		if err != nil {
+			return fmt.Errorf("error reading policy: %w", err)
+		}
+		if live, exists := livePolicies[name]; !exists || strings.TrimSpace(live) != strings.TrimSpace(string(content)) {
+			drift.Policies = append(drift.Policies, namespace+name)
+		}
+	}
+	for name := range livePolicies {
+		if !repoPolicies[name] {
+			drift.Policies = append(drift.Policies, namespace+name)
+		}
+	}
+	// principals, which are compared by their effective RSoP
+	getLivePolicy := func(ctx context.Context, name string) (*internal.Policy, error) {
+		namespace, name := internal.SplitQualifiedName(name)
+		if policy := internal.BuiltinPolicy(name); policy != nil && (namespace == "" || name != internal.RootPolicyName) {
+			policy.Namespace = namespace
+			return policy, nil
+		}
+		hcl, exists := livePolicies[name]
+		if !exists {
+			return nil, fmt.Errorf("live policy '%s': %w", name, os.ErrNotExist)
+		}
+		policy, err := internal.ParsePolicy(hcl, name)
+		if err != nil {
+			return nil, err
+		}
+		policy.Namespace = namespace
+		return policy, nil
+	}
+	var (
+		namespaceDir = filepath.ToSlash(namespaceDirectory(namespace))
+		principals   = map[string]bool{}
+	)
+	repoPrincipals, err := repo.listFiles(namespacePrincipalDirectory(namespace))
+	if err != nil {
+		return err
+	}
+	for _, principal := range repoPrincipals {
+		principals[principal] = true
+	}
+	for key := range liveAuth {
+		principals[path.Join(namespaceDir, key)] = true
+	}
+	for _, principal := range sortedKeys(principals) {
+		repoRSoP := &internal.RSoP{}
+		if slices.Contains(repoPrincipals, principal) {
+			if repoRSoP, err = repo.GetRSoP(ctx, principal); err != nil {
+				return err
+			}
+		}
+		liveRSoP := &internal.RSoP{}
+		_, key := SplitNamespace(principal)
+		if data, exists := liveAuth[key]; exists {
+			if liveRSoP, err = principalRSoP(ctx, data, namespace, getLivePolicy); err != nil {
+				return fmt.Errorf("error evaluating live auth principal '%s': %w", principal, err)
+			}
+		}
+		diff := repoRSoP.Diff(liveRSoP)
+		if !diff.Empty() {
+			logger.Debug().Str("principal", principal).Any("diff", diff).Msg("detected drift")
+			drift.Principals[principal] = diff
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package gitops_test
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+	"github.com/threatkey-oss/hvresult/internal/testcluster"
+)
+
+func TestDrift(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		client    = testcluster.NewTestCluster(t)
+		repo      = t.TempDir()
+		directory = filepath.Join(repo, "vault-policy")
+	)
+	if err := client.Sys().PutPolicy("reader", `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+	_, err := client.Logical().Write("auth/token/roles/app", map[string]any{
+		"allowed_policies": []string{"reader"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gitops.DownloadAuth(ctx, client, filepath.Join(directory, "auth"), gitops.DownloadOptions{Prune: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := gitops.DownloadPolicies(ctx, client, filepath.Join(directory, "sys", "policies", "acl")); err != nil {
+		t.Fatal(err)
+	}
+	git := gitops.Git{Dir: repo}
+	must := mustT[string](t)
+	must(git.CombinedOutput("init"))
+	must(git.CombinedOutput("config", "user.email", "go-test@localhost"))
+	must(git.CombinedOutput("config", "user.name", "Go Test"))
+	must(git.CombinedOutput("config", "commit.gpgsign", "false"))
+	must(git.CombinedOutput("add", "."))
+	must(git.CombinedOutput("commit", "-m", "init"))
+
+	drift, err := gitops.DetectDrift(ctx, client, directory, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !drift.Empty() {
+		t.Fatalf("expected no drift, got policies %v and principals %v", drift.Policies, drift.Principals)
+	}
+	// someone clicks around in the UI
+	if err := client.Sys().PutPolicy("reader", `path "secret/*" { capabilities = ["read", "delete"] }`); err != nil {
+		t.Fatal(err)
+	}
+	drift, err = gitops.DetectDrift(ctx, client, directory, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(drift.Policies, []string{"reader"}) {
+		t.Fatalf("expected reader to drift, got %v", drift.Policies)
+	}
+	diff, exists := drift.Principals["auth/token/roles/app"]
+	if !exists {
+		t.Fatalf("expected auth/token/roles/app to drift, got %v", drift.Principals)
+	}
+	if diff.Added["secret/*"] == nil || diff.Removed != nil {
+		t.Fatalf("expected only an added capability on secret/*, got %+v", diff)
+	}
+}
@@ -28,96 +28,130 @@ const (
 	Add Mutation = iota
 	Delete
 	Change
+	// A file moved to another path, see ChangedFile.OldPath.
+	Rename
 )
 
 type ChangedFile struct {
-	Path      string
-	Mutation  Mutation
-	Principal bool `json:",omitempty"`
-	Policy    bool `json:",omitempty"`
+	Path     string   `json:"path"`
+	Mutation Mutation `json:"mutation"`
+	// The path before a rename. Renamed policies are a Delete of the old path and an Add of the new one, which has
+	// this set, because Vault deletes one policy and creates another.
+	OldPath string `json:"old_path,omitempty"`
+	// The namespace the file is in, see SplitNamespace.
+	Namespace string `json:"namespace,omitempty"`
+	Principal bool   `json:"principal,omitempty"`
+	Policy    bool   `json:"policy,omitempty"`
+	// An identity group or entity.
+	Identity bool `json:"identity,omitempty"`
 }
 
-// Computes a change between HEAD and some reference, like a branch. Leave blank to use the default branch, which is usually named main or master.
+// Computes a change between the working copy and some reference, like a branch. Leave blank to use the default branch,
+// which is usually named main or master. When headRef isn't empty, it's compared instead of the working copy.
 //
 // Returns the branch used.
-func GetChangedFiles(ctx context.Context, repo string, referenceName string) ([]ChangedFile, string, error) {
+func GetChangedFiles(ctx context.Context, repo string, referenceName, headRef string) ([]ChangedFile, string, error) {
 	git := Git{Dir: repo}
 	if referenceName == "" {
-		output, err := git.CombinedOutput("config", "init.defaultBranch")
-		if err != nil {
-			var exitErr *exec.ExitError
-			// ignore not found
-			if !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
-				return nil, referenceName, fmt.Errorf("error running `git config init.defaultBranch`:%w: %s", err, output)
-			}
-		}
-		referenceName = output
-		if referenceName == "" {
-			referenceName, err = guessDefaultBranch(git)
-			if err != nil {
-				return nil, referenceName, fmt.Errorf("error guessing default branch: %w", err)
-			}
-			log.Info().Str("branch", referenceName).Msg("`git config init.defaultBranch` returned nothing, guessed default branch")
+		var err error
+		if referenceName, err = defaultBranch(git); err != nil {
+			return nil, referenceName, err
 		}
 	}
-	output, err := git.CombinedOutput("diff", referenceName, "--name-status")
+	args := []string{"diff", referenceName}
+	if headRef != "" {
+		args = append(args, headRef)
+	}
+	args = append(args, "--name-status", "-M")
+	output, err := git.CombinedOutput(args...)
 	if err != nil {
-		return nil, referenceName, fmt.Errorf("error running `git diff %s --name-status`: %w: %s", referenceName, err, output)
+		return nil, referenceName, fmt.Errorf("error running `git %s`: %w: %s", strings.Join(args, " "), err, output)
 	}
-	log.Debug().Str("output", output).Msgf("git diff %s --name-status", referenceName)
+	log.Debug().Str("output", output).Msgf("git %s", strings.Join(args, " "))
 	var (
 		changes []ChangedFile
 		reader  = bufio.NewReader(strings.NewReader(output))
 		done    bool
 	)
-	for {
+	for !done {
 		line, err := reader.ReadString('\n')
 		if errors.Is(err, io.EOF) {
 			done = true
 		} else if err != nil {
 			return nil, referenceName, fmt.Errorf("error parsing git diff: %w", err)
 		}
-		splitLine := strings.SplitN(strings.TrimSpace(line), "\t", 2)
-		if len(splitLine) != 2 {
+		// renames and copies have a similarity score and both paths, e.g. R100\told\tnew
+		splitLine := strings.Split(strings.TrimSpace(line), "\t")
+		if len(splitLine) < 2 || splitLine[0] == "" {
 			log.Debug().Strs("line", splitLine).Msg("ignoring unexpected line split")
 			continue
 		}
-		var (
-			mutation Mutation
-			path     = splitLine[1]
-		)
 		// Added (A), Copied (C), Deleted (D), Modified (M), Renamed (R), have their type (i.e. regular file, symlink,
 		// submodule, ...) changed (T), are Unmerged (U), are Unknown (X), or have had their pairing Broken (B)
 		// - man git-diff
-		switch status := splitLine[0]; status {
-		case "A", "C":
-			mutation = Add
-		case "D":
-			mutation = Delete
-		case "M":
-			mutation = Change
+		switch status := splitLine[0]; status[0] {
+		case 'A':
+			changes = append(changes, classifyChangedFile(splitLine[1], Add))
+		case 'D':
+			changes = append(changes, classifyChangedFile(splitLine[1], Delete))
+		case 'M', 'T':
+			changes = append(changes, classifyChangedFile(splitLine[1], Change))
+		case 'C', 'R':
+			if len(splitLine) != 3 {
+				log.Warn().Strs("line", splitLine).Msg("expected 2 paths for a rename or copy, skipping")
+				continue
+			}
+			oldPath, newPath := splitLine[1], splitLine[2]
+			if status[0] == 'C' {
+				// the original is still there
+				changes = append(changes, classifyChangedFile(newPath, Add))
+				continue
+			}
+			changes = append(changes, renamedFiles(oldPath, newPath)...)
 		default:
 			log.Warn().Str("status", status).Msg("unhandled git file status, skipping")
-			continue
-		}
-		cf := ChangedFile{
-			Path:     path,
-			Mutation: mutation,
-		}
-		// this heuristic might need adjustment
-		if strings.HasPrefix(path, "auth") {
-			cf.Principal = true
-		} else if strings.HasSuffix(filepath.Dir(path), "acl") {
-			cf.Policy = true
-		}
-		changes = append(changes, cf)
-		if done {
-			break
 		}
 	}
 	return changes, referenceName, nil
 }
 
+// Determines what a changed file is from its path.
+func classifyChangedFile(path string, mutation Mutation) ChangedFile {
+	cf := ChangedFile{
+		Path:     path,
+		Mutation: mutation,
+	}
+	// this heuristic might need adjustment
+	namespace, nsPath := SplitNamespace(path)
+	cf.Namespace = namespace
+	if strings.HasPrefix(nsPath, "auth") {
+		cf.Principal = true
+	} else if strings.HasPrefix(nsPath, "identity/") {
+		cf.Identity = true
+	} else if strings.HasSuffix(filepath.Dir(nsPath), "acl") {
+		cf.Policy = true
+	}
+	return cf
+}
+
+// Principals that keep being principals are moved, while everything else is deleted and added, since e.g. a
+// renamed policy is a different policy to Vault.
+func renamedFiles(oldPath, newPath string) []ChangedFile {
+	var (
+		deleted = classifyChangedFile(oldPath, Delete)
+		added   = classifyChangedFile(newPath, Add)
+	)
+	if deleted.Principal && added.Principal {
+		added.Mutation = Rename
+		added.OldPath = oldPath
+		return []ChangedFile{added}
+	}
+	if deleted.Policy && added.Policy {
+		added.OldPath = oldPath
+	}
+	return []ChangedFile{deleted, added}
+}
+
 // A little wrapper for subprocess commands to git.
 //
 // If you're curious about why, github.com/go-git/go-git can get a little dicey and bugs are more easily triaged this way.
@@ -135,6 +169,47 @@ func (g Git) CombinedOutput(args ...string) (string, error) {
 	return string(bytes.TrimSpace(combined)), err
 }
 
+// MergeBase returns the commit a PR from headRef into baseRef would be compared to, like GitHub's three-dot diff.
+// An empty baseRef means the default branch and an empty headRef means HEAD.
+func MergeBase(repo, baseRef, headRef string) (string, error) {
+	git := Git{Dir: repo}
+	if baseRef == "" {
+		var err error
+		if baseRef, err = defaultBranch(git); err != nil {
+			return "", err
+		}
+	}
+	if headRef == "" {
+		headRef = "HEAD"
+	}
+	output, err := git.CombinedOutput("merge-base", baseRef, headRef)
+	if err != nil {
+		return "", fmt.Errorf("error finding merge base of %s and %s: %w: %s", baseRef, headRef, err, output)
+	}
+	return output, nil
+}
+
+// The branch configured as init.defaultBranch, or a guess if there isn't one.
+func defaultBranch(git Git) (string, error) {
+	output, err := git.CombinedOutput("config", "init.defaultBranch")
+	if err != nil {
+		var exitErr *exec.ExitError
+		// ignore not found
+		if !(errors.As(err, &exitErr) && exitErr.ExitCode() == 1) {
+			return "", fmt.Errorf("error running `git config init.defaultBranch`:%w: %s", err, output)
+		}
+	}
+	if output != "" {
+		return output, nil
+	}
+	branch, err := guessDefaultBranch(git)
+	if err != nil {
+		return "", fmt.Errorf("error guessing default branch: %w", err)
+	}
+	log.Info().Str("branch", branch).Msg("`git config init.defaultBranch` returned nothing, guessed default branch")
+	return branch, nil
+}
+
 // uses the heuristic of "the last line of the git branch command"
 func guessDefaultBranch(g Git) (string, error) {
 	output, err := g.CombinedOutput("branch")
@@ -74,6 +74,7 @@ func TestGenerateCapMap(t *testing.T) {
 			context.Background(),
 			tempGitDir,
 			"",
+			"",
 		)
 		if err != nil {
 			t.Fatal(err)
@@ -88,6 +89,165 @@ func TestGenerateCapMap(t *testing.T) {
 	})
 }
 
+func TestGetChangedFilesRenames(t *testing.T) {
+	tempGitDir := t.TempDir()
+	var (
+		rolesPath    = filepath.Join(tempGitDir, "auth", "gcp", "roles")
+		policiesPath = filepath.Join(tempGitDir, "sys", "policies", "acl")
+	)
+	for _, dir := range []string{rolesPath, policiesPath} {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(rolesPath, "app"):       `{"token_policies": ["other"]}`,
+		filepath.Join(policiesPath, "other"):  `path "other/*" { capabilities = ["read"] }`,
+		filepath.Join(policiesPath, "reader"): `path "secret/*" { capabilities = ["read"] }`,
+	}
+	for path, content := range files {
+		if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git := gitops.Git{tempGitDir}
+	must := mustT[string](t)
+	must(git.CombinedOutput("init"))
+	must(git.CombinedOutput("config", "user.email", "go-test@localhost"))
+	must(git.CombinedOutput("config", "user.name", "Go Test"))
+	must(git.CombinedOutput("config", "commit.gpgsign", "false"))
+	must(git.CombinedOutput("add", "."))
+	must(git.CombinedOutput("commit", "-m", "init"))
+	must(git.CombinedOutput("branch", "-M", "main"))
+	must(git.CombinedOutput("checkout", "-b", "change"))
+	must(git.CombinedOutput("mv", "auth/gcp/roles/app", "auth/gcp/roles/app2"))
+	must(git.CombinedOutput("mv", "sys/policies/acl/reader", "sys/policies/acl/writer"))
+	must(git.CombinedOutput("commit", "-m", "rename"))
+	changes, _, err := gitops.GetChangedFiles(context.Background(), tempGitDir, "main", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]gitops.ChangedFile{
+		{
+			Path:      "auth/gcp/roles/app2",
+			OldPath:   "auth/gcp/roles/app",
+			Mutation:  gitops.Rename,
+			Principal: true,
+		},
+		{
+			Path:     "sys/policies/acl/reader",
+			Mutation: gitops.Delete,
+			Policy:   true,
+		},
+		{
+			Path:     "sys/policies/acl/writer",
+			OldPath:  "sys/policies/acl/reader",
+			Mutation: gitops.Add,
+			Policy:   true,
+		},
+	}, changes); diff != "" {
+		t.Fatal(diff)
+	}
+	// the principal kept its policies, so moving it changes nothing
+	diff, err := gitops.GetMovedAuthPrincipalDifferential(tempGitDir, "auth/gcp/roles/app", "auth/gcp/roles/app2", "main", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Empty() {
+		t.Fatalf("expected an empty differential for a moved principal, got %+v", diff)
+	}
+	bindings, err := gitops.GetAuthPrincipalBindingChanges(tempGitDir, changes[0], "main", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bindings) != 0 {
+		t.Fatalf("expected no binding changes for a moved principal, got %v", bindings)
+	}
+}
+
+func TestGetChangedFilesBetweenRefs(t *testing.T) {
+	tempGitDir := t.TempDir()
+	var (
+		rolesPath    = filepath.Join(tempGitDir, "auth", "gcp", "roles")
+		policiesPath = filepath.Join(tempGitDir, "sys", "policies", "acl")
+		git          = gitops.Git{tempGitDir}
+		must         = mustT[string](t)
+	)
+	for _, dir := range []string{rolesPath, policiesPath} {
+		if err := os.MkdirAll(dir, 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(filepath.Join(rolesPath, "app"), `{"token_policies": ["reader"]}`)
+	writeFile(filepath.Join(policiesPath, "reader"), `path "secret/*" { capabilities = ["read"] }`)
+	writeFile(filepath.Join(policiesPath, "other"), `path "other/*" { capabilities = ["read"] }`)
+	must(git.CombinedOutput("init"))
+	must(git.CombinedOutput("config", "user.email", "go-test@localhost"))
+	must(git.CombinedOutput("config", "user.name", "Go Test"))
+	must(git.CombinedOutput("config", "commit.gpgsign", "false"))
+	must(git.CombinedOutput("add", "."))
+	must(git.CombinedOutput("commit", "-m", "init"))
+	must(git.CombinedOutput("branch", "-M", "main"))
+	// the PR changes reader
+	must(git.CombinedOutput("checkout", "-b", "feature"))
+	writeFile(filepath.Join(policiesPath, "reader"), `path "secret/*" { capabilities = ["read", "list"] }`)
+	must(git.CombinedOutput("commit", "-am", "feature"))
+	// while main moves on
+	must(git.CombinedOutput("checkout", "main"))
+	writeFile(filepath.Join(policiesPath, "other"), `path "other/*" { capabilities = ["list"] }`)
+	must(git.CombinedOutput("commit", "-am", "main"))
+	// and the working copy has nothing to do with either
+	writeFile(filepath.Join(policiesPath, "reader"), `path "secret/*" { capabilities = ["deny"] }`)
+
+	t.Run("TwoDot", func(t *testing.T) {
+		changes, _, err := gitops.GetChangedFiles(context.Background(), tempGitDir, "main", "feature")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]gitops.ChangedFile{
+			{Path: "sys/policies/acl/other", Mutation: gitops.Change, Policy: true},
+			{Path: "sys/policies/acl/reader", Mutation: gitops.Change, Policy: true},
+		}, changes); diff != "" {
+			t.Fatal(diff)
+		}
+	})
+	t.Run("MergeBase", func(t *testing.T) {
+		mergeBase, err := gitops.MergeBase(tempGitDir, "main", "feature")
+		if err != nil {
+			t.Fatal(err)
+		}
+		changes, _, err := gitops.GetChangedFiles(context.Background(), tempGitDir, mergeBase, "feature")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]gitops.ChangedFile{
+			{Path: "sys/policies/acl/reader", Mutation: gitops.Change, Policy: true},
+		}, changes); diff != "" {
+			t.Fatal(diff)
+		}
+		diffs, err := gitops.GetPolicyChangeDifferentials(
+			changes, tempGitDir, "reader", filepath.Join("sys", "policies", "acl"), "auth", mergeBase, "feature",
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diff, exists := diffs["auth/gcp/roles/app"]
+		if !exists {
+			t.Fatalf("expected a differential for auth/gcp/roles/app, got %v", diffs)
+		}
+		// the working copy's deny is ignored
+		if metrics := diff.Metrics(); metrics.Total() != 1 {
+			t.Fatalf("expected 1 change from adding list, got %+v", diff)
+		}
+	})
+}
+
 func mustT[T any](t *testing.T) func(T, error) T {
 	t.Helper()
 	return func(thing T, err error) T {
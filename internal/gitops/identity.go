@@ -0,0 +1,376 @@
+package gitops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/mitchellh/mapstructure"
+	"github.com/rs/zerolog/log"
+	"github.com/threatkey-oss/hvresult/internal"
+	"golang.org/x/sync/errgroup"
+)
+
+// An identity group as written to identity/group/name/<name>.
+type identityGroupData struct {
+	ID       string   `mapstructure:"id" json:"id"`
+	Name     string   `mapstructure:"name" json:"name"`
+	Type     string   `mapstructure:"type" json:"type"`
+	Policies []string `mapstructure:"policies" json:"policies,omitempty"`
+	// Groups whose members get this group's policies.
+	MemberGroupIDs []string `mapstructure:"member_group_ids" json:"member_group_ids,omitempty"`
+	// Only internal groups have their members managed in Vault.
+	MemberEntityIDs []string `mapstructure:"member_entity_ids" json:"member_entity_ids,omitempty"`
+	// Only external groups have an alias, which ties them to a group from an auth mount.
+	Alias *identityGroupAlias `mapstructure:"alias" json:"alias,omitempty"`
+}
+
+type identityGroupAlias struct {
+	Name          string `mapstructure:"name" json:"name"`
+	MountAccessor string `mapstructure:"mount_accessor" json:"mount_accessor"`
+}
+
+// An identity entity as written to identity/entity/name/<name>.
+type identityEntityData struct {
+	ID       string   `mapstructure:"id" json:"id"`
+	Name     string   `mapstructure:"name" json:"name"`
+	Policies []string `mapstructure:"policies" json:"policies,omitempty"`
+	// Groups the entity is directly a member of. Internal groups list their members themselves, so this only
+	// matters for external groups, whose members are decided at login.
+	DirectGroupIDs []string `mapstructure:"direct_group_ids" json:"direct_group_ids,omitempty"`
+}
+
+// Lists and reads everything at an identity name endpoint, e.g. identity/group/name, keyed by name.
+func fetchIdentityThings[T any](ctx context.Context, vaultLogical *vault.Logical, listPath string) (map[string]T, error) {
+	names, err := listAuthPrincipals(ctx, vaultLogical, listPath)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		eg     errgroup.Group
+		mutex  sync.Mutex
+		things = make(map[string]T, len(names))
+	)
+	eg.SetLimit(5)
+	for i := range names {
+		name := names[i]
+		eg.Go(func() error {
+			readPath := listPath + "/" + name
+			log.Debug().Str("getPath", readPath).Msg("reading identity")
+			secret, err := vaultLogical.ReadWithContext(ctx, readPath)
+			if err != nil {
+				return fmt.Errorf("error reading %s: %w", readPath, err)
+			}
+			if secret == nil || secret.Data == nil {
+				// deleted since it was listed
+				return nil
+			}
+			var thing T
+			if err := mapstructure.Decode(secret.Data, &thing); err != nil {
+				return fmt.Errorf("error decoding %s: %w", readPath, err)
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			things[name] = thing
+			return nil
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	return things, nil
+}
+
+// DownloadIdentity writes every identity group and entity in Vault to identityDirectory as group/name/<name> and
+// entity/name/<name>.
+func DownloadIdentity(ctx context.Context, vc *vault.Client, identityDirectory string, opts DownloadOptions) error {
+	vaultLogical := vc.Logical()
+	groups, err := fetchIdentityThings[identityGroupData](ctx, vaultLogical, "identity/group/name")
+	if err != nil {
+		return err
+	}
+	entities, err := fetchIdentityThings[identityEntityData](ctx, vaultLogical, "identity/entity/name")
+	if err != nil {
+		return err
+	}
+	downloaded := map[string]bool{"group/name": true, "entity/name": true}
+	for _, directory := range []string{"group/name", "entity/name"} {
+		if err := os.MkdirAll(filepath.Join(identityDirectory, filepath.FromSlash(directory)), 0o750); err != nil {
+			return fmt.Errorf("error creating identity directory: %w", err)
+		}
+	}
+	for name, group := range groups {
+		// internal groups come back with an empty alias
+		if group.Alias != nil && group.Alias.Name == "" {
+			group.Alias = nil
+		}
+		if err := writeJSONFile(filepath.Join(identityDirectory, "group", "name", name), group); err != nil {
+			return err
+		}
+		downloaded["group/name/"+name] = true
+	}
+	for name, entity := range entities {
+		if err := writeJSONFile(filepath.Join(identityDirectory, "entity", "name", name), entity); err != nil {
+			return err
+		}
+		downloaded["entity/name/"+name] = true
+	}
+	log.Info().Int("groups", len(groups)).Int("entities", len(entities)).Msg("downloaded all identity groups and entities")
+	if !opts.Prune {
+		return nil
+	}
+	return pruneDirectory(identityDirectory, downloaded, nil)
+}
+
+// identityStore is the identity groups and entities of a namespace in a gitops directory.
+type identityStore struct {
+	namespace string
+	// ID -> group
+	groups map[string]identityGroupData
+	// ID -> entity
+	entities map[string]identityEntityData
+	// group ID -> IDs of the groups it's a member of
+	parents map[string][]string
+}
+
+// Reads the identity groups and entities of a namespace. Directories without any are empty.
+func readIdentityStore(repo *OfflinePolicyProvider, namespace string) (*identityStore, error) {
+	var (
+		identityDirectory = filepath.ToSlash(namespaceIdentityDirectory(namespace))
+		store             = &identityStore{
+			namespace: namespace,
+			groups:    map[string]identityGroupData{},
+			entities:  map[string]identityEntityData{},
+			parents:   map[string][]string{},
+		}
+	)
+	files, err := repo.listFiles(identityDirectory)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		var (
+			relPath = strings.TrimPrefix(file, identityDirectory+"/")
+			thing   any
+		)
+		switch {
+		case strings.HasPrefix(relPath, "group/name/"):
+			thing = &identityGroupData{}
+		case strings.HasPrefix(relPath, "entity/name/"):
+			thing = &identityEntityData{}
+		default:
+			continue
+		}
+		content, err := repo.readFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading identity: %w", err)
+		}
+		if err := json.Unmarshal(content, thing); err != nil {
+			return nil, fmt.Errorf("error unmarshalling %s: %w", file, err)
+		}
+		switch thing := thing.(type) {
+		case *identityGroupData:
+			store.groups[thing.ID] = *thing
+		case *identityEntityData:
+			store.entities[thing.ID] = *thing
+		}
+	}
+	store.linkGroups()
+	return store, nil
+}
+
+// Reads the identity groups and entities of the namespace the client uses, which is namespace relative to the
+// gitops directory.
+func fetchIdentityStore(ctx context.Context, vc *vault.Client, namespace string) (*identityStore, error) {
+	vaultLogical := vc.Logical()
+	groups, err := fetchIdentityThings[identityGroupData](ctx, vaultLogical, "identity/group/name")
+	if err != nil {
+		return nil, err
+	}
+	entities, err := fetchIdentityThings[identityEntityData](ctx, vaultLogical, "identity/entity/name")
+	if err != nil {
+		return nil, err
+	}
+	store := &identityStore{
+		namespace: namespace,
+		groups:    make(map[string]identityGroupData, len(groups)),
+		entities:  make(map[string]identityEntityData, len(entities)),
+		parents:   map[string][]string{},
+	}
+	for _, group := range groups {
+		store.groups[group.ID] = group
+	}
+	for _, entity := range entities {
+		store.entities[entity.ID] = entity
+	}
+	store.linkGroups()
+	return store, nil
+}
+
+// Fills in parents from the members of every group.
+func (s *identityStore) linkGroups() {
+	for _, group := range s.groups {
+		for _, memberID := range group.MemberGroupIDs {
+			s.parents[memberID] = append(s.parents[memberID], group.ID)
+		}
+	}
+	for _, parents := range s.parents {
+		sort.Strings(parents)
+	}
+}
+
+// policy name -> how it was reached
+type identitySources map[string][]internal.PolicySource
+
+func (s identitySources) add(source internal.PolicySource, policyNames ...string) {
+	for _, name := range policyNames {
+		s[name] = append(s[name], source)
+	}
+}
+
+// Adds the policies of a group and every group it's a member of, which members inherit.
+func (s *identityStore) addGroupSources(sources identitySources, groupID string, via []string, visited map[string]bool) {
+	group, exists := s.groups[groupID]
+	// groups can be cyclic and the same group can be reached multiple ways
+	if !exists || visited[groupID] {
+		return
+	}
+	visited[groupID] = true
+	via = append(append([]string{}, via...), group.Name)
+	sources.add(internal.PolicySource{Kind: internal.SourceGroup, Via: via}, group.Policies...)
+	for _, parentID := range s.parents[groupID] {
+		s.addGroupSources(sources, parentID, via, visited)
+	}
+}
+
+// The groups an entity is directly a member of.
+func (s *identityStore) entityGroupIDs(entity identityEntityData) []string {
+	var groupIDs []string
+	for id, group := range s.groups {
+		if slices.Contains(group.MemberEntityIDs, entity.ID) {
+			groupIDs = append(groupIDs, id)
+		}
+	}
+	for _, id := range entity.DirectGroupIDs {
+		if group, exists := s.groups[id]; exists && group.Type == "external" {
+			groupIDs = append(groupIDs, id)
+		}
+	}
+	sort.Strings(groupIDs)
+	return slices.Compact(groupIDs)
+}
+
+// Every group and entity, keyed by path relative to the gitops directory, with where their policies come from.
+func (s *identityStore) principals() map[string]identitySources {
+	var (
+		identityDirectory = filepath.ToSlash(namespaceIdentityDirectory(s.namespace))
+		principals        = make(map[string]identitySources, len(s.groups)+len(s.entities))
+	)
+	for id, group := range s.groups {
+		sources := identitySources{}
+		s.addGroupSources(sources, id, nil, map[string]bool{})
+		principals[path.Join(identityDirectory, "group", "name", group.Name)] = sources
+	}
+	for _, entity := range s.entities {
+		sources := identitySources{}
+		sources.add(internal.PolicySource{Kind: internal.SourceEntity, Via: []string{entity.Name}}, entity.Policies...)
+		visited := map[string]bool{}
+		for _, groupID := range s.entityGroupIDs(entity) {
+			s.addGroupSources(sources, groupID, nil, visited)
+		}
+		principals[path.Join(identityDirectory, "entity", "name", entity.Name)] = sources
+	}
+	return principals
+}
+
+// Builds an RSoP from policy sources, reading policies with getPolicy. Policies that don't exist are skipped.
+func (s *identityStore) rsop(
+	ctx context.Context,
+	sources identitySources,
+	getPolicy func(ctx context.Context, name string) (*internal.Policy, error),
+) (*internal.RSoP, error) {
+	policies := make([]*internal.Policy, 0, len(sources))
+	for _, name := range sortedKeys(sources) {
+		policy, err := getPolicy(ctx, s.namespace+name)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				log.Warn().Err(err).Str("policy", name).Msg("referenced policy does not exist, treating as empty")
+				continue
+			}
+			return nil, fmt.Errorf("error getting policy '%s': %w", name, err)
+		}
+		policy.Sources = sources[name]
+		policies = append(policies, policy)
+	}
+	return &internal.RSoP{Policies: policies}, nil
+}
+
+// GetIdentityDifferentials returns an RSoP differential for every identity group and entity in a namespace that's
+// affected by changes between a historical git ref and the working copy, including through nested groups.
+//
+// Groups and entities are affected when the set of policies they get changes, e.g. because of a membership change,
+// or when they get any of changedPolicies. The current side is read from currentGitRef, or the working copy when it's
+// empty.
+func GetIdentityDifferentials(repositoryPath, namespace string, changedPolicies []string, historicalGitRef, currentGitRef string) (map[string]*internal.RSoPDifferential, error) {
+	ctx := context.Background()
+	historicalRepo, err := newOfflinePolicyProvider(repositoryPath, historicalGitRef)
+	if err != nil {
+		return nil, err
+	}
+	currentRepo, err := newOfflinePolicyProvider(repositoryPath, currentGitRef)
+	if err != nil {
+		return nil, err
+	}
+	historicalStore, err := readIdentityStore(historicalRepo, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error reading identity at %s: %w", historicalGitRef, err)
+	}
+	currentStore, err := readIdentityStore(currentRepo, namespace)
+	if err != nil {
+		return nil, fmt.Errorf("error reading current identity: %w", err)
+	}
+	var (
+		historical = historicalStore.principals()
+		current    = currentStore.principals()
+		paths      = map[string]bool{}
+		diffs      = map[string]*internal.RSoPDifferential{}
+	)
+	for path := range historical {
+		paths[path] = true
+	}
+	for path := range current {
+		paths[path] = true
+	}
+	for _, path := range sortedKeys(paths) {
+		var (
+			historicalNames = sortedKeys(historical[path])
+			currentNames    = sortedKeys(current[path])
+			affected        = !sameStrings(historicalNames, currentNames)
+		)
+		for _, name := range append(historicalNames, currentNames...) {
+			affected = affected || slices.Contains(changedPolicies, name)
+		}
+		if !affected {
+			continue
+		}
+		historicalRSoP, err := historicalStore.rsop(ctx, historical[path], historicalRepo.GetPolicy)
+		if err != nil {
+			return nil, err
+		}
+		currentRSoP, err := currentStore.rsop(ctx, current[path], currentRepo.GetPolicy)
+		if err != nil {
+			return nil, err
+		}
+		diffs[path] = historicalRSoP.Diff(currentRSoP)
+	}
+	return diffs, nil
+}
@@ -0,0 +1,100 @@
+package gitops_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestIdentityDifferentials(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		repo  = t.TempDir()
+		write = func(path, content string) {
+			t.Helper()
+			path = filepath.Join(repo, filepath.FromSlash(path))
+			if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+				t.Fatal(err)
+			}
+		}
+		git  = gitops.Git{Dir: repo}
+		must = mustT[string](t)
+	)
+	write("sys/policies/acl/reader", `path "secret/*" { capabilities = ["read"] }`)
+	write("sys/policies/acl/admin", `path "secret/*" { capabilities = ["update"] }`)
+	write("identity/group/name/engineers", `{"id": "g-eng", "name": "engineers", "type": "internal", "policies": ["reader"], "member_entity_ids": ["e-alice"]}`)
+	write("identity/group/name/admins", `{"id": "g-adm", "name": "admins", "type": "internal", "policies": ["admin"]}`)
+	write("identity/entity/name/alice", `{"id": "e-alice", "name": "alice"}`)
+	write("identity/entity/name/bob", `{"id": "e-bob", "name": "bob"}`)
+	must(git.CombinedOutput("init"))
+	must(git.CombinedOutput("config", "user.email", "go-test@localhost"))
+	must(git.CombinedOutput("config", "user.name", "Go Test"))
+	must(git.CombinedOutput("config", "commit.gpgsign", "false"))
+	must(git.CombinedOutput("add", "."))
+	must(git.CombinedOutput("commit", "-m", "init"))
+	// engineers join admins, so alice gets admin through nested groups
+	write("identity/group/name/admins", `{"id": "g-adm", "name": "admins", "type": "internal", "policies": ["admin"], "member_group_ids": ["g-eng"]}`)
+
+	t.Run("Membership", func(t *testing.T) {
+		diffs, err := gitops.GetIdentityDifferentials(repo, "", nil, "HEAD", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var paths []string
+		for path := range diffs {
+			paths = append(paths, path)
+		}
+		slices.Sort(paths)
+		expected := []string{"identity/entity/name/alice", "identity/group/name/engineers"}
+		if !slices.Equal(paths, expected) {
+			t.Fatalf("expected %v, got %v", expected, paths)
+		}
+		added := diffs["identity/entity/name/alice"].Added["secret/*"]
+		if added == nil || added.Capabilities[internal.Update] == nil {
+			t.Fatalf("expected alice to gain update on secret/*, got %+v", diffs["identity/entity/name/alice"])
+		}
+	})
+	t.Run("Policy", func(t *testing.T) {
+		write("sys/policies/acl/reader", `path "secret/*" { capabilities = ["read", "list"] }`)
+		diffs, err := gitops.GetPolicyChangeDifferentials(nil, repo, "reader", filepath.Join("sys", "policies", "acl"), "auth", "HEAD", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, path := range []string{"identity/entity/name/alice", "identity/group/name/engineers"} {
+			if _, exists := diffs[path]; !exists {
+				t.Errorf("expected a differential for %s, got %v", path, diffs)
+			}
+		}
+		if _, exists := diffs["identity/entity/name/bob"]; exists {
+			t.Error("bob isn't in any group")
+		}
+	})
+	t.Run("Offline", func(t *testing.T) {
+		pp, err := gitops.NewOfflinePolicyProvider(repo, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsop, err := pp.GetRSoP(ctx, "identity/entity/name/alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sources []string
+		for _, policy := range rsop.Policies {
+			for _, source := range policy.Sources {
+				sources = append(sources, policy.Name+" from "+source.String())
+			}
+		}
+		expected := []string{"admin from group engineers -> admins", "reader from group engineers"}
+		if !slices.Equal(sources, expected) {
+			t.Fatalf("expected %v, got %v", expected, sources)
+		}
+	})
+}
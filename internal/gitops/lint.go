@@ -0,0 +1,72 @@
+package gitops
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+
+	"github.com/threatkey-oss/hvresult/internal"
+)
+
+// Lint checks every policy in the working copy of a gitops directory, and every namespace's policy references, for
+// common mistakes. Findings are located relative to the directory.
+func Lint(directory string) ([]internal.LintFinding, error) {
+	repo, err := newOfflinePolicyProvider(directory, "")
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := repo.namespaces()
+	if err != nil {
+		return nil, fmt.Errorf("error listing namespaces: %w", err)
+	}
+	var findings []internal.LintFinding
+	for _, namespace := range namespaces {
+		policyFiles, err := repo.listFiles(namespacePolicyDirectory(namespace))
+		if err != nil {
+			return nil, fmt.Errorf("error listing policies: %w", err)
+		}
+		for _, file := range policyFiles {
+			content, err := repo.readFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("error reading policy: %w", err)
+			}
+			findings = append(findings, internal.LintPolicy(string(content), file)...)
+		}
+		refs, err := readPolicyReferences(repo, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("error reading policy references in namespace '%s': %w", namespace, err)
+		}
+		findings = append(findings, lintReferences(refs, namespace)...)
+	}
+	internal.SortLintFindings(findings)
+	return findings, nil
+}
+
+// Finds dangling references and unreferenced policies in a namespace.
+func lintReferences(refs *policyReferences, namespace string) []internal.LintFinding {
+	var findings []internal.LintFinding
+	for principal, names := range refs.principals {
+		for _, name := range names {
+			if !refs.exists(name) {
+				findings = append(findings, internal.NewLintFinding(internal.LintDanglingReference, principal, name,
+					fmt.Sprintf("references policy %q, which doesn't exist", name)))
+			}
+		}
+	}
+	names := make([]string, 0, len(refs.policies))
+	for name := range refs.policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		// Vault attaches default and the builtin policies itself
+		if name == internal.DefaultPolicyName || internal.BuiltinPolicy(name) != nil || len(refs.referencing(name)) > 0 {
+			continue
+		}
+		file := path.Join(filepath.ToSlash(namespacePolicyDirectory(namespace)), name)
+		findings = append(findings, internal.NewLintFinding(internal.LintUnreferencedPolicy, file, "",
+			fmt.Sprintf("no auth principal, identity group, or entity references policy %q", name)))
+	}
+	return findings
+}
@@ -0,0 +1,49 @@
+package gitops_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestLint(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		write = func(path, content string) {
+			t.Helper()
+			path = filepath.Join(dir, filepath.FromSlash(path))
+			if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+				t.Fatal(err)
+			}
+		}
+	)
+	write("sys/policies/acl/default", `path "sys/capabilities-self" { capabilities = ["update"] }`)
+	write("sys/policies/acl/reader", `path "secret/*" { capabilities = ["read"] }`)
+	write("sys/policies/acl/unused", `path "secret/*/config" { capabilities = ["read"] }`)
+	write("auth/kubernetes/role/app", `{"token_policies": ["reader", "raeder"]}`)
+	write("namespaces/eng/sys/policies/acl/reader", `path "secret/*" { capabilities = ["read"] }`)
+	write("namespaces/eng/identity/group/name/devs", `{"id": "g-devs", "name": "devs", "type": "internal", "policies": ["reader"]}`)
+
+	findings, err := gitops.Lint(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, finding := range findings {
+		got = append(got, finding.Rule+" "+finding.File)
+	}
+	// default is attached by Vault, and eng's reader is referenced by a group in eng
+	if diff := cmp.Diff([]string{
+		"HVR008 auth/kubernetes/role/app",
+		"HVR009 sys/policies/acl/unused",
+		"HVR003 sys/policies/acl/unused",
+	}, got); diff != "" {
+		t.Fatal(diff)
+	}
+}
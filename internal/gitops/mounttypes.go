@@ -0,0 +1,120 @@
+package gitops
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnsupportedAuthMount = errors.New("unknown paths for listing Vault identities for this mount type")
+	ErrInvalidAuthMountType = errors.New("invalid auth mount type")
+)
+
+// AuthMountType is where the principals of an auth method live and which of their fields hold policies.
+type AuthMountType struct {
+	Endpoints []AuthMountEndpoint `mapstructure:"endpoints"`
+	// Fields that hold policies, either as a list or a comma-separated string.
+	//
+	// Defaults to policies, token_policies, and allowed_policies. Fields other than those are read into policies.
+	PolicyFields []string `mapstructure:"policy_fields"`
+}
+
+// AuthMountEndpoint is a place principals can be listed and read, relative to the mount.
+type AuthMountEndpoint struct {
+	// LIST path, e.g. "roles"
+	List string `mapstructure:"list"`
+	// GET path prefix, e.g. "role/"
+	Read string `mapstructure:"read"`
+}
+
+// The standard fields that hold policies.
+var defaultPolicyFields = []string{"policies", "token_policies", "allowed_policies"}
+
+// Every policy field of the built-in mount types, for reading principals of an unknown type.
+var knownPolicyFields = []string{"policies", "token_policies", "allowed_policies", "value"}
+
+func endpoint(list, read string) AuthMountEndpoint {
+	return AuthMountEndpoint{List: list, Read: read}
+}
+
+// All "official" auth methods.
+var builtinAuthMountTypes = map[string]AuthMountType{
+	"alicloud":   {Endpoints: []AuthMountEndpoint{endpoint("role", "role/")}},
+	"approle":    {Endpoints: []AuthMountEndpoint{endpoint("role", "role/")}},
+	"aws":        {Endpoints: []AuthMountEndpoint{endpoint("roles", "role/")}},
+	"azure":      {Endpoints: []AuthMountEndpoint{endpoint("role", "role/")}},
+	"cert":       {Endpoints: []AuthMountEndpoint{endpoint("certs", "certs/")}},
+	"cf":         {Endpoints: []AuthMountEndpoint{endpoint("roles", "roles/")}},
+	"gcp":        {Endpoints: []AuthMountEndpoint{endpoint("roles", "role/")}},
+	"jwt":        {Endpoints: []AuthMountEndpoint{endpoint("role", "role/")}},
+	"kerberos":   {Endpoints: []AuthMountEndpoint{endpoint("groups", "groups/")}},
+	"kubernetes": {Endpoints: []AuthMountEndpoint{endpoint("role", "role/")}},
+	"oci":        {Endpoints: []AuthMountEndpoint{endpoint("role", "role/")}},
+	"oidc":       {Endpoints: []AuthMountEndpoint{endpoint("role", "role/")}},
+	"radius":     {Endpoints: []AuthMountEndpoint{endpoint("users", "users/")}},
+	"saml":       {Endpoints: []AuthMountEndpoint{endpoint("role", "role/")}},
+	"token":      {Endpoints: []AuthMountEndpoint{endpoint("roles", "roles/")}},
+	// namespaces get an ns_token mount instead of token
+	"ns_token": {Endpoints: []AuthMountEndpoint{endpoint("roles", "roles/")}},
+	"userpass": {Endpoints: []AuthMountEndpoint{endpoint("users", "users/")}},
+	"github": {
+		Endpoints:    []AuthMountEndpoint{endpoint("map/teams", "map/teams/"), endpoint("map/users", "map/users/")},
+		PolicyFields: []string{"value"},
+	},
+	"ldap": {Endpoints: []AuthMountEndpoint{endpoint("groups", "groups/"), endpoint("users", "users/")}},
+	"okta": {Endpoints: []AuthMountEndpoint{endpoint("groups", "groups/"), endpoint("users", "users/")}},
+}
+
+var (
+	authMountTypesMutex sync.RWMutex
+	authMountTypes      = builtinAuthMountTypes
+)
+
+// SetAuthMountTypes adds mount types, e.g. for custom auth plugins, replacing any built-in ones with the same name.
+func SetAuthMountTypes(types map[string]AuthMountType) error {
+	merged := make(map[string]AuthMountType, len(builtinAuthMountTypes)+len(types))
+	for name, mountType := range builtinAuthMountTypes {
+		merged[name] = mountType
+	}
+	for name, mountType := range types {
+		if len(mountType.Endpoints) == 0 {
+			return fmt.Errorf("%w '%s': no endpoints", ErrInvalidAuthMountType, name)
+		}
+		for _, endpoint := range mountType.Endpoints {
+			if strings.Trim(endpoint.List, "/") == "" || strings.Trim(endpoint.Read, "/") == "" {
+				return fmt.Errorf("%w '%s': endpoints need both list and read paths", ErrInvalidAuthMountType, name)
+			}
+		}
+		merged[name] = mountType
+	}
+	authMountTypesMutex.Lock()
+	defer authMountTypesMutex.Unlock()
+	authMountTypes = merged
+	return nil
+}
+
+// Returns the endpoints of an auth mount at abspath, e.g. auth/gcp.
+func authMountEndpoints(name, abspath, mountType string) ([]authEndpoint, error) {
+	authMountTypesMutex.RLock()
+	defer authMountTypesMutex.RUnlock()
+	config, exists := authMountTypes[mountType]
+	if !exists {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnsupportedAuthMount, mountType)
+	}
+	policyFields := config.PolicyFields
+	if len(policyFields) == 0 {
+		policyFields = defaultPolicyFields
+	}
+	endpoints := make([]authEndpoint, 0, len(config.Endpoints))
+	for _, endpoint := range config.Endpoints {
+		endpoints = append(endpoints, authEndpoint{
+			mount:          name,
+			listPath:       abspath + "/" + strings.Trim(endpoint.List, "/"),
+			readPathPrefix: abspath + "/" + strings.Trim(endpoint.Read, "/") + "/",
+			policyFields:   policyFields,
+		})
+	}
+	return endpoints, nil
+}
@@ -0,0 +1,37 @@
+package gitops_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestSetAuthMountTypes(t *testing.T) {
+	t.Cleanup(func() {
+		if err := gitops.SetAuthMountTypes(nil); err != nil {
+			t.Fatal(err)
+		}
+	})
+	for name, mountType := range map[string]gitops.AuthMountType{
+		"no endpoints": {PolicyFields: []string{"policies"}},
+		"no list path": {Endpoints: []gitops.AuthMountEndpoint{{Read: "roles/"}}},
+		"no read path": {Endpoints: []gitops.AuthMountEndpoint{{List: "roles", Read: "/"}}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := gitops.SetAuthMountTypes(map[string]gitops.AuthMountType{"custom": mountType})
+			if !errors.Is(err, gitops.ErrInvalidAuthMountType) {
+				t.Fatalf("expected ErrInvalidAuthMountType, got %v", err)
+			}
+		})
+	}
+	err := gitops.SetAuthMountTypes(map[string]gitops.AuthMountType{
+		"custom": {
+			Endpoints:    []gitops.AuthMountEndpoint{{List: "roles", Read: "roles/"}},
+			PolicyFields: []string{"token_policies", "bound_policies"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
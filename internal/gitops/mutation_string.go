@@ -11,11 +11,12 @@ func _() {
 	_ = x[Add-0]
 	_ = x[Delete-1]
 	_ = x[Change-2]
+	_ = x[Rename-3]
 }
 
-const _Mutation_name = "AddDeleteChange"
+const _Mutation_name = "AddDeleteChangeRename"
 
-var _Mutation_index = [...]uint8{0, 3, 9, 15}
+var _Mutation_index = [...]uint8{0, 3, 9, 15, 21}
 
 func (i Mutation) String() string {
 	if i < 0 || i >= Mutation(len(_Mutation_index)-1) {
@@ -0,0 +1,109 @@
+package gitops
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+	"github.com/threatkey-oss/hvresult/internal"
+)
+
+// The directory that each namespace's auth/, identity/, and sys/ trees are written under, e.g. namespaces/eng/team/auth/...
+const namespacesDirectory = "namespaces"
+
+// SplitNamespace splits a path relative to a gitops directory into its namespace and the path within it.
+//
+// For example, "namespaces/eng/team/auth/gcp/role/foo" is "eng/team/" and "auth/gcp/role/foo", while
+// "auth/gcp/role/foo" is in the root namespace "". Namespaces named "auth", "identity", or "sys" aren't supported.
+func SplitNamespace(relativePath string) (namespace, rest string) {
+	relativePath = filepath.ToSlash(relativePath)
+	if !strings.HasPrefix(relativePath, namespacesDirectory+"/") {
+		return "", relativePath
+	}
+	parts := strings.Split(strings.TrimPrefix(relativePath, namespacesDirectory+"/"), "/")
+	for i, part := range parts {
+		if part == "auth" || part == "identity" || part == "sys" {
+			return internal.NormalizeNamespace(strings.Join(parts[:i], "/")), strings.Join(parts[i:], "/")
+		}
+	}
+	return internal.NormalizeNamespace(strings.Join(parts, "/")), ""
+}
+
+// The root of a namespace in a gitops directory.
+func namespaceDirectory(namespace string) string {
+	if namespace == "" {
+		return ""
+	}
+	return filepath.Join(namespacesDirectory, filepath.FromSlash(strings.TrimSuffix(namespace, "/")))
+}
+
+// The policy directory of a namespace, relative to a gitops directory.
+func namespacePolicyDirectory(namespace string) string {
+	return filepath.Join(namespaceDirectory(namespace), "sys", "policies", "acl")
+}
+
+// The auth principal directory of a namespace, relative to a gitops directory.
+func namespacePrincipalDirectory(namespace string) string {
+	return filepath.Join(namespaceDirectory(namespace), "auth")
+}
+
+// The identity group and entity directory of a namespace, relative to a gitops directory.
+func namespaceIdentityDirectory(namespace string) string {
+	return filepath.Join(namespaceDirectory(namespace), "identity")
+}
+
+// DownloadNamespaces downloads the auth principals and policies of every namespace below the client's.
+//
+// Each is written to namespaces/<path>/auth, namespaces/<path>/sys/policies/acl, and with opts.Identity,
+// namespaces/<path>/identity under directory. With opts.Prune, namespaces that no longer exist are removed.
+func DownloadNamespaces(ctx context.Context, vc *vault.Client, directory string, opts DownloadOptions) error {
+	namespaces, err := internal.ListNamespaces(ctx, vc)
+	if err != nil {
+		return err
+	}
+	for _, namespace := range namespaces {
+		var (
+			nsClient = internal.NamespacedClient(vc, namespace.Path)
+			logger   = log.With().Str("namespace", namespace.Path).Logger()
+		)
+		logger.Info().Msg("downloading namespace")
+		if err := DownloadAuth(ctx, nsClient, filepath.Join(directory, namespacePrincipalDirectory(namespace.Path)), opts); err != nil {
+			return fmt.Errorf("error downloading auth mounts in namespace '%s': %w", namespace.Path, err)
+		}
+		if err := DownloadPolicies(ctx, nsClient, filepath.Join(directory, namespacePolicyDirectory(namespace.Path))); err != nil {
+			return fmt.Errorf("error downloading policies in namespace '%s': %w", namespace.Path, err)
+		}
+		if opts.Identity {
+			if err := DownloadIdentity(ctx, nsClient, filepath.Join(directory, namespaceIdentityDirectory(namespace.Path)), opts); err != nil {
+				return fmt.Errorf("error downloading identity in namespace '%s': %w", namespace.Path, err)
+			}
+		}
+	}
+	log.Info().Int("count", len(namespaces)).Msg("downloaded all namespaces")
+	if !opts.Prune {
+		return nil
+	}
+	namespacesRoot := filepath.Join(directory, namespacesDirectory)
+	if _, err := os.Stat(namespacesRoot); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	// each namespace pruned its own trees, so only namespaces that weren't listed are removed
+	var (
+		listed = map[string]bool{}
+		trees  = map[string]bool{}
+	)
+	for _, namespace := range namespaces {
+		relPath := strings.TrimSuffix(namespace.Path, "/")
+		listed[relPath] = true
+		for _, tree := range []string{"auth", "identity", "sys"} {
+			trees[path.Join(relPath, tree)] = true
+		}
+	}
+	return pruneDirectory(namespacesRoot, listed, trees)
+}
@@ -0,0 +1,21 @@
+package gitops_test
+
+import (
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestSplitNamespace(t *testing.T) {
+	for input, expected := range map[string][2]string{
+		"auth/gcp/role/foo":                           {"", "auth/gcp/role/foo"},
+		"sys/policies/acl/reader":                     {"", "sys/policies/acl/reader"},
+		"namespaces/eng/auth/gcp/role/foo":            {"eng/", "auth/gcp/role/foo"},
+		"namespaces/eng/team/sys/policies/acl/reader": {"eng/team/", "sys/policies/acl/reader"},
+		"namespaces/eng/team":                         {"eng/team/", ""},
+	} {
+		if namespace, rest := gitops.SplitNamespace(input); namespace != expected[0] || rest != expected[1] {
+			t.Errorf("SplitNamespace(%q): expected %q, got %q %q", input, expected, namespace, rest)
+		}
+	}
+}
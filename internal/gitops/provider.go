@@ -0,0 +1,222 @@
+package gitops
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/threatkey-oss/hvresult/internal"
+)
+
+var (
+	ErrOfflinePrincipal = errors.New("only auth principal and identity paths like auth/gcp/role/foo, identity/group/name/devs, or namespaces/eng/auth/gcp/role/foo can be evaluated offline")
+)
+
+// OfflinePolicyProvider reads auth principals and policies from a directory written by DownloadAuth and DownloadPolicies.
+//
+// When ref is set, files are read from that git ref instead of the working copy.
+type OfflinePolicyProvider struct {
+	git Git
+	ref string
+}
+
+// Creates an OfflinePolicyProvider for a gitops directory, optionally at a git ref.
+func NewOfflinePolicyProvider(directory, ref string) (internal.PolicyProvider, error) {
+	return newOfflinePolicyProvider(directory, ref)
+}
+
+func newOfflinePolicyProvider(directory, ref string) (*OfflinePolicyProvider, error) {
+	if _, err := os.Stat(filepath.Join(directory, "sys", "policies", "acl")); err != nil {
+		return nil, fmt.Errorf("error checking policy directory - wrong directory specified?: %w", err)
+	}
+	pp := &OfflinePolicyProvider{
+		git: Git{Dir: directory},
+		ref: ref,
+	}
+	if ref != "" {
+		if output, err := pp.git.CombinedOutput("rev-parse", "--verify", ref+"^{commit}"); err != nil {
+			return nil, fmt.Errorf("error resolving git ref '%s': %w: %s", ref, err, output)
+		}
+	}
+	return pp, nil
+}
+
+// Reads a file relative to the gitops directory. Missing files are reported as os.ErrNotExist.
+func (p *OfflinePolicyProvider) readFile(relativePath string) ([]byte, error) {
+	if p.ref == "" {
+		return os.ReadFile(filepath.Join(p.git.Dir, filepath.FromSlash(relativePath)))
+	}
+	// "./" makes the path relative to the directory rather than the repository root
+	readThing := fmt.Sprintf("%s:./%s", p.ref, relativePath)
+	if output, err := p.git.CombinedOutput("cat-file", "-e", readThing); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", readThing, os.ErrNotExist, output)
+	}
+	output, err := p.git.CombinedOutput("show", readThing)
+	if err != nil {
+		return nil, fmt.Errorf("error getting file at ref %s: %w: %s", readThing, err, output)
+	}
+	return []byte(output), nil
+}
+
+// Lists the files below a directory relative to the gitops directory, as slash-separated paths relative to it.
+func (p *OfflinePolicyProvider) listFiles(relativeDirectory string) ([]string, error) {
+	relativeDirectory = filepath.ToSlash(relativeDirectory)
+	if p.ref == "" {
+		var (
+			files    []string
+			walkRoot = filepath.Join(p.git.Dir, filepath.FromSlash(relativeDirectory))
+		)
+		err := filepath.WalkDir(walkRoot, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if path == walkRoot && errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			relPath, err := filepath.Rel(p.git.Dir, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, filepath.ToSlash(relPath))
+			return nil
+		})
+		return files, err
+	}
+	// paths are relative to the working directory, like readFile
+	output, err := p.git.CombinedOutput("ls-tree", "-r", "--name-only", p.ref, "--", "./"+relativeDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("error listing files at ref %s: %w: %s", p.ref, err, output)
+	}
+	if output == "" {
+		return nil, nil
+	}
+	return strings.Split(output, "\n"), nil
+}
+
+// Lists every namespace in the gitops directory, starting with the root namespace "".
+func (p *OfflinePolicyProvider) namespaces() ([]string, error) {
+	files, err := p.listFiles(namespacesDirectory)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		namespaces = []string{""}
+		seen       = map[string]bool{"": true}
+	)
+	for _, file := range files {
+		if namespace, _ := SplitNamespace(file); !seen[namespace] {
+			seen[namespace] = true
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// Reads and parses a policy from sys/policies/acl, or from a namespace's if the name is qualified like "eng/reader".
+func (p *OfflinePolicyProvider) GetPolicy(ctx context.Context, name string) (*internal.Policy, error) {
+	namespace, name := internal.SplitQualifiedName(name)
+	if policy := internal.BuiltinPolicy(name); policy != nil && (namespace == "" || name != internal.RootPolicyName) {
+		policy.Namespace = namespace
+		return policy, nil
+	}
+	data, err := p.readFile(path.Join(filepath.ToSlash(namespacePolicyDirectory(namespace)), name))
+	if err != nil {
+		return nil, fmt.Errorf("error reading policy: %w", err)
+	}
+	policy, err := internal.ParsePolicy(string(data), name)
+	if err != nil {
+		return nil, err
+	}
+	policy.Namespace = namespace
+	return policy, nil
+}
+
+// Generates an RSoP for an auth principal or identity path, e.g. auth/gcp/role/foo, identity/group/name/devs, or
+// namespaces/eng/auth/gcp/role/foo.
+func (p *OfflinePolicyProvider) GetRSoP(ctx context.Context, authThing string) (*internal.RSoP, error) {
+	authThing = strings.Trim(authThing, "/")
+	namespace, nsPath := SplitNamespace(authThing)
+	if strings.HasPrefix(nsPath, "identity/") {
+		store, err := readIdentityStore(p, namespace)
+		if err != nil {
+			return nil, err
+		}
+		sources, exists := store.principals()[authThing]
+		if !exists {
+			return nil, fmt.Errorf("identity '%s': %w", authThing, os.ErrNotExist)
+		}
+		return store.rsop(ctx, sources, p.GetPolicy)
+	}
+	if !strings.HasPrefix(nsPath, "auth/") {
+		return nil, fmt.Errorf("%w: '%s'", ErrOfflinePrincipal, authThing)
+	}
+	content, err := p.readFile(authThing)
+	if err != nil {
+		return nil, fmt.Errorf("error reading auth principal: %w", err)
+	}
+	var data authPrincipalData
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, fmt.Errorf("error unmarshalling %s as auth principal data: %w", authThing, err)
+	}
+	return principalRSoP(ctx, data, namespace, p.GetPolicy)
+}
+
+// Names of the policies tokens from the principal get, sorted and without duplicates, and whether that includes the
+// default policy without it being listed.
+//
+// Only roles get the default policy implicitly, like with ReadthroughPolicyProvider.
+func (a authPrincipalData) attachedPolicies() (names []string, implicitDefault bool) {
+	names = a.AllPolicies()
+	if a.isRole() && internal.AttachesDefaultPolicy(names, a.TokenNoDefaultPolicy) {
+		names = append(names, internal.DefaultPolicyName)
+		implicitDefault = true
+	}
+	sort.Strings(names)
+	return slices.Compact(names), implicitDefault
+}
+
+// Builds the RSoP of an auth principal in a namespace, reading policies with getPolicy.
+//
+// Policies that don't exist are skipped.
+func principalRSoP(
+	ctx context.Context,
+	data authPrincipalData,
+	namespace string,
+	getPolicy func(ctx context.Context, name string) (*internal.Policy, error),
+) (*internal.RSoP, error) {
+	names, implicitDefault := data.attachedPolicies()
+	policies := make([]*internal.Policy, 0, len(names))
+	for _, name := range names {
+		policy, err := getPolicy(ctx, namespace+name)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				log.Warn().Err(err).Str("policy", name).Msg("referenced policy does not exist, treating as empty")
+				continue
+			}
+			return nil, fmt.Errorf("error getting policy '%s': %w", name, err)
+		}
+		source := internal.PolicySource{Kind: internal.SourceRole}
+		if implicitDefault && name == internal.DefaultPolicyName {
+			source.Kind = internal.SourceImplicit
+		}
+		policy.Sources = []internal.PolicySource{source}
+		policies = append(policies, policy)
+	}
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].QualifiedName() < policies[j].QualifiedName()
+	})
+	return &internal.RSoP{Policies: policies}, nil
+}
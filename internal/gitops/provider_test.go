@@ -0,0 +1,114 @@
+package gitops_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+)
+
+func TestOfflinePolicyProvider(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		repo      = t.TempDir()
+		directory = filepath.Join(repo, "vault-policy")
+		write     = func(path, content string) {
+			t.Helper()
+			path = filepath.Join(directory, filepath.FromSlash(path))
+			if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+				t.Fatal(err)
+			}
+		}
+	)
+	write("auth/gcp/role/foo", `{"token_policies": ["reader"]}`)
+	write("auth/ldap/groups/devs", `{"policies": ["reader", "missing"]}`)
+	write("sys/policies/acl/reader", `path "secret/*" { capabilities = ["read"] }`)
+	write("sys/policies/acl/default", `path "auth/token/lookup-self" { capabilities = ["read"] }`)
+	write("namespaces/eng/auth/approle/role/bar", `{"token_policies": ["reader"], "token_no_default_policy": true}`)
+	write("namespaces/eng/sys/policies/acl/reader", `path "secret/*" { capabilities = ["update"] }`)
+	git := gitops.Git{Dir: repo}
+	must := mustT[string](t)
+	must(git.CombinedOutput("init"))
+	must(git.CombinedOutput("config", "user.email", "go-test@localhost"))
+	must(git.CombinedOutput("config", "user.name", "Go Test"))
+	must(git.CombinedOutput("config", "commit.gpgsign", "false"))
+	must(git.CombinedOutput("add", "."))
+	must(git.CombinedOutput("commit", "-m", "init"))
+	// only in the working copy
+	write("sys/policies/acl/reader", `path "secret/*" { capabilities = ["read", "list"] }`)
+
+	names := func(rsop *internal.RSoP) []string {
+		var names []string
+		for _, policy := range rsop.Policies {
+			names = append(names, policy.Name)
+		}
+		return names
+	}
+	t.Run("WorkingCopy", func(t *testing.T) {
+		pp, err := gitops.NewOfflinePolicyProvider(directory, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsop, err := pp.GetRSoP(ctx, "auth/gcp/role/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(rsop); len(got) != 2 || got[0] != "default" || got[1] != "reader" {
+			t.Fatalf("expected the implicit default policy and reader, got %v", got)
+		}
+		if rsop.Policies[0].Sources[0].Kind != internal.SourceImplicit {
+			t.Fatalf("expected default to be implicit, got %v", rsop.Policies[0].Sources)
+		}
+		if caps := rsop.GetCapabilityMap()["secret/*"].Capabilities; len(caps[internal.List]) == 0 {
+			t.Fatalf("expected list from the working copy, got %v", caps)
+		}
+		// missing policies are skipped, and groups don't get default
+		rsop, err = pp.GetRSoP(ctx, "/auth/ldap/groups/devs")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := names(rsop); len(got) != 1 || got[0] != "reader" {
+			t.Fatalf("expected only reader, got %v", got)
+		}
+		// namespaced principals use their namespace's policies, and paths are relative to it
+		rsop, err = pp.GetRSoP(ctx, "namespaces/eng/auth/approle/role/bar")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := rsop.Policies; len(got) != 1 || got[0].QualifiedName() != "eng/reader" {
+			t.Fatalf("expected only eng/reader, got %v", names(rsop))
+		}
+		if entry := rsop.GetCapabilityMap()["eng/secret/*"]; entry == nil || len(entry.Capabilities[internal.Update]) == 0 {
+			t.Fatalf("expected update on eng/secret/*, got %v", rsop.GetCapabilityMap())
+		}
+		if _, err := pp.GetRSoP(ctx, "hvs.sometoken"); !errors.Is(err, gitops.ErrOfflinePrincipal) {
+			t.Fatalf("expected ErrOfflinePrincipal, got %v", err)
+		}
+	})
+	t.Run("Ref", func(t *testing.T) {
+		pp, err := gitops.NewOfflinePolicyProvider(directory, "HEAD")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rsop, err := pp.GetRSoP(ctx, "auth/gcp/role/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if caps := rsop.GetCapabilityMap()["secret/*"].Capabilities; len(caps[internal.List]) != 0 || len(caps[internal.Read]) == 0 {
+			t.Fatalf("expected only read at HEAD, got %v", caps)
+		}
+		if _, err := pp.GetRSoP(ctx, "auth/gcp/role/nope"); !errors.Is(err, os.ErrNotExist) {
+			t.Fatalf("expected os.ErrNotExist, got %v", err)
+		}
+		if _, err := gitops.NewOfflinePolicyProvider(directory, "not-a-ref"); err == nil {
+			t.Fatal("expected an error for a bad ref")
+		}
+	})
+}
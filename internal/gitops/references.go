@@ -0,0 +1,184 @@
+package gitops
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/threatkey-oss/hvresult/internal"
+)
+
+// PolicyReference is a principal referencing a policy by name.
+type PolicyReference struct {
+	Principal string `json:"principal"`
+	Policy    string `json:"policy"`
+}
+
+// PolicyWarnings are policy references in a change that are probably mistakes, like a typo in a policy name.
+type PolicyWarnings struct {
+	// Affected principals that reference policies that don't exist.
+	Dangling []PolicyReference `json:"dangling"`
+	// Paths of policies the change adds that no principal references.
+	Unreferenced []string `json:"unreferenced"`
+	// Policies the change deletes that principals still reference.
+	DeletedReferenced []PolicyReference `json:"deleted_referenced"`
+}
+
+func (w PolicyWarnings) Empty() bool {
+	return len(w.Dangling) == 0 && len(w.Unreferenced) == 0 && len(w.DeletedReferenced) == 0
+}
+
+// The policies of a namespace and who references them.
+type policyReferences struct {
+	policies map[string]bool
+	// principal path -> policy names it references directly
+	principals map[string][]string
+}
+
+func (r *policyReferences) exists(name string) bool {
+	return r.policies[name] || internal.BuiltinPolicy(name) != nil
+}
+
+// Paths of the principals that reference a policy, sorted.
+func (r *policyReferences) referencing(name string) []string {
+	var paths []string
+	for principal, names := range r.principals {
+		if slices.Contains(names, name) {
+			paths = append(paths, principal)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Reads every policy, auth principal, identity group, and entity of a namespace.
+func readPolicyReferences(repo *OfflinePolicyProvider, namespace string) (*policyReferences, error) {
+	refs := &policyReferences{
+		policies:   map[string]bool{},
+		principals: map[string][]string{},
+	}
+	policyFiles, err := repo.listFiles(namespacePolicyDirectory(namespace))
+	if err != nil {
+		return nil, fmt.Errorf("error listing policies: %w", err)
+	}
+	for _, file := range policyFiles {
+		refs.policies[path.Base(file)] = true
+	}
+	principalFiles, err := repo.listFiles(namespacePrincipalDirectory(namespace))
+	if err != nil {
+		return nil, fmt.Errorf("error listing auth principals: %w", err)
+	}
+	for _, file := range principalFiles {
+		content, err := repo.readFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading auth principal: %w", err)
+		}
+		var data authPrincipalData
+		if err := json.Unmarshal(content, &data); err != nil {
+			return nil, fmt.Errorf("error unmarshalling %s as auth principal data: %w", file, err)
+		}
+		refs.principals[file] = data.AllPolicies()
+	}
+	store, err := readIdentityStore(repo, namespace)
+	if err != nil {
+		return nil, err
+	}
+	identityDirectory := filepath.ToSlash(namespaceIdentityDirectory(namespace))
+	for _, group := range store.groups {
+		refs.principals[path.Join(identityDirectory, "group", "name", group.Name)] = group.Policies
+	}
+	for _, entity := range store.entities {
+		refs.principals[path.Join(identityDirectory, "entity", "name", entity.Name)] = entity.Policies
+	}
+	return refs, nil
+}
+
+// GetPolicyWarnings finds policy references that are probably mistakes at currentGitRef, or in the working copy when
+// it's empty: affected principals that reference policies that don't exist, policies added by changes that nothing
+// references, and policies deleted by changes that are still referenced.
+func GetPolicyWarnings(repositoryPath string, changes []ChangedFile, affectedPrincipals []string, currentGitRef string) (PolicyWarnings, error) {
+	warnings := PolicyWarnings{
+		Dangling:          []PolicyReference{},
+		Unreferenced:      []string{},
+		DeletedReferenced: []PolicyReference{},
+	}
+	repo, err := newOfflinePolicyProvider(repositoryPath, currentGitRef)
+	if err != nil {
+		return warnings, err
+	}
+	namespaces := map[string]*policyReferences{}
+	getReferences := func(namespace string) (*policyReferences, error) {
+		if refs, exists := namespaces[namespace]; exists {
+			return refs, nil
+		}
+		refs, err := readPolicyReferences(repo, namespace)
+		if err != nil {
+			return nil, fmt.Errorf("error reading policy references in namespace '%s': %w", namespace, err)
+		}
+		namespaces[namespace] = refs
+		return refs, nil
+	}
+	// namespace + policy name -> deleted, reported as DeletedReferenced instead of Dangling
+	deleted := map[string]bool{}
+	for _, change := range changes {
+		if !change.Policy || change.Mutation == Change {
+			continue
+		}
+		refs, err := getReferences(change.Namespace)
+		if err != nil {
+			return warnings, err
+		}
+		name := path.Base(filepath.ToSlash(change.Path))
+		switch change.Mutation {
+		case Add:
+			if len(refs.referencing(name)) == 0 {
+				warnings.Unreferenced = append(warnings.Unreferenced, change.Path)
+			}
+		case Delete:
+			deleted[change.Namespace+name] = true
+			for _, principal := range refs.referencing(name) {
+				warnings.DeletedReferenced = append(warnings.DeletedReferenced, PolicyReference{Principal: principal, Policy: name})
+			}
+		}
+	}
+	for _, principal := range affectedPrincipals {
+		namespace, _ := SplitNamespace(principal)
+		refs, err := getReferences(namespace)
+		if err != nil {
+			return warnings, err
+		}
+		// principals that were deleted don't reference anything anymore
+		for _, name := range refs.principals[principal] {
+			if !refs.exists(name) && !deleted[namespace+name] {
+				warnings.Dangling = append(warnings.Dangling, PolicyReference{Principal: principal, Policy: name})
+			}
+		}
+	}
+	return warnings, nil
+}
+
+// Prints policy warnings as a GitHub alert, which stands out in pull request comments.
+func printPolicyWarnings(warnings PolicyWarnings) {
+	if warnings.Empty() {
+		return
+	}
+	var lines []string
+	for _, ref := range warnings.Dangling {
+		lines = append(lines, fmt.Sprintf("`%s` references policy `%s`, which doesn't exist.", ref.Principal, ref.Policy))
+	}
+	for _, ref := range warnings.DeletedReferenced {
+		lines = append(lines, fmt.Sprintf("`%s` still references policy `%s`, which is deleted.", ref.Principal, ref.Policy))
+	}
+	for _, policyPath := range warnings.Unreferenced {
+		lines = append(lines, fmt.Sprintf("`%s` is added, but no principal references it.", policyPath))
+	}
+	fmt.Println("> [!WARNING]")
+	fmt.Println("> Policy references that are probably mistakes:")
+	fmt.Println(">")
+	fmt.Println("> * " + strings.Join(lines, "\n> * "))
+	fmt.Println()
+}
@@ -4,52 +4,90 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 	"github.com/threatkey-oss/hvresult/internal"
 )
 
-// GetAuthPrincipalDifferential compares policies for an auth principal in the working copy to a historical git ref.
-func GetAuthPrincipalDifferential(repositoryPath, relativePrincipalPath, relativePolicyDirectory, historicalGitRef string) (*internal.RSoPDifferential, error) {
-	git := Git{Dir: repositoryPath}
-	currentPolicies, err := readPrincipalPolicies(git, relativePrincipalPath, relativePolicyDirectory, "")
-	if err != nil {
+// GetAuthPrincipalDifferential compares policies for an auth principal at currentGitRef, or the working copy when it's
+// empty, to a historical git ref.
+func GetAuthPrincipalDifferential(repositoryPath, relativePrincipalPath, relativePolicyDirectory, historicalGitRef, currentGitRef string) (*internal.RSoPDifferential, error) {
+	return principalDifferential(
+		Git{Dir: repositoryPath},
+		relativePrincipalPath, relativePolicyDirectory,
+		relativePrincipalPath, relativePolicyDirectory,
+		historicalGitRef, currentGitRef,
+	)
+}
+
+// GetMovedAuthPrincipalDifferential compares policies for an auth principal at currentGitRef, or the working copy when
+// it's empty, to the one it was renamed from at a historical git ref. Policies are read from the namespace each side is
+// in.
+func GetMovedAuthPrincipalDifferential(repositoryPath, historicalPrincipalPath, relativePrincipalPath, historicalGitRef, currentGitRef string) (*internal.RSoPDifferential, error) {
+	var (
+		historicalNamespace, _ = SplitNamespace(historicalPrincipalPath)
+		currentNamespace, _    = SplitNamespace(relativePrincipalPath)
+	)
+	return principalDifferential(
+		Git{Dir: repositoryPath},
+		historicalPrincipalPath, namespacePolicyDirectory(historicalNamespace),
+		relativePrincipalPath, namespacePolicyDirectory(currentNamespace),
+		historicalGitRef, currentGitRef,
+	)
+}
+
+func principalDifferential(
+	git Git,
+	historicalPrincipalPath, historicalPolicyDirectory,
+	currentPrincipalPath, currentPolicyDirectory,
+	historicalGitRef, currentGitRef string,
+) (*internal.RSoPDifferential, error) {
+	// added and deleted principals have no policies on the side they're missing from
+	currentPolicies, err := readPrincipalPolicies(git, currentPrincipalPath, currentPolicyDirectory, currentGitRef)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return nil, fmt.Errorf("error getting policies for working copy: %w", err)
 	}
-	historicalPolicies, err := readPrincipalPolicies(git, relativePrincipalPath, relativePolicyDirectory, historicalGitRef)
-	if err != nil {
+	historicalPolicies, err := readPrincipalPolicies(git, historicalPrincipalPath, historicalPolicyDirectory, historicalGitRef)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
 		return nil, fmt.Errorf("error getting policies for historical copy: %w", err)
 	}
 	var (
 		historical = internal.RSoP{Policies: historicalPolicies}
 		current    = internal.RSoP{Policies: currentPolicies}
-		hcapmap    = historical.GetCapabilityMap()
-		ccapmap    = current.GetCapabilityMap()
-		diff       = hcapmap.Diff(ccapmap)
+		diff       = historical.Diff(&current)
 	)
-	log.Debug().Any("historical", hcapmap).Any("current", ccapmap).Send()
+	log.Debug().Any("added", diff.Added).Any("removed", diff.Removed).Send()
 	return diff, nil
 }
 
-// GetPolicyChangeDifferentials returns an RSoP differential for every auth principal that involves this policy.
+// GetPolicyChangeDifferentials returns an RSoP differential for every auth principal, identity group, and entity
+// that involves this policy at currentGitRef, or in the working copy when it's empty.
 func GetPolicyChangeDifferentials(
 	changedFiles []ChangedFile,
 	repositoryPath, policyName,
 	relativePolicyDirectory, relativePrincipalDirectory,
-	historicalGitRef string,
+	historicalGitRef, currentGitRef string,
 ) (map[string]*internal.RSoPDifferential, error) {
 	// TODO: make some sort of cache thing for Windows and IOPS-constrainted runtimes
 	var (
 		git                = Git{Dir: repositoryPath}
 		affectedPrincipals = make(map[string]*internal.RSoPDifferential, len(changedFiles))
+		// current path -> path before a rename
+		renamedFrom = map[string]string{}
 	)
 	// determine if any relevant files got deleted
-	// (these are not covered by the filepath.WalkDir invocation below)
+	// (these are not covered by the listing below)
 	for _, changed := range changedFiles {
-		if changed.Principal && changed.Mutation == Delete {
+		if changed.Principal && changed.Mutation == Rename {
+			renamedFrom[changed.Path] = changed.OldPath
+		}
+		// policies only apply to principals in the same namespace
+		inNamespace := strings.HasPrefix(filepath.ToSlash(changed.Path), filepath.ToSlash(relativePrincipalDirectory)+"/")
+		if changed.Principal && changed.Mutation == Delete && inNamespace {
 			policies, err := readPrincipalPolicies(git, changed.Path, relativePolicyDirectory, historicalGitRef)
 			if err != nil {
 				return nil, fmt.Errorf("error reading policies for deleted auth principal %s: %w", changed.Path, err)
@@ -63,82 +101,74 @@ func GetPolicyChangeDifferentials(
 			}
 			if relevant {
 				rsop := &internal.RSoP{Policies: policies}
-				diff := rsop.GetCapabilityMap().Diff(internal.RSoPCapMap{})
+				diff := rsop.Diff(&internal.RSoP{})
 				affectedPrincipals[changed.Path] = diff
 			}
 		}
 	}
 	// crawl everything else
-	absWalkRoot, err := filepath.Abs(filepath.Join(repositoryPath, relativePrincipalDirectory))
+	currentRepo, err := newOfflinePolicyProvider(repositoryPath, currentGitRef)
 	if err != nil {
-		return nil, fmt.Errorf("error getting absolute path of auth principal directory: %w", err)
+		return nil, err
 	}
-	log.Debug().Str("root", absWalkRoot).Str("policy", policyName).Msg("walking auth directory for policy matches")
-	err = filepath.WalkDir(absWalkRoot, func(path string, d fs.DirEntry, _ error) error {
-		if d.IsDir() {
-			return nil
-		}
-		content, err := os.ReadFile(path)
+	log.Debug().Str("directory", relativePrincipalDirectory).Str("policy", policyName).Msg("listing auth principals for policy matches")
+	relPaths, err := currentRepo.listFiles(relativePrincipalDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("error listing auth principals: %w", err)
+	}
+	for _, relPath := range relPaths {
+		content, err := currentRepo.readFile(relPath)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("error reading auth principal: %w", err)
 		}
 		var authData authPrincipalData
 		if err := json.Unmarshal(content, &authData); err != nil {
-			return fmt.Errorf("error unmarshalling %s as auth principal data: %w", path, err)
+			return nil, fmt.Errorf("error unmarshalling %s as auth principal data: %w", relPath, err)
 		}
-		for _, name := range authData.AllPolicies() {
-			if name == policyName {
-				relPath, err := filepath.Rel(git.Dir, path)
-				if err != nil {
-					return fmt.Errorf("error getting relative path to auth principal: %w", err)
-				}
-				diff, err := GetAuthPrincipalDifferential(git.Dir, relPath, relativePolicyDirectory, historicalGitRef)
-				if err != nil {
-					return err
-				}
-				affectedPrincipals[relPath] = diff
-				return nil
-			}
+		if names, _ := authData.attachedPolicies(); !slices.Contains(names, policyName) {
+			continue
 		}
-		return nil
-	})
-	return affectedPrincipals, err
-}
-
-// when gitRef is the empty string, this reads from the working copy.
-func readPrincipalPolicies(git Git, relativePrincipalPath, relativePolicyDirectory, historicalGitRef string) ([]*internal.Policy, error) {
-	var (
-		principalData []byte
-		readThing     string
-	)
-	if historicalGitRef == "" {
-		// working copy
-		readThing = filepath.Join(git.Dir, relativePrincipalPath)
-		data, err := os.ReadFile(readThing)
-		if err != nil {
-			return nil, fmt.Errorf("error reading working copy auth principle file at '%s': %w", readThing, err)
+		var diff *internal.RSoPDifferential
+		if oldPath, renamed := renamedFrom[relPath]; renamed {
+			diff, err = GetMovedAuthPrincipalDifferential(git.Dir, oldPath, relPath, historicalGitRef, currentGitRef)
+		} else {
+			diff, err = GetAuthPrincipalDifferential(git.Dir, relPath, relativePolicyDirectory, historicalGitRef, currentGitRef)
 		}
-		principalData = data
-	} else {
-		readThing = fmt.Sprintf("%s:%s", historicalGitRef, relativePrincipalPath)
-		contentStr, err := git.CombinedOutput("show", readThing)
 		if err != nil {
-			return nil, fmt.Errorf("error getting auth principal file at ref %s: %w", readThing, err)
+			return nil, err
 		}
-		log.Debug().Str("output", contentStr).Msgf("git show %s", readThing)
-		principalData = []byte(contentStr)
+		affectedPrincipals[relPath] = diff
 	}
-	// find out what policies apply
-	var data authPrincipalData
-	if err := json.Unmarshal(principalData, &data); err != nil {
-		return nil, fmt.Errorf("error unmarshalling %s as auth principal data: %w", readThing, err)
+	namespace, _ := SplitNamespace(relativePolicyDirectory)
+	identities, err := GetIdentityDifferentials(repositoryPath, namespace, []string{policyName}, historicalGitRef, currentGitRef)
+	if err != nil {
+		return nil, err
+	}
+	for path, diff := range identities {
+		affectedPrincipals[path] = diff
+	}
+	return affectedPrincipals, nil
+}
+
+// when gitRef is the empty string, this reads from the working copy.
+func readPrincipalPolicies(git Git, relativePrincipalPath, relativePolicyDirectory, historicalGitRef string) ([]*internal.Policy, error) {
+	data, err := readPrincipalData(git, relativePrincipalPath, historicalGitRef)
+	if err != nil {
+		return nil, err
 	}
 	// get policies
 	var (
-		allPolicies = data.AllPolicies()
-		policies    = make([]*internal.Policy, 0, len(allPolicies))
+		// like the offline and Vault providers, roles get the default policy unless told otherwise
+		allPolicies, _ = data.attachedPolicies()
+		policies       = make([]*internal.Policy, 0, len(allPolicies))
+		namespace, _   = SplitNamespace(relativePrincipalPath)
 	)
 	for _, policyName := range allPolicies {
+		if policy := internal.BuiltinPolicy(policyName); policy != nil {
+			policy.Namespace = namespace
+			policies = append(policies, policy)
+			continue
+		}
 		var (
 			policyReadThing string
 			policyData      string
@@ -152,11 +182,15 @@ func readPrincipalPolicies(git Git, relativePrincipalPath, relativePolicyDirecto
 					log.Warn().Err(err).Msg("referenced policy does not exist on disk, treating as empty")
 					continue
 				}
-				return nil, fmt.Errorf("error reading working copy policy file at '%s': %w", readThing, err)
+				return nil, fmt.Errorf("error reading working copy policy file at '%s': %w", policyReadThing, err)
 			}
 			policyData = string(data)
 		} else {
-			policyReadThing = fmt.Sprintf("%s:%s", historicalGitRef, filepath.Join(relativePolicyDirectory, policyName))
+			policyReadThing = fmt.Sprintf("%s:%s", historicalGitRef, filepath.ToSlash(filepath.Join(relativePolicyDirectory, policyName)))
+			if output, err := git.CombinedOutput("cat-file", "-e", policyReadThing); err != nil {
+				log.Warn().Str("output", output).Str("policy", policyReadThing).Msg("referenced policy does not exist at ref, treating as empty")
+				continue
+			}
 			policyData, err = git.CombinedOutput("show", policyReadThing)
 			if err != nil {
 				return nil, fmt.Errorf("error getting policy file at ref %s: %w", policyReadThing, err)
@@ -166,7 +200,41 @@ func readPrincipalPolicies(git Git, relativePrincipalPath, relativePolicyDirecto
 		if err != nil {
 			return nil, fmt.Errorf("error parsing %s: %w", policyData, err)
 		}
+		policy.Namespace = namespace
 		policies = append(policies, policy)
 	}
 	return policies, nil
 }
+
+// when gitRef is the empty string, this reads from the working copy.
+func readPrincipalData(git Git, relativePrincipalPath, historicalGitRef string) (authPrincipalData, error) {
+	var (
+		data          authPrincipalData
+		principalData []byte
+		readThing     string
+	)
+	if historicalGitRef == "" {
+		// working copy
+		readThing = filepath.Join(git.Dir, relativePrincipalPath)
+		content, err := os.ReadFile(readThing)
+		if err != nil {
+			return data, fmt.Errorf("error reading working copy auth principle file at '%s': %w", readThing, err)
+		}
+		principalData = content
+	} else {
+		readThing = fmt.Sprintf("%s:%s", historicalGitRef, relativePrincipalPath)
+		if output, err := git.CombinedOutput("cat-file", "-e", readThing); err != nil {
+			return data, fmt.Errorf("auth principal file at ref %s: %w: %s", readThing, os.ErrNotExist, output)
+		}
+		contentStr, err := git.CombinedOutput("show", readThing)
+		if err != nil {
+			return data, fmt.Errorf("error getting auth principal file at ref %s: %w", readThing, err)
+		}
+		log.Debug().Str("output", contentStr).Msgf("git show %s", readThing)
+		principalData = []byte(contentStr)
+	}
+	if err := json.Unmarshal(principalData, &data); err != nil {
+		return data, fmt.Errorf("error unmarshalling %s as auth principal data: %w", readThing, err)
+	}
+	return data, nil
+}
@@ -0,0 +1,130 @@
+package gitops
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"path/filepath"
+	"sort"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/rs/zerolog/log"
+	"github.com/threatkey-oss/hvresult/internal"
+)
+
+// ReadPrincipalRSoPs reads the RSoP of every auth principal, identity group, and entity in a directory written by
+// DownloadAuth, DownloadIdentity, and DownloadPolicies, at a git ref or in the working copy when it's empty.
+//
+// Keys are the principal paths relative to directory, e.g. "auth/approle/role/foo", "identity/group/name/devs", or
+// "namespaces/eng/auth/approle/role/foo".
+func ReadPrincipalRSoPs(directory, ref string) (map[string]*internal.RSoP, error) {
+	ctx := context.Background()
+	repo, err := newOfflinePolicyProvider(directory, ref)
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := repo.namespaces()
+	if err != nil {
+		return nil, err
+	}
+	rsops := map[string]*internal.RSoP{}
+	for _, namespace := range namespaces {
+		principals, err := repo.listFiles(namespacePrincipalDirectory(namespace))
+		if err != nil {
+			return nil, fmt.Errorf("error listing auth principals: %w", err)
+		}
+		for _, principal := range principals {
+			if rsops[principal], err = repo.GetRSoP(ctx, principal); err != nil {
+				return nil, fmt.Errorf("error reading auth principal '%s': %w", principal, err)
+			}
+		}
+		store, err := readIdentityStore(repo, namespace)
+		if err != nil {
+			return nil, err
+		}
+		for path, sources := range store.principals() {
+			if rsops[path], err = store.rsop(ctx, sources, repo.GetPolicy); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return rsops, nil
+}
+
+// LivePrincipalRSoPs reads the RSoP of every auth principal, identity group, and entity in Vault, listing the same
+// mounts as DownloadAuth. With namespaces, every namespace below the client's is read too.
+//
+// Keys are where DownloadNamespaces would write them, e.g. "auth/approle/role/foo", "identity/group/name/devs", or
+// "namespaces/eng/auth/approle/role/foo".
+func LivePrincipalRSoPs(ctx context.Context, vc *vault.Client, pp internal.PolicyProvider, namespaces bool) (map[string]*internal.RSoP, error) {
+	paths := []string{""}
+	if namespaces {
+		children, err := internal.ListNamespaces(ctx, vc)
+		if err != nil {
+			return nil, err
+		}
+		for _, namespace := range children {
+			paths = append(paths, namespace.Path)
+		}
+	}
+	var (
+		rsops = map[string]*internal.RSoP{}
+		// most principals share policies, so only read each once
+		policies        = map[string]*internal.Policy{}
+		cachedGetPolicy = func(ctx context.Context, name string) (*internal.Policy, error) {
+			policy, cached := policies[name]
+			if !cached {
+				var err error
+				if policy, err = pp.GetPolicy(ctx, name); err != nil {
+					return nil, err
+				}
+				policies[name] = policy
+			}
+			// each RSoP sets its own sources
+			copied := *policy
+			return &copied, nil
+		}
+	)
+	for _, namespace := range paths {
+		var (
+			nsClient     = internal.NamespacedClient(vc, namespace)
+			namespaceDir = filepath.ToSlash(namespaceDirectory(namespace))
+		)
+		auth, err := fetchAuth(ctx, nsClient)
+		if err != nil {
+			return nil, err
+		}
+		for key, data := range auth {
+			principal := path.Join(namespaceDir, key)
+			if rsops[principal], err = principalRSoP(ctx, data, namespace, cachedGetPolicy); err != nil {
+				return nil, fmt.Errorf("error evaluating auth principal '%s': %w", principal, err)
+			}
+		}
+		store, err := fetchIdentityStore(ctx, nsClient, namespace)
+		if err != nil {
+			return nil, err
+		}
+		for principal, sources := range store.principals() {
+			if rsops[principal], err = store.rsop(ctx, sources, cachedGetPolicy); err != nil {
+				return nil, err
+			}
+		}
+		log.Debug().Str("namespace", namespace).Msg("read all principals")
+	}
+	return rsops, nil
+}
+
+// WhoCan evaluates a request against the RSoP of every principal.
+func WhoCan(rsops map[string]*internal.RSoP, requestPath string, caps []internal.Capability) internal.AccessReport {
+	report := make(internal.AccessReport, 0, len(rsops))
+	for principal, rsop := range rsops {
+		report = append(report, internal.PrincipalAccess{
+			Principal: principal,
+			Access:    rsop.Evaluate(requestPath, caps),
+		})
+	}
+	sort.Slice(report, func(i, j int) bool {
+		return report[i].Principal < report[j].Principal
+	})
+	return report
+}
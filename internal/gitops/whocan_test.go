@@ -0,0 +1,140 @@
+package gitops_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/threatkey-oss/hvresult/internal"
+	"github.com/threatkey-oss/hvresult/internal/gitops"
+	"github.com/threatkey-oss/hvresult/internal/testcluster"
+)
+
+func TestWhoCan(t *testing.T) {
+	directory := t.TempDir()
+	for path, content := range map[string]string{
+		"auth/approle/role/reader":                `{"token_policies": ["reader"]}`,
+		"auth/approle/role/blocked":               `{"token_policies": ["reader", "denier"]}`,
+		"auth/approle/role/nodefault":             `{"token_policies": ["reader"], "token_no_default_policy": true}`,
+		"auth/approle/role/empty":                 `{"token_policies": []}`,
+		"auth/ldap/groups/nobody":                 `{"policies": ["unrelated"]}`,
+		"sys/policies/acl/default":                `path "sys/capabilities-self" { capabilities = ["update"] }`,
+		"sys/policies/acl/reader":                 `path "secret/*" { capabilities = ["read"] }`,
+		"sys/policies/acl/denier":                 `path "secret/prod/+" { capabilities = ["deny"] }`,
+		"sys/policies/acl/unrelated":              `path "other/*" { capabilities = ["read"] }`,
+		"namespaces/eng/auth/approle/role/reader": `{"token_policies": ["reader"]}`,
+		"namespaces/eng/sys/policies/acl/reader":  `path "secret/*" { capabilities = ["read"] }`,
+		"identity/group/name/readers":             `{"id": "g1", "name": "readers", "type": "internal", "policies": ["reader"]}`,
+	} {
+		path = filepath.Join(directory, filepath.FromSlash(path))
+		if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rsops, err := gitops.ReadPrincipalRSoPs(directory, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rsops) != 7 {
+		t.Fatalf("expected 7 principals, got %d", len(rsops))
+	}
+	report := gitops.WhoCan(rsops, "secret/prod/db", []internal.Capability{internal.Read})
+	relevant := map[string]bool{}
+	for _, access := range report {
+		if access.Relevant() {
+			relevant[access.Principal] = access.Allowed
+		}
+	}
+	if allowed, ok := relevant["auth/approle/role/reader"]; !ok || !allowed {
+		t.Errorf("expected reader to be allowed: %+v", relevant)
+	}
+	if allowed, ok := relevant["identity/group/name/readers"]; !ok || !allowed {
+		t.Errorf("expected the readers group to be allowed: %+v", relevant)
+	}
+	if allowed, ok := relevant["auth/approle/role/blocked"]; !ok || allowed {
+		t.Errorf("expected blocked to be reported as denied: %+v", relevant)
+	}
+	// its secret/* is eng/secret/*
+	if _, ok := relevant["namespaces/eng/auth/approle/role/reader"]; ok {
+		t.Errorf("expected the namespaced reader to be omitted: %+v", relevant)
+	}
+	if _, ok := relevant["auth/ldap/groups/nobody"]; ok {
+		t.Errorf("expected nobody to be omitted: %+v", relevant)
+	}
+	// roles get the default policy unless they opt out, like in Vault
+	withDefault := map[string]bool{}
+	for _, access := range gitops.WhoCan(rsops, "sys/capabilities-self", []internal.Capability{internal.Update}) {
+		if access.Relevant() && access.Allowed {
+			withDefault[access.Principal] = true
+		}
+	}
+	if !withDefault["auth/approle/role/reader"] || !withDefault["auth/approle/role/empty"] || withDefault["auth/approle/role/nodefault"] || withDefault["auth/ldap/groups/nobody"] {
+		t.Errorf("expected only roles without token_no_default_policy to get default: %+v", withDefault)
+	}
+	// principals deleted from the working copy are still at the ref
+	git := gitops.Git{Dir: directory}
+	must := mustT[string](t)
+	must(git.CombinedOutput("init"))
+	must(git.CombinedOutput("config", "user.email", "go-test@localhost"))
+	must(git.CombinedOutput("config", "user.name", "Go Test"))
+	must(git.CombinedOutput("config", "commit.gpgsign", "false"))
+	must(git.CombinedOutput("add", "."))
+	must(git.CombinedOutput("commit", "-m", "init"))
+	if err := os.Remove(filepath.Join(directory, "auth", "approle", "role", "reader")); err != nil {
+		t.Fatal(err)
+	}
+	atRef, err := gitops.ReadPrincipalRSoPs(directory, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := atRef["auth/approle/role/reader"]; !exists || len(atRef) != len(rsops) {
+		t.Errorf("expected every principal at HEAD, got %d", len(atRef))
+	}
+}
+
+func TestLivePrincipalRSoPs(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		client = testcluster.NewTestCluster(t)
+	)
+	if err := client.Sys().PutPolicy("reader", `path "secret/*" { capabilities = ["read"] }`); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Sys().EnableAuthWithOptions("approle", &vault.EnableAuthOptions{Type: "approle"}); err != nil {
+		t.Fatal(err)
+	}
+	for path, data := range map[string]map[string]any{
+		"auth/approle/role/reader": {"token_policies": []string{"reader", "missing"}},
+		"identity/group":           {"name": "readers", "policies": []string{"reader"}},
+	} {
+		if _, err := client.Logical().Write(path, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pp, err := internal.NewReadthroughPolicyProvider(nil, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsops, err := gitops.LivePrincipalRSoPs(ctx, client, pp, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, principal := range []string{"auth/approle/role/reader", "identity/group/name/readers"} {
+		rsop, exists := rsops[principal]
+		if !exists {
+			t.Fatalf("expected %s, got %v", principal, rsops)
+		}
+		if !rsop.Evaluate("secret/foo", []internal.Capability{internal.Read}).Allowed {
+			t.Errorf("expected %s to read secret/foo", principal)
+		}
+	}
+	// like offline, roles get the default policy
+	if !rsops["auth/approle/role/reader"].Evaluate("sys/capabilities-self", []internal.Capability{internal.Update}).Allowed {
+		t.Error("expected the role to get the default policy")
+	}
+}
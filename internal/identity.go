@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/mitchellh/mapstructure"
+)
+
+// IdentityEntity is the subset of an identity/entity/id/:id response that affects policy.
+type IdentityEntity struct {
+	ID       string            `mapstructure:"id" json:"id"`
+	Name     string            `mapstructure:"name" json:"name"`
+	Metadata map[string]string `mapstructure:"metadata" json:"metadata,omitempty"`
+	Aliases  []IdentityAlias   `mapstructure:"aliases" json:"aliases,omitempty"`
+	// All groups the entity belongs to, directly or not.
+	GroupIDs []string `mapstructure:"group_ids" json:"group_ids,omitempty"`
+	// Groups the entity is a member of, not including their parents.
+	DirectGroupIDs []string `mapstructure:"direct_group_ids" json:"direct_group_ids,omitempty"`
+	Policies       []string `mapstructure:"policies" json:"policies,omitempty"`
+}
+
+// IdentityAlias is an entity alias, which ties an entity to an auth mount.
+type IdentityAlias struct {
+	ID             string            `mapstructure:"id" json:"id"`
+	Name           string            `mapstructure:"name" json:"name"`
+	MountAccessor  string            `mapstructure:"mount_accessor" json:"mount_accessor"`
+	Metadata       map[string]string `mapstructure:"metadata" json:"metadata,omitempty"`
+	CustomMetadata map[string]string `mapstructure:"custom_metadata" json:"custom_metadata,omitempty"`
+}
+
+// IdentityGroup is the subset of an identity/group/id/:id response that affects policy.
+type IdentityGroup struct {
+	ID       string            `mapstructure:"id" json:"id"`
+	Name     string            `mapstructure:"name" json:"name"`
+	Metadata map[string]string `mapstructure:"metadata" json:"metadata,omitempty"`
+	Policies []string          `mapstructure:"policies" json:"policies,omitempty"`
+	// Groups whose members include this group, and so grant it their policies.
+	ParentGroupIDs []string `mapstructure:"parent_group_ids" json:"parent_group_ids,omitempty"`
+}
+
+// IdentityContext is everything needed to render templated policy paths for an entity.
+type IdentityContext struct {
+	Entity IdentityEntity  `json:"entity"`
+	Groups []IdentityGroup `json:"groups,omitempty"`
+}
+
+// Reads an IdentityContext from a JSON file shaped like:
+//
+//	{"entity": {...identity/entity/id/:id data...}, "groups": [{...identity/group/id/:id data...}]}
+func ReadIdentityContextFile(path string) (*IdentityContext, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading identity context file: %w", err)
+	}
+	var identity IdentityContext
+	if err := json.Unmarshal(data, &identity); err != nil {
+		return nil, fmt.Errorf("error unmarshalling identity context file: %w", err)
+	}
+	return &identity, nil
+}
+
+// Looks up an entity and every group it belongs to.
+func LookupIdentityContext(ctx context.Context, client *vault.Client, entityID string) (*IdentityContext, error) {
+	if client == nil {
+		return nil, ErrVaultClientRequired
+	}
+	var identity IdentityContext
+	if err := readIdentityThing(ctx, client, "identity/entity/id/"+entityID, &identity.Entity); err != nil {
+		return nil, err
+	}
+	for _, groupID := range identity.Entity.GroupIDs {
+		var group IdentityGroup
+		if err := readIdentityThing(ctx, client, "identity/group/id/"+groupID, &group); err != nil {
+			return nil, err
+		}
+		identity.Groups = append(identity.Groups, group)
+	}
+	return &identity, nil
+}
+
+func readIdentityThing(ctx context.Context, client *vault.Client, path string, thing any) error {
+	s, err := client.Logical().ReadWithContext(ctx, path)
+	if err != nil {
+		return fmt.Errorf("error reading %s: %w", path, err)
+	}
+	if s == nil || s.Data == nil {
+		return fmt.Errorf("%s not found", path)
+	}
+	if err := mapstructure.Decode(s.Data, thing); err != nil {
+		return fmt.Errorf("error decoding %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,295 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/hclsyntax"
+)
+
+// LintRule is a check for a common mistake in policies or a gitops directory.
+type LintRule struct {
+	// Stable identifier like "HVR001", for baselines and documentation.
+	ID string `json:"id"`
+	// Short name like "duplicate-path".
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+var (
+	LintInvalidPolicy      = LintRule{"HVR000", "invalid-policy", "the policy can't be parsed"}
+	LintDuplicatePath      = LintRule{"HVR001", "duplicate-path", "a path is declared more than once in a policy, and Vault merges the declarations"}
+	LintUnreachablePath    = LintRule{"HVR002", "unreachable-path", "a path has empty, `.`, or `..` segments, `?` or `#`, surrounding whitespace, or an invalid identity template, so no request can match it"}
+	LintGlobNotAtEnd       = LintRule{"HVR003", "glob-not-at-end", "`*` is only a glob at the end of a path, anywhere else it only matches a literal `*`"}
+	LintListWithoutSegment = LintRule{"HVR004", "list-without-trailing-segment", "`list` on a path ending in `+`, which can't match LIST requests for the directories `+` stands for because they end in `/`"}
+	LintGrantsEverything   = LintRule{"HVR005", "grants-everything", "`*` with every capability, which is as good as the root policy"}
+	LintUnknownCapability  = LintRule{"HVR006", "unknown-capability", "a capability Vault doesn't know, which grants nothing"}
+	LintDenyWithOthers     = LintRule{"HVR007", "deny-with-capabilities", "capabilities alongside `deny`, which have no effect"}
+	LintDanglingReference  = LintRule{"HVR008", "dangling-policy-reference", "a principal references a policy that doesn't exist"}
+	LintUnreferencedPolicy = LintRule{"HVR009", "unreferenced-policy", "no principal references a policy"}
+)
+
+// LintRules are every rule that Lint* functions report, by ID.
+var LintRules = []LintRule{
+	LintInvalidPolicy,
+	LintDuplicatePath,
+	LintUnreachablePath,
+	LintGlobNotAtEnd,
+	LintListWithoutSegment,
+	LintGrantsEverything,
+	LintUnknownCapability,
+	LintDenyWithOthers,
+	LintDanglingReference,
+	LintUnreferencedPolicy,
+}
+
+// LintFinding is a violation of a LintRule.
+type LintFinding struct {
+	Rule string `json:"rule"`
+	Name string `json:"name"`
+	// Slash-separated path of the file.
+	File string `json:"file"`
+	// 1-based, or 0 when the finding is about the whole file.
+	Line   int `json:"line,omitempty"`
+	Column int `json:"column,omitempty"`
+	// What the finding is about within the file, like a policy path or capability. Baselines match on this
+	// instead of the line, which changes whenever something above it does.
+	Subject string `json:"subject,omitempty"`
+	Message string `json:"message"`
+}
+
+// NewLintFinding creates a finding for a rule.
+func NewLintFinding(rule LintRule, file, subject, message string) LintFinding {
+	return LintFinding{
+		Rule:    rule.ID,
+		Name:    rule.Name,
+		File:    file,
+		Subject: subject,
+		Message: message,
+	}
+}
+
+func (f LintFinding) at(r hcl.Range) LintFinding {
+	f.Line, f.Column = r.Start.Line, r.Start.Column
+	return f
+}
+
+// e.g. "sys/policies/acl/devs:3:1: HVR001 duplicate-path: ..."
+func (f LintFinding) String() string {
+	location := f.File
+	if f.Line > 0 {
+		location = fmt.Sprintf("%s:%d:%d", f.File, f.Line, f.Column)
+	}
+	return fmt.Sprintf("%s: %s %s: %s", location, f.Rule, f.Name, f.Message)
+}
+
+// SortLintFindings sorts findings by file, then location, then rule.
+func SortLintFindings(findings []LintFinding) {
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		if a.Column != b.Column {
+			return a.Column < b.Column
+		}
+		return a.Rule < b.Rule
+	})
+}
+
+// Capabilities Vault accepts in a policy.
+var knownCapabilities = append(slices.Clone(grantingCapabilities), Deny)
+
+// LintPolicy checks a policy document for common mistakes. file is used for the locations of findings, and its base
+// name is the name of the policy.
+func LintPolicy(policyData, file string) []LintFinding {
+	policy, err := ParsePolicy(policyData, path.Base(file))
+	if err != nil {
+		return []LintFinding{NewLintFinding(LintInvalidPolicy, file, "", err.Error())}
+	}
+	var (
+		findings []LintFinding
+		// path -> declarations, in document order
+		declarations = map[string][]PathConfig{}
+	)
+	for _, pc := range policy.Paths {
+		declarations[pc.Path] = append(declarations[pc.Path], pc)
+	}
+	for _, pcs := range declarations {
+		sort.SliceStable(pcs, func(i, j int) bool {
+			return pathRange(pcs[i]).Start.Byte < pathRange(pcs[j]).Start.Byte
+		})
+		first := pathRange(pcs[0]).Start.Line
+		for _, pc := range pcs[1:] {
+			findings = append(findings, NewLintFinding(LintDuplicatePath, file, pc.Path,
+				fmt.Sprintf("path %q is already declared on line %d", pc.Path, first)).at(pathRange(pc)))
+		}
+	}
+	for _, pc := range policy.Paths {
+		findings = append(findings, lintPathConfig(pc, file)...)
+	}
+	SortLintFindings(findings)
+	return findings
+}
+
+func lintPathConfig(pc PathConfig, file string) []LintFinding {
+	var (
+		findings []LintFinding
+		where    = pathRange(pc)
+		add      = func(rule LintRule, subject, message string, r hcl.Range) {
+			findings = append(findings, NewLintFinding(rule, file, subject, message).at(r))
+		}
+	)
+	if reason := unreachableReason(pc.Path); reason != "" {
+		add(LintUnreachablePath, pc.Path, fmt.Sprintf("path %q can never match a request: %s", pc.Path, reason), where)
+	}
+	if index := strings.Index(pc.Path, "*"); index >= 0 && index < len(pc.Path)-1 {
+		add(LintGlobNotAtEnd, pc.Path, fmt.Sprintf("path %q has `*` before the end, where it only matches a literal `*`", pc.Path), where)
+	}
+	if slices.Contains(pc.Capabilities, List) && (pc.Path == "+" || strings.HasSuffix(pc.Path, "/+")) {
+		add(LintListWithoutSegment, pc.Path,
+			fmt.Sprintf("`list` on path %q only lists %q, use %q to list what `+` matches", pc.Path, strings.TrimSuffix(pc.Path, "+"), pc.Path+"/"),
+			capabilitiesRange(pc))
+	}
+	if pc.Path == "*" && !slices.ContainsFunc([]Capability{Create, Read, Update, Delete, List, Sudo}, func(c Capability) bool {
+		return !slices.Contains(pc.Capabilities, c)
+	}) {
+		add(LintGrantsEverything, pc.Path, "path \"*\" grants every capability on everything", where)
+	}
+	for _, capability := range pc.Capabilities {
+		if !slices.Contains(knownCapabilities, capability) {
+			add(LintUnknownCapability, pc.Path+" "+string(capability),
+				fmt.Sprintf("path %q has unknown capability %q", pc.Path, capability), capabilitiesRange(pc))
+		}
+	}
+	if slices.Contains(pc.Capabilities, Deny) && len(pc.Capabilities) > 1 {
+		add(LintDenyWithOthers, pc.Path, fmt.Sprintf("path %q denies, so its other capabilities have no effect", pc.Path), capabilitiesRange(pc))
+	}
+	return findings
+}
+
+// Why no request path can match a policy path, or "" if one can.
+//
+// Vault cleans request paths before authorizing them, so they never have empty or dot segments.
+func unreachableReason(policyPath string) string {
+	if strings.TrimSpace(policyPath) != policyPath {
+		return "it starts or ends with whitespace"
+	}
+	if err := validateTemplates(policyPath); err != nil {
+		return "Vault can't render its identity template"
+	}
+	if strings.ContainsAny(policyPath, "?#") {
+		return "request paths can't contain `?` or `#`"
+	}
+	// a trailing slash or glob is fine, e.g. "secret/" or "secret/*"
+	segments := strings.Split(strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(policyPath, "/"), "*"), "/"), "/")
+	for _, segment := range segments {
+		switch {
+		case segment == "." || segment == "..":
+			return fmt.Sprintf("request paths don't have %q segments", segment)
+		case segment == "" && len(segments) > 1:
+			return "request paths don't have empty segments"
+		}
+	}
+	return ""
+}
+
+// Where a path block is declared, or an empty range if it wasn't parsed from native HCL syntax.
+func pathRange(pc PathConfig) hcl.Range {
+	// the rest of the block body after the decoded capabilities, which starts at its opening brace
+	if body, ok := pc.Other.(*hclsyntax.Body); ok {
+		return body.SrcRange
+	}
+	return hcl.Range{}
+}
+
+// Where the capabilities of a path block are declared, falling back to the block.
+func capabilitiesRange(pc PathConfig) hcl.Range {
+	if body, ok := pc.Other.(*hclsyntax.Body); ok {
+		if attr, exists := body.Attributes["capabilities"]; exists {
+			return attr.SrcRange
+		}
+	}
+	return pathRange(pc)
+}
+
+// LintBaseline is a set of accepted findings that linting shouldn't report again.
+type LintBaseline struct {
+	Findings []LintBaselineEntry `json:"findings"`
+}
+
+// LintBaselineEntry identifies a finding without its line, so it stays suppressed when the file is edited around it.
+type LintBaselineEntry struct {
+	Rule    string `json:"rule"`
+	File    string `json:"file"`
+	Subject string `json:"subject,omitempty"`
+}
+
+func baselineEntry(f LintFinding) LintBaselineEntry {
+	return LintBaselineEntry{Rule: f.Rule, File: f.File, Subject: f.Subject}
+}
+
+// NewLintBaseline accepts every finding.
+func NewLintBaseline(findings []LintFinding) *LintBaseline {
+	baseline := &LintBaseline{Findings: []LintBaselineEntry{}}
+	seen := map[LintBaselineEntry]bool{}
+	for _, finding := range findings {
+		if entry := baselineEntry(finding); !seen[entry] {
+			seen[entry] = true
+			baseline.Findings = append(baseline.Findings, entry)
+		}
+	}
+	return baseline
+}
+
+// ReadLintBaseline reads a baseline written by WriteLintBaseline.
+func ReadLintBaseline(filename string) (*LintBaseline, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading lint baseline: %w", err)
+	}
+	var baseline LintBaseline
+	if err := json.Unmarshal(content, &baseline); err != nil {
+		return nil, fmt.Errorf("error unmarshalling lint baseline %s: %w", filename, err)
+	}
+	return &baseline, nil
+}
+
+// WriteLintBaseline writes a baseline as indented JSON so it reviews well.
+func WriteLintBaseline(filename string, baseline *LintBaseline) error {
+	content, err := json.MarshalIndent(baseline, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filename, append(content, '\n'), 0o644); err != nil {
+		return fmt.Errorf("error writing lint baseline: %w", err)
+	}
+	return nil
+}
+
+// Filter returns the findings that aren't in the baseline. A nil baseline accepts nothing.
+func (b *LintBaseline) Filter(findings []LintFinding) []LintFinding {
+	if b == nil {
+		return findings
+	}
+	accepted := map[LintBaselineEntry]bool{}
+	for _, entry := range b.Findings {
+		accepted[entry] = true
+	}
+	var remaining []LintFinding
+	for _, finding := range findings {
+		if !accepted[baselineEntry(finding)] {
+			remaining = append(remaining, finding)
+		}
+	}
+	return remaining
+}
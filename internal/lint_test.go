@@ -0,0 +1,106 @@
+package internal_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/threatkey-oss/hvresult/internal"
+)
+
+func TestLintPolicy(t *testing.T) {
+	const policy = `path "secret/*" {
+  capabilities = ["read"]
+}
+
+path "secret/*" {
+  capabilities = ["list"]
+}
+
+path "secret/*/config" {
+  capabilities = ["read", "wirte"]
+}
+
+path "kv/metadata/+" {
+  capabilities = ["list"]
+}
+
+path "secret//x" {
+  capabilities = ["deny", "read"]
+}
+
+path "*" {
+  capabilities = ["create", "read", "update", "delete", "list", "sudo"]
+}
+
+path "kv/metadata/+/" {
+  capabilities = ["list"]
+}
+
+path "secret/{{identity.entity.nope}}" {
+  capabilities = ["read"]
+}
+`
+	type finding struct {
+		Rule    string
+		Line    int
+		Subject string
+	}
+	var got []finding
+	for _, f := range internal.LintPolicy(policy, "sys/policies/acl/devs") {
+		if f.File != "sys/policies/acl/devs" {
+			t.Fatalf("unexpected file: %+v", f)
+		}
+		got = append(got, finding{f.Rule, f.Line, f.Subject})
+	}
+	if diff := cmp.Diff([]finding{
+		{"HVR001", 5, "secret/*"},
+		{"HVR003", 9, "secret/*/config"},
+		{"HVR006", 10, "secret/*/config wirte"},
+		{"HVR004", 14, "kv/metadata/+"},
+		{"HVR002", 17, "secret//x"},
+		{"HVR007", 18, "secret//x"},
+		{"HVR005", 21, "*"},
+		{"HVR002", 29, "secret/{{identity.entity.nope}}"},
+	}, got); diff != "" {
+		t.Fatal(diff)
+	}
+
+	invalid := internal.LintPolicy(`path "secret/*" {`, "broken")
+	if len(invalid) != 1 || invalid[0].Rule != internal.LintInvalidPolicy.ID {
+		t.Fatalf("expected only an invalid policy finding, got %+v", invalid)
+	}
+}
+
+func TestLintBaseline(t *testing.T) {
+	findings := internal.LintPolicy(`
+path "secret/*/config" {
+  capabilities = ["read"]
+}
+`, "devs")
+	if len(findings) != 1 {
+		t.Fatalf("expected 1 finding, got %+v", findings)
+	}
+	filename := filepath.Join(t.TempDir(), "baseline.json")
+	if err := internal.WriteLintBaseline(filename, internal.NewLintBaseline(findings)); err != nil {
+		t.Fatal(err)
+	}
+	baseline, err := internal.ReadLintBaseline(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// moving the accepted stanza doesn't matter, but a new one does
+	findings = internal.LintPolicy(`
+path "other/*/config" {
+  capabilities = ["read"]
+}
+
+path "secret/*/config" {
+  capabilities = ["read"]
+}
+`, "devs")
+	remaining := baseline.Filter(findings)
+	if len(remaining) != 1 || remaining[0].Subject != "other/*/config" {
+		t.Fatalf("expected only the new finding, got %+v", remaining)
+	}
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"sort"
+	"strings"
+)
+
+// PathMatch is the path stanza that Vault would use to authorize a request.
+type PathMatch struct {
+	// The path as written in the policies, e.g. "secret/+/foo/*".
+	Path string
+	// The merged stanza. If its capabilities include Deny, it's the only key.
+	*RSoPPath
+}
+
+// Whether the matched stanza grants a capability, taking deny into account.
+func (m *PathMatch) Allows(cap Capability) bool {
+	if m == nil || m.Denied() {
+		return false
+	}
+	return len(m.Capabilities[cap]) > 0
+}
+
+// Whether the matched stanza is a deny.
+func (m *PathMatch) Denied() bool {
+	return m != nil && len(m.Capabilities[Deny]) > 0
+}
+
+// Match finds the stanza with the highest priority for a concrete request path, or nil if nothing matches.
+//
+// This follows the ACL lookup in Vault: exact paths win outright, otherwise every glob (`*`) and
+// segment wildcard (`+`) path that matches is ranked by the priority rules at
+// https://developer.hashicorp.com/vault/docs/concepts/policies#priority-matching
+func (r RSoPCapMap) Match(requestPath string) *PathMatch {
+	requestPath = strings.TrimPrefix(requestPath, "/")
+	if entry, exists := r[requestPath]; exists && !isGlobPath(requestPath) {
+		return &PathMatch{Path: requestPath, RSoPPath: entry}
+	}
+	return r.matchNonExact(requestPath)
+}
+
+// MatchOperation is like Match but accounts for the capability being exercised.
+//
+// Vault lets a LIST request with a trailing slash use an exact stanza without one.
+func (r RSoPCapMap) MatchOperation(requestPath string, cap Capability) *PathMatch {
+	requestPath = strings.TrimPrefix(requestPath, "/")
+	if entry, exists := r[requestPath]; exists && !isGlobPath(requestPath) {
+		return &PathMatch{Path: requestPath, RSoPPath: entry}
+	}
+	if cap == List {
+		trimmed := strings.TrimSuffix(requestPath, "/")
+		if entry, exists := r[trimmed]; exists && !isGlobPath(trimmed) {
+			return &PathMatch{Path: trimmed, RSoPPath: entry}
+		}
+	}
+	return r.matchNonExact(requestPath)
+}
+
+// a candidate glob or segment wildcard path, see Vault's wcPathDescr
+type wildcardCandidate struct {
+	path string
+	// path without a trailing glob
+	trimmed string
+	// index of the first `+` or `*`
+	firstWildcard int
+	isPrefix      bool
+	wildcards     int
+}
+
+// Whether c has lower priority than other.
+func (c wildcardCandidate) less(other wildcardCandidate) bool {
+	if c.firstWildcard != other.firstWildcard {
+		return c.firstWildcard < other.firstWildcard
+	}
+	if c.isPrefix != other.isPrefix {
+		return c.isPrefix
+	}
+	if c.wildcards != other.wildcards {
+		return c.wildcards > other.wildcards
+	}
+	if len(c.trimmed) != len(other.trimmed) {
+		return len(c.trimmed) < len(other.trimmed)
+	}
+	return c.trimmed < other.trimmed
+}
+
+func (r RSoPCapMap) matchNonExact(requestPath string) *PathMatch {
+	var (
+		candidates   []wildcardCandidate
+		longestGlob  *wildcardCandidate
+		requestParts = strings.Split(requestPath, "/")
+	)
+	for path := range r {
+		if !isGlobPath(path) {
+			continue
+		}
+		candidate := wildcardCandidate{
+			path:     path,
+			trimmed:  strings.TrimSuffix(path, "*"),
+			isPrefix: strings.HasSuffix(path, "*"),
+		}
+		// plain globs: only the longest matching prefix is considered
+		if !strings.Contains(path, "+") {
+			if !strings.HasPrefix(requestPath, candidate.trimmed) {
+				continue
+			}
+			candidate.firstWildcard = len(candidate.trimmed)
+			if longestGlob == nil || len(candidate.trimmed) > len(longestGlob.trimmed) {
+				longestGlob = &candidate
+			}
+			continue
+		}
+		candidate.firstWildcard = strings.Index(path, "+")
+		if matchSegments(candidate, requestParts) {
+			candidate.wildcards = strings.Count(candidate.trimmed, "+")
+			candidates = append(candidates, candidate)
+		}
+	}
+	if longestGlob != nil {
+		candidates = append(candidates, *longestGlob)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].less(candidates[j])
+	})
+	winner := candidates[len(candidates)-1].path
+	return &PathMatch{Path: winner, RSoPPath: r[winner]}
+}
+
+// matches a path containing `+` segments against the split request path
+func matchSegments(candidate wildcardCandidate, requestParts []string) bool {
+	policyParts := strings.Split(candidate.trimmed, "/")
+	if !candidate.isPrefix && len(policyParts) != len(requestParts) {
+		return false
+	}
+	if candidate.isPrefix && len(policyParts) > len(requestParts) {
+		return false
+	}
+	for i, part := range policyParts {
+		switch {
+		case part == "+", part == requestParts[i]:
+			// ok
+		case candidate.isPrefix && i == len(policyParts)-1 && strings.HasPrefix(requestParts[i], part):
+			// ok
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Whether a policy path contains a glob or segment wildcard.
+func isGlobPath(path string) bool {
+	return strings.HasSuffix(path, "*") || strings.Contains(path, "+")
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	t.Parallel()
+	capmap := capsOnly(map[string]map[Capability][]string{
+		"secret/foo":          {Read: {"exact"}},
+		"secret/*":            {List: {"glob"}},
+		"secret/foo*":         {Update: {"longer-glob"}},
+		"secret/+/bar":        {Create: {"segment"}},
+		"secret/+/+/baz":      {Create: {"segments"}},
+		"secret/+/+/*":        {Delete: {"segments-glob"}},
+		"secret/denied/+":     {Deny: {"denier"}},
+		"listable/dir":        {List: {"exact-list"}},
+		"sys/policies/acl/+":  {Read: {"acl"}},
+		"sys/policies/acl/a*": {Read: {"acl-a"}},
+	})
+	for _, tc := range []struct {
+		request  string
+		op       Capability
+		expected string
+	}{
+		{"secret/foo", Read, "secret/foo"},
+		{"/secret/foo", Read, "secret/foo"},
+		{"secret/foobar", Read, "secret/foo*"},
+		{"secret/other", Read, "secret/*"},
+		// same first wildcard position, but the glob loses to the segment wildcard
+		{"secret/x/bar", Read, "secret/+/bar"},
+		// the first wildcard is later than the one in secret/*
+		{"secret/denied/thing", Read, "secret/denied/+"},
+		{"secret/x/y/baz", Read, "secret/+/+/baz"},
+		// both are prefixes starting at the same spot, so the one with fewer `+` wins
+		{"secret/x/y/z", Read, "secret/*"},
+		// later first wildcard wins
+		{"sys/policies/acl/abc", Read, "sys/policies/acl/a*"},
+		{"sys/policies/acl/xyz", Read, "sys/policies/acl/+"},
+		// list can use an exact match without the trailing slash
+		{"listable/dir/", List, "listable/dir"},
+		{"listable/dir/", Read, ""},
+		{"nothing/here", Read, ""},
+	} {
+		match := capmap.MatchOperation(tc.request, tc.op)
+		switch {
+		case match == nil && tc.expected != "":
+			t.Errorf("%s (%s): expected %q, got no match", tc.request, tc.op, tc.expected)
+		case match != nil && match.Path != tc.expected:
+			t.Errorf("%s (%s): expected %q, got %q", tc.request, tc.op, tc.expected, match.Path)
+		}
+	}
+	t.Run("Deny", func(t *testing.T) {
+		t.Parallel()
+		match := capmap.Match("secret/denied/thing")
+		if !match.Denied() || match.Allows(Read) {
+			t.Fatalf("expected deny, got %+v", match)
+		}
+		if !capmap.Match("secret/foo").Allows(Read) {
+			t.Fatal("expected read on secret/foo")
+		}
+		var none *PathMatch
+		if none.Allows(Read) {
+			t.Fatal("nil match should not allow anything")
+		}
+	})
+}
+
+func TestPathsOverlap(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		a, b     string
+		expected bool
+	}{
+		// exact
+		{"sys/raw", "sys/raw", true},
+		{"sys/raw", "sys/rawr", false},
+		// glob against exact
+		{"sys/*", "sys/raw", true},
+		{"sys/ra*", "sys/raw/x", true},
+		{"sys/raw/*", "sys/raw", false},
+		// glob against glob
+		{"*", "secret/*", true},
+		{"auth/gcp/*", "auth/*", true},
+		{"auth/gcp/*", "auth/github/*", false},
+		{"secret/fo*", "secret/f*", true},
+		// `+` against exact
+		{"sys/+", "sys/raw", true},
+		{"sys/+", "sys/raw/x", false},
+		{"secret/+", "secret/", true},
+		// `+` against glob
+		{"auth/+/role/*", "auth/gcp/*", true},
+		{"auth/+/role/*", "auth/gcp/+/*", true},
+		{"auth/+/role/*", "auth/gcp/roles/*", false},
+		{"auth/+/role/*", "auth/g*", true},
+		{"sys/+", "sys/policies/acl/*", false},
+		{"+/raw", "sys/*", true},
+		{"secret/fo*", "secret/+", true},
+		// `+` against `+`
+		{"auth/+/role/+", "auth/gcp/+/app", true},
+		{"auth/+/role/+", "auth/+/login", false},
+	} {
+		if got := pathsOverlap(tc.a, tc.b); got != tc.expected {
+			t.Errorf("pathsOverlap(%q, %q) = %v, expected %v", tc.a, tc.b, got, tc.expected)
+		}
+		if got := pathsOverlap(tc.b, tc.a); got != tc.expected {
+			t.Errorf("pathsOverlap(%q, %q) = %v, expected %v", tc.b, tc.a, got, tc.expected)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	vault "github.com/hashicorp/vault/api"
+	"github.com/mitchellh/mapstructure"
+)
+
+// The ID Vault gives the root namespace.
+const RootNamespaceID = "root"
+
+// Namespace is a Vault Enterprise namespace.
+type Namespace struct {
+	ID string
+	// Relative to the namespace of the client that listed it, with a trailing slash, e.g. "eng/team/".
+	Path string
+}
+
+// NormalizeNamespace formats a namespace path like "/eng/team" as "eng/team/", and the root namespace as "".
+func NormalizeNamespace(namespace string) string {
+	namespace = strings.Trim(namespace, "/")
+	if namespace == "" {
+		return ""
+	}
+	return namespace + "/"
+}
+
+// SplitQualifiedName splits a policy name like "eng/team/reader" into its namespace and name.
+//
+// Vault doesn't allow slashes in policy names, so everything up to the last slash is the namespace.
+func SplitQualifiedName(qualified string) (namespace, name string) {
+	i := strings.LastIndex(qualified, "/")
+	if i < 0 {
+		return "", qualified
+	}
+	return NormalizeNamespace(qualified[:i]), qualified[i+1:]
+}
+
+// NamespacedClient returns a copy of client for a namespace relative to the namespace the client already uses.
+func NamespacedClient(client *vault.Client, namespace string) *vault.Client {
+	namespace = NormalizeNamespace(namespace)
+	if namespace == "" {
+		return client
+	}
+	return client.WithNamespace(NormalizeNamespace(client.Namespace()) + namespace)
+}
+
+type namespaceListData struct {
+	Keys    []string `mapstructure:"keys"`
+	KeyInfo map[string]struct {
+		ID string `mapstructure:"id"`
+	} `mapstructure:"key_info"`
+}
+
+// ListNamespaces walks sys/namespaces recursively below the namespace the client uses.
+//
+// Outside of Vault Enterprise there are no namespaces, so this returns nothing.
+func ListNamespaces(ctx context.Context, client *vault.Client) ([]Namespace, error) {
+	if client == nil {
+		return nil, ErrVaultClientRequired
+	}
+	return listNamespaces(ctx, client, "")
+}
+
+func listNamespaces(ctx context.Context, client *vault.Client, parent string) ([]Namespace, error) {
+	s, err := NamespacedClient(client, parent).Logical().ListWithContext(ctx, "sys/namespaces")
+	if err != nil {
+		return nil, fmt.Errorf("error listing namespaces in '%s': %w", parent, err)
+	}
+	if s == nil || s.Data == nil {
+		return nil, nil
+	}
+	var data namespaceListData
+	if err := mapstructure.Decode(s.Data, &data); err != nil {
+		return nil, fmt.Errorf("error decoding namespace list: %w", err)
+	}
+	var namespaces []Namespace
+	for _, key := range data.Keys {
+		namespace := Namespace{
+			ID:   data.KeyInfo[key].ID,
+			Path: parent + NormalizeNamespace(key),
+		}
+		children, err := listNamespaces(ctx, client, namespace.Path)
+		if err != nil {
+			return nil, err
+		}
+		namespaces = append(append(namespaces, namespace), children...)
+	}
+	return namespaces, nil
+}
@@ -0,0 +1,59 @@
+package internal_test
+
+import (
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal"
+)
+
+func TestNamespaces(t *testing.T) {
+	t.Parallel()
+	for input, expected := range map[string]string{
+		"":          "",
+		"/":         "",
+		"eng":       "eng/",
+		"/eng/team": "eng/team/",
+		"eng/team/": "eng/team/",
+	} {
+		if got := internal.NormalizeNamespace(input); got != expected {
+			t.Errorf("NormalizeNamespace(%q): expected %q, got %q", input, expected, got)
+		}
+	}
+	for input, expected := range map[string][2]string{
+		"reader":          {"", "reader"},
+		"eng/reader":      {"eng/", "reader"},
+		"eng/team/reader": {"eng/team/", "reader"},
+	} {
+		if namespace, name := internal.SplitQualifiedName(input); namespace != expected[0] || name != expected[1] {
+			t.Errorf("SplitQualifiedName(%q): expected %q, got %q %q", input, expected, namespace, name)
+		}
+	}
+	// the same policy name in different namespaces shouldn't collide, and paths are relative to the namespace
+	rsop := &internal.RSoP{Policies: []*internal.Policy{
+		{Name: "default", Paths: []internal.PathConfig{{Path: "secret/*", Capabilities: []internal.Capability{internal.Read}}}},
+		{Name: "default", Namespace: "eng/", Paths: []internal.PathConfig{
+			{Path: "secret/*", Capabilities: []internal.Capability{internal.List}},
+			{Path: "team/secret/*", Capabilities: []internal.Capability{internal.Update}},
+		}},
+		{Name: internal.RootPolicyName, Namespace: "eng/"},
+	}}
+	capmap := rsop.GetCapabilityMap()
+	for path, expected := range map[string]map[internal.Capability][]string{
+		"secret/*":          {internal.Read: {"default"}},
+		"eng/secret/*":      {internal.List: {"eng/default"}},
+		"eng/team/secret/*": {internal.Update: {"eng/default"}},
+	} {
+		entry := capmap[path]
+		if entry == nil {
+			t.Fatalf("expected %q in %v", path, capmap)
+		}
+		for cap, policies := range expected {
+			if got := entry.Capabilities[cap]; len(got) != 1 || got[0] != policies[0] {
+				t.Errorf("%s %s: expected %v, got %v", path, cap, policies, got)
+			}
+		}
+	}
+	if rsop.IsRoot() {
+		t.Error("a policy named root outside the root namespace isn't the root policy")
+	}
+}
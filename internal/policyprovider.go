@@ -4,13 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
-	"path/filepath"
 	"sort"
+	"strings"
 
-	"github.com/hashicorp/hcl/v2/hclsimple"
 	vault "github.com/hashicorp/vault/api"
 	"github.com/mitchellh/mapstructure"
+	"github.com/rs/zerolog/log"
 )
 
 var (
@@ -26,55 +25,89 @@ type PolicyProvider interface {
 
 // ReadthroughPolicyProvider is a readthrough cache of Vault policies.
 type ReadthroughPolicyProvider struct {
-	offlinePath string
-	client      *vault.Client
+	// nil disables caching
+	cache  *PolicyCache
+	client *vault.Client
 }
 
-// Reads a policy from Vault or the cache path.
+// Reads a policy from the cache or Vault.
+//
+// Names can be qualified by a namespace relative to the client's, e.g. "eng/team/reader".
+// Cached policies older than the cache TTL are revalidated against Vault, but still used if Vault can't be reached.
 func (p *ReadthroughPolicyProvider) GetPolicy(ctx context.Context, name string) (*Policy, error) {
-	if p.offlinePath != "" {
-		policy, err := p.getOfflinePolicy(name)
-		if err != nil || policy != nil {
-			return policy, err
+	namespace, shortName := SplitQualifiedName(name)
+	if policy := BuiltinPolicy(shortName); policy != nil && (namespace == "" || shortName != RootPolicyName) {
+		policy.Namespace = namespace
+		return policy, nil
+	}
+	var (
+		logger = log.With().Str("policy", name).Logger()
+		cached *policyCacheEntry
+	)
+	if p.cache != nil {
+		var err error
+		cached, err = p.cache.get(name)
+		switch {
+		case err != nil:
+			logger.Warn().Err(err).Msg("error reading cached policy, fetching from Vault")
+		case cached == nil:
+			logger.Debug().Msg("policy cache miss")
+		case p.cache.fresh(cached):
+			logger.Debug().Time("fetched", cached.FetchedAt).Msg("policy cache hit")
+			return parseNamespacedPolicy(cached.HCL, namespace, shortName)
+		case p.client == nil:
+			logger.Warn().Time("fetched", cached.FetchedAt).Msg("cached policy is stale and there's no Vault client to revalidate it, using it anyway")
+			return parseNamespacedPolicy(cached.HCL, namespace, shortName)
+		default:
+			logger.Debug().Time("fetched", cached.FetchedAt).Msg("cached policy is stale, revalidating")
 		}
 	}
 	if p.client == nil {
 		return nil, fmt.Errorf("no Vault client specified, policy not found")
 	}
-	policyData, err := p.client.Sys().GetPolicyWithContext(ctx, name)
+	policyData, err := NamespacedClient(p.client, namespace).Sys().GetPolicyWithContext(ctx, shortName)
 	if err != nil {
+		if cached != nil {
+			logger.Warn().Err(err).Time("fetched", cached.FetchedAt).Msg("error revalidating cached policy, using stale copy")
+			return parseNamespacedPolicy(cached.HCL, namespace, shortName)
+		}
 		return nil, fmt.Errorf("error reading policy from Vault: %w", err)
 	}
-	policy, err := ParsePolicy(policyData, name)
+	policy, err := parseNamespacedPolicy(policyData, namespace, shortName)
 	if err != nil {
 		return nil, err
 	}
-	if p.offlinePath != "" {
-		// TODO: good way to handle errors caching policies
-		_ = p.cachePolicy(name, policyData)
+	if p.cache != nil {
+		if cached != nil && cached.SHA256 != hashPolicy(policyData) {
+			logger.Info().Msg("cached policy changed in Vault, replacing it")
+		}
+		if err := p.cache.put(name, policyData); err != nil {
+			logger.Warn().Err(err).Msg("error caching policy")
+		}
 	}
 	return policy, nil
 }
 
-func (p *ReadthroughPolicyProvider) getOfflinePolicy(name string) (*Policy, error) {
-	data, err := os.ReadFile(filepath.Join(p.offlinePath, name))
+func parseNamespacedPolicy(policyData, namespace, name string) (*Policy, error) {
+	policy, err := ParsePolicy(policyData, name)
 	if err != nil {
-		return nil, fmt.Errorf("error reading cached policy: %w", err)
-	}
-	var policy *Policy
-	if err = hclsimple.Decode(name, data, nil, &policy); err != nil {
-		return nil, fmt.Errorf("error decoding cached policy: %w", err)
+		return nil, err
 	}
+	policy.Namespace = namespace
 	return policy, nil
 }
 
-func (p *ReadthroughPolicyProvider) cachePolicy(name, data string) error {
-	return os.WriteFile(filepath.Join(p.offlinePath, name), []byte(data), 0o640)
-}
-
 type logicalPolicyData struct {
-	Policies      []string `mapstructure:"policies"`
-	TokenPolicies []string `mapstructure:"token_policies"`
+	Policies         []string `mapstructure:"policies"`
+	TokenPolicies    []string `mapstructure:"token_policies"`
+	IdentityPolicies []string `mapstructure:"identity_policies"`
+	EntityID         string   `mapstructure:"entity_id"`
+	// Only present on tokens, relative to the root namespace.
+	NamespacePath string `mapstructure:"namespace_path"`
+	// Namespace ID -> policies granted by groups in other namespaces. Only present on tokens.
+	ExternalNamespacePolicies map[string][]string `mapstructure:"external_namespace_policies"`
+	// Only present on roles.
+	TokenNoDefaultPolicy bool `mapstructure:"token_no_default_policy"`
 }
 
 func (p *ReadthroughPolicyProvider) GetRSoP(ctx context.Context, authThing string) (*RSoP, error) {
@@ -85,17 +118,23 @@ func (p *ReadthroughPolicyProvider) GetRSoP(ctx context.Context, authThing strin
 	if err != nil {
 		return nil, err
 	}
-	var policyNames []string
+	sources := make(policySources)
 	switch ak {
-	case Token:
+	case Token, TokenAccessor:
 		var s *vault.Secret
-		// if this happens to be our own token, then lookup self
-		if authThing == p.client.Token() {
+		switch {
+		case ak == TokenAccessor:
+			s, err = p.client.Auth().Token().LookupAccessorWithContext(ctx, authThing)
+			if err != nil {
+				return nil, fmt.Errorf("error looking up token accessor: %w", err)
+			}
+		case authThing == p.client.Token():
+			// if this happens to be our own token, then lookup self
 			s, err = p.client.Auth().Token().LookupSelfWithContext(ctx)
 			if err != nil {
 				return nil, fmt.Errorf("error looking up self: %w", err)
 			}
-		} else {
+		default:
 			// errors out without sudo/root
 			s, err = p.client.Auth().Token().LookupWithContext(ctx, authThing)
 			if err != nil {
@@ -106,49 +145,163 @@ func (p *ReadthroughPolicyProvider) GetRSoP(ctx context.Context, authThing strin
 		if err := mapstructure.Decode(s.Data, &data); err != nil {
 			return nil, fmt.Errorf("error decoding token lookup data: %w", err)
 		}
-		policyNames = data.Policies
-	case TokenAccessor:
-		s, err := p.client.Auth().Token().LookupAccessorWithContext(ctx, authThing)
-		if err != nil {
-			return nil, fmt.Errorf("error looking up token accessor: %w", err)
-		}
-		policyNames = s.Auth.Policies
-	case RolePathMaybe:
-		s, err := p.client.Logical().ReadWithContext(ctx, authThing)
-		if err != nil {
-			return nil, fmt.Errorf("error reading guessed role path: %w", err)
+		// policies and identity live in the namespace the token was created in
+		namespace := NormalizeNamespace(strings.TrimPrefix(NormalizeNamespace(data.NamespacePath), NormalizeNamespace(p.client.Namespace())))
+		sources.add(PolicySource{Kind: SourceToken}, qualify(namespace, data.Policies)...)
+		if data.EntityID != "" {
+			if err := p.addEntitySources(ctx, sources, namespace, "identity/entity/id/"+data.EntityID); err != nil {
+				// the token's own view of identity policies is better than nothing
+				log.Warn().Err(err).Str("entity", data.EntityID).Msg("error walking token entity, using identity_policies without their origin")
+				sources.add(PolicySource{Kind: SourceEntity, Via: []string{data.EntityID}}, qualify(namespace, data.IdentityPolicies)...)
+			}
 		}
-		if s.Data == nil || s.Data["token_policies"] == nil {
-			return nil, fmt.Errorf(".data.token_policies not present in guessed role path")
+		if err := p.addExternalNamespaceSources(ctx, sources, data.ExternalNamespacePolicies); err != nil {
+			return nil, err
 		}
-		var data logicalPolicyData
-		if err := mapstructure.Decode(s.Data, &data); err != nil {
-			return nil, fmt.Errorf("error decoding guessed role path data: %w", err)
+	case RolePathMaybe:
+		switch {
+		case strings.HasPrefix(authThing, "identity/entity/"):
+			if err := p.addEntitySources(ctx, sources, "", authThing); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(authThing, "identity/group/"):
+			if err := p.addGroupSources(ctx, sources, "", authThing, nil, map[string]bool{}); err != nil {
+				return nil, err
+			}
+		default:
+			s, err := p.client.Logical().ReadWithContext(ctx, authThing)
+			if err != nil {
+				return nil, fmt.Errorf("error reading guessed role path: %w", err)
+			}
+			if s == nil || !IsRole(s.Data) {
+				return nil, fmt.Errorf(".data.token_policies not present in guessed role path")
+			}
+			var data logicalPolicyData
+			if err := mapstructure.Decode(s.Data, &data); err != nil {
+				return nil, fmt.Errorf("error decoding guessed role path data: %w", err)
+			}
+			sources.add(PolicySource{Kind: SourceRole}, data.TokenPolicies...)
+			// tokens already list default in their policies, but roles don't
+			if AttachesDefaultPolicy(data.TokenPolicies, data.TokenNoDefaultPolicy) {
+				sources.add(PolicySource{Kind: SourceImplicit}, DefaultPolicyName)
+			}
 		}
-		policyNames = data.TokenPolicies
 	default:
 		return nil, fmt.Errorf("unhandled AuthKind: %s (%d)", ak.String(), ak)
 	}
-	policies := make([]*Policy, len(policyNames))
-	for i, name := range policyNames {
-		policies[i], err = p.GetPolicy(ctx, name)
+	policies := make([]*Policy, 0, len(sources))
+	for name, policySources := range sources {
+		policy, err := p.GetPolicy(ctx, name)
 		if err != nil {
 			return nil, fmt.Errorf("error getting policy '%s': %w", name, err)
 		}
-		policies[i].Name = name
+		policy.Namespace, policy.Name = SplitQualifiedName(name)
+		policy.Sources = policySources
+		policies = append(policies, policy)
 	}
 	// sort
 	sort.Slice(policies, func(i, j int) bool {
-		return policies[i].Name < policies[j].Name
+		return policies[i].QualifiedName() < policies[j].QualifiedName()
 	})
 	return &RSoP{Policies: policies}, nil
 }
 
+// Adds the policies of an entity and of every group it's a member of.
+func (p *ReadthroughPolicyProvider) addEntitySources(ctx context.Context, sources policySources, namespace, entityPath string) error {
+	var entity IdentityEntity
+	if err := readIdentityThing(ctx, NamespacedClient(p.client, namespace), entityPath, &entity); err != nil {
+		return err
+	}
+	sources.add(PolicySource{Kind: SourceEntity, Via: []string{entity.Name}}, qualify(namespace, entity.Policies)...)
+	visited := map[string]bool{}
+	for _, groupID := range entity.DirectGroupIDs {
+		if err := p.addGroupSources(ctx, sources, namespace, "identity/group/id/"+groupID, nil, visited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds the policies of a group and every parent group, which members inherit.
+func (p *ReadthroughPolicyProvider) addGroupSources(ctx context.Context, sources policySources, namespace, groupPath string, via []string, visited map[string]bool) error {
+	var group IdentityGroup
+	if err := readIdentityThing(ctx, NamespacedClient(p.client, namespace), groupPath, &group); err != nil {
+		return err
+	}
+	// groups can be cyclic and the same group can be reached multiple ways
+	if visited[group.ID] {
+		return nil
+	}
+	visited[group.ID] = true
+	via = append(append([]string{}, via...), group.Name)
+	sources.add(PolicySource{Kind: SourceGroup, Via: via}, qualify(namespace, group.Policies)...)
+	for _, parentID := range group.ParentGroupIDs {
+		if err := p.addGroupSources(ctx, sources, namespace, "identity/group/id/"+parentID, via, visited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds policies granted to an entity by groups in other namespaces, like a parent namespace.
+func (p *ReadthroughPolicyProvider) addExternalNamespaceSources(ctx context.Context, sources policySources, external map[string][]string) error {
+	if len(external) == 0 {
+		return nil
+	}
+	namespaces, err := ListNamespaces(ctx, p.client)
+	if err != nil {
+		return err
+	}
+	paths := map[string]string{}
+	if p.client.Namespace() == "" {
+		paths[RootNamespaceID] = ""
+	}
+	for _, namespace := range namespaces {
+		paths[namespace.ID] = namespace.Path
+	}
+	for id, policyNames := range external {
+		namespace, found := paths[id]
+		if !found {
+			log.Warn().Str("namespace", id).Strs("policies", policyNames).Msg("policies granted by a namespace outside of the client's namespace can't be read, skipping")
+			continue
+		}
+		via := namespace
+		if via == "" {
+			via = RootNamespaceID
+		}
+		sources.add(PolicySource{Kind: SourceNamespace, Via: []string{via}}, qualify(namespace, policyNames)...)
+	}
+	return nil
+}
+
+// Prefixes policy names with a namespace.
+func qualify(namespace string, policyNames []string) []string {
+	if namespace == "" {
+		return policyNames
+	}
+	qualified := make([]string, len(policyNames))
+	for i, name := range policyNames {
+		qualified[i] = namespace + name
+	}
+	return qualified
+}
+
+// policy name -> how it was reached
+type policySources map[string][]PolicySource
+
+func (s policySources) add(source PolicySource, policyNames ...string) {
+	for _, name := range policyNames {
+		s[name] = append(s[name], source)
+	}
+}
+
 // ReadthroughPolicyProvider is a readthrough cache of Vault policies.
-func NewReadthroughPolicyProvider(offlinePath string, client *vault.Client) (PolicyProvider, error) {
+//
+// Policies aren't cached if cache is nil.
+func NewReadthroughPolicyProvider(cache *PolicyCache, client *vault.Client) (PolicyProvider, error) {
 	pp := &ReadthroughPolicyProvider{
-		offlinePath: offlinePath,
-		client:      client,
+		cache:  cache,
+		client: client,
 	}
 	return pp, nil
 }
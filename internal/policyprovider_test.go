@@ -100,7 +100,7 @@ var (
 func TestProviderNoCache(t *testing.T) {
 	ctx := context.Background()
 	client := testcluster.NewTestCluster(t)
-	pp, err := internal.NewReadthroughPolicyProvider("", client)
+	pp, err := internal.NewReadthroughPolicyProvider(nil, client)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -129,6 +129,81 @@ func TestProviderNoCache(t *testing.T) {
 		}))
 		pp.GetRSoP(ctx, s.Auth.ClientToken)
 	})
+	// roles get the default policy unless told otherwise
+	t.Run("RoleDefault", func(t *testing.T) {
+		t.Parallel()
+		err := client.Sys().EnableAuthWithOptions("approle", &vault.EnableAuthOptions{Type: "approle"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Sys().PutPolicy("role-default", `path "role-default" { capabilities = ["read"] }`); err != nil {
+			t.Fatal(err)
+		}
+		for role, noDefault := range map[string]bool{"with-default": false, "without-default": true} {
+			_, err := client.Logical().Write("auth/approle/role/"+role, map[string]any{
+				"token_policies":          []string{"role-default"},
+				"token_no_default_policy": noDefault,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rsop, err := pp.GetRSoP(ctx, "auth/approle/role/"+role)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, policy := range rsop.Policies {
+				names = append(names, policy.Name)
+			}
+			expected := []string{"role-default"}
+			if !noDefault {
+				expected = []string{"default", "role-default"}
+			}
+			if diff := cmp.Diff(expected, names); diff != "" {
+				t.Fatal(diff)
+			}
+		}
+	})
+	// entity -> group -> parent group
+	t.Run("Identity", func(t *testing.T) {
+		t.Parallel()
+		mustSecret := mustT[*vault.Secret](t)
+		for _, name := range []string{"identity-entity", "identity-devs", "identity-eng"} {
+			if err := client.Sys().PutPolicy(name, `path "`+name+`" { capabilities = ["read"] }`); err != nil {
+				t.Fatal(err)
+			}
+		}
+		logical := client.Logical()
+		entity := mustSecret(logical.Write("identity/entity", map[string]any{
+			"name":     "alice",
+			"policies": []string{"identity-entity"},
+		}))
+		devs := mustSecret(logical.Write("identity/group", map[string]any{
+			"name":              "devs",
+			"policies":          []string{"identity-devs"},
+			"member_entity_ids": []string{entity.Data["id"].(string)},
+		}))
+		mustSecret(logical.Write("identity/group", map[string]any{
+			"name":             "eng",
+			"policies":         []string{"identity-eng"},
+			"member_group_ids": []string{devs.Data["id"].(string)},
+		}))
+		rsop, err := pp.GetRSoP(ctx, "identity/entity/name/alice")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sources := map[string][]internal.PolicySource{}
+		for _, policy := range rsop.Policies {
+			sources[policy.Name] = policy.Sources
+		}
+		if diff := cmp.Diff(map[string][]internal.PolicySource{
+			"identity-entity": {{Kind: internal.SourceEntity, Via: []string{"alice"}}},
+			"identity-devs":   {{Kind: internal.SourceGroup, Via: []string{"devs"}}},
+			"identity-eng":    {{Kind: internal.SourceGroup, Via: []string{"devs", "eng"}}},
+		}, sources); diff != "" {
+			t.Fatal(diff)
+		}
+	})
 }
 
 // calls t.Fatal() on error
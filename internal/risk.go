@@ -0,0 +1,264 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Severity is how risky a change to an RSoP is.
+type Severity int
+
+const (
+	SeverityNone Severity = iota
+	SeverityLow
+	SeverityMedium
+	SeverityHigh
+	SeverityCritical
+)
+
+var severityNames = []string{"none", "low", "medium", "high", "critical"}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+	return severityNames[s]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *Severity) UnmarshalText(text []byte) error {
+	parsed, err := ParseSeverity(string(text))
+	if err != nil {
+		return err
+	}
+	*s = parsed
+	return nil
+}
+
+// ParseSeverity parses a severity name like "high".
+func ParseSeverity(name string) (Severity, error) {
+	index := slices.Index(severityNames, strings.ToLower(strings.TrimSpace(name)))
+	if index < 0 {
+		return SeverityNone, fmt.Errorf("unknown severity '%s', expected one of %s", name, strings.Join(severityNames, ", "))
+	}
+	return Severity(index), nil
+}
+
+// RiskRule assigns a severity to the rows of an RSoPDifferential it matches.
+type RiskRule struct {
+	Severity Severity
+	// Why the change is risky, e.g. "sudo on sys/".
+	Reason string
+	// Rows for removals instead of additions.
+	Removed bool
+	// Rows for parameters, wrapping TTLs, MFA, and control groups instead of capabilities.
+	Constraint bool
+	// Rows for capabilities cancelled by deny.
+	Preempted bool
+	// Rows for one of these capabilities. Empty matches any.
+	Capabilities []Capability
+	// Rows for policy paths that could match the same request as this one, e.g. "sys/*" matches "*", "+/raw", and
+	// "sys/raw".
+	// Empty matches any path.
+	Path string
+	// Only rows for exactly Path.
+	Exact bool
+	// Only rows for policy paths that end in a bare `*` segment, like "secret/*", which grant a whole subtree.
+	Glob bool
+	// Only rows for policy paths that end in a `+` segment, like "sys/+", which grant every path at that level.
+	Wildcard bool
+}
+
+// Capabilities that let a token do something, as opposed to deny.
+var grantingCapabilities = []Capability{Create, Read, Update, Patch, Delete, List, Sudo, Subscribe}
+
+// Capabilities that change things.
+var writeCapabilities = []Capability{Create, Update, Patch, Delete, Sudo}
+
+// RiskRules are evaluated for every row and the highest severity wins.
+var RiskRules = []RiskRule{
+	{Severity: SeverityCritical, Reason: "grants everything", Path: "*", Exact: true, Capabilities: grantingCapabilities},
+	{Severity: SeverityCritical, Reason: "sudo on sys/", Path: "sys/*", Capabilities: []Capability{Sudo}},
+	{Severity: SeverityHigh, Reason: "can rewrite policies", Path: "sys/policies/acl/*", Capabilities: writeCapabilities},
+	{Severity: SeverityHigh, Reason: "can rewrite policies", Path: "sys/policy/*", Capabilities: writeCapabilities},
+	{Severity: SeverityHigh, Reason: "can change what auth roles grant", Path: "auth/+/role/*", Capabilities: writeCapabilities},
+	{Severity: SeverityHigh, Reason: "deny removed", Removed: true, Capabilities: []Capability{Deny}},
+	{Severity: SeverityMedium, Reason: "no longer cancelled by deny", Removed: true, Preempted: true},
+	{Severity: SeverityMedium, Reason: "glob grants a whole subtree", Glob: true, Capabilities: grantingCapabilities},
+	{Severity: SeverityMedium, Reason: "wildcard grants a whole level", Wildcard: true, Capabilities: grantingCapabilities},
+	{Severity: SeverityMedium, Reason: "constraint removed", Removed: true, Constraint: true},
+	{Severity: SeverityLow, Reason: "capability added", Capabilities: grantingCapabilities},
+}
+
+// A row of an RSoPDifferential as seen by risk rules.
+type riskRow struct {
+	path       string
+	removed    bool
+	constraint bool
+	preempted  bool
+	// empty for constraints
+	capability Capability
+}
+
+func (rule RiskRule) matches(row riskRow) bool {
+	switch {
+	case rule.Removed != row.removed, rule.Constraint != row.constraint, rule.Preempted != row.preempted:
+		return false
+	case len(rule.Capabilities) > 0 && !slices.Contains(rule.Capabilities, row.capability):
+		return false
+	case rule.Glob && !(row.path == "*" || strings.HasSuffix(row.path, "/*")):
+		return false
+	case rule.Wildcard && !(row.path == "+" || strings.HasSuffix(row.path, "/+")):
+		return false
+	case rule.Path == "":
+		return true
+	case rule.Exact:
+		return rule.Path == row.path
+	default:
+		return pathsOverlap(rule.Path, row.path)
+	}
+}
+
+// Returns the highest severity of the rules that match a row and why.
+func classifyRisk(row riskRow) (Severity, string) {
+	var (
+		severity = SeverityNone
+		reason   string
+	)
+	for _, rule := range RiskRules {
+		if rule.Severity > severity && rule.matches(row) {
+			severity, reason = rule.Severity, rule.Reason
+		}
+	}
+	return severity, reason
+}
+
+// Whether 2 policy paths could match the same request: a `+` segment unifies with any single segment on the other side,
+// and a trailing `*` matches any suffix of the other side, wildcards included.
+func pathsOverlap(a, b string) bool {
+	var (
+		pa, pb = parsePathPattern(a), parsePathPattern(b)
+		i, j   int
+	)
+	for {
+		switch {
+		case i == len(pa.tokens) && pa.glob, j == len(pb.tokens) && pb.glob:
+			return true
+		case i == len(pa.tokens):
+			return pb.matchesEmpty(j)
+		case j == len(pb.tokens):
+			return pa.matchesEmpty(i)
+		case pa.tokens[i].wildcard && pb.tokens[j].wildcard:
+			i, j = i+1, j+1
+		case pa.tokens[i].wildcard:
+			i, j = i+1, pb.segmentEnd(j)
+		case pb.tokens[j].wildcard:
+			i, j = pa.segmentEnd(i), j+1
+		case pa.tokens[i].char == pb.tokens[j].char:
+			i, j = i+1, j+1
+		default:
+			return false
+		}
+	}
+}
+
+// A policy path as a request path would be matched against it.
+type pathPattern struct {
+	tokens []pathToken
+	// ends in `*`, which matches any suffix
+	glob bool
+}
+
+// A single character, or a `+` segment, which matches any one segment.
+type pathToken struct {
+	char     byte
+	wildcard bool
+}
+
+func parsePathPattern(policyPath string) pathPattern {
+	pattern := pathPattern{glob: strings.HasSuffix(policyPath, "*")}
+	for i, segment := range strings.Split(strings.TrimSuffix(policyPath, "*"), "/") {
+		if i > 0 {
+			pattern.tokens = append(pattern.tokens, pathToken{char: '/'})
+		}
+		if segment == "+" {
+			pattern.tokens = append(pattern.tokens, pathToken{wildcard: true})
+			continue
+		}
+		for k := 0; k < len(segment); k++ {
+			pattern.tokens = append(pattern.tokens, pathToken{char: segment[k]})
+		}
+	}
+	return pattern
+}
+
+// The index of the `/` that ends the segment containing tokens[i], or len(tokens) if it's the last one.
+func (p pathPattern) segmentEnd(i int) int {
+	for i < len(p.tokens) && (p.tokens[i].wildcard || p.tokens[i].char != '/') {
+		i++
+	}
+	return i
+}
+
+// Whether tokens[i:] can match nothing, like Vault lets "secret/+" match "secret/".
+func (p pathPattern) matchesEmpty(i int) bool {
+	for _, token := range p.tokens[i:] {
+		if !token.wildcard {
+			return false
+		}
+	}
+	return true
+}
+
+// RiskyChange is a row of an RSoPDifferential with its severity.
+type RiskyChange struct {
+	Path    string `json:"path"`
+	Removed bool   `json:"removed"`
+	// The capability or constraint, like the Capability column of MarkdownTable.
+	What     string   `json:"what"`
+	Policies []string `json:"policies"`
+	Severity Severity `json:"severity"`
+	Reason   string   `json:"reason,omitempty"`
+}
+
+// Risks returns every row of the differential that has a severity, highest first.
+func (p *RSoPDifferential) Risks() []RiskyChange {
+	if p.Empty() {
+		return nil
+	}
+	var risks []RiskyChange
+	for _, path := range p.paths() {
+		for _, row := range changesetRows(path, p.Added[path], p.Removed[path]) {
+			if row.severity == SeverityNone {
+				continue
+			}
+			risks = append(risks, RiskyChange{
+				Path:     path,
+				Removed:  row.risk.removed,
+				What:     row.what,
+				Policies: row.policies,
+				Severity: row.severity,
+				Reason:   row.reason,
+			})
+		}
+	}
+	slices.SortStableFunc(risks, func(a, b RiskyChange) int {
+		return int(b.Severity - a.Severity)
+	})
+	return risks
+}
+
+// MaxSeverity returns the highest severity of any row of the differential.
+func (p *RSoPDifferential) MaxSeverity() Severity {
+	severity := SeverityNone
+	for _, risk := range p.Risks() {
+		severity = max(severity, risk.Severity)
+	}
+	return severity
+}
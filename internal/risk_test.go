@@ -0,0 +1,142 @@
+package internal_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/threatkey-oss/hvresult/internal"
+)
+
+func TestRisks(t *testing.T) {
+	capabilities := func(policy string, caps ...internal.Capability) *internal.RSoPPath {
+		path := &internal.RSoPPath{Capabilities: map[internal.Capability][]string{}}
+		for _, cap := range caps {
+			path.Capabilities[cap] = []string{policy}
+		}
+		return path
+	}
+	for _, test := range []struct {
+		name     string
+		diff     *internal.RSoPDifferential
+		severity internal.Severity
+		reason   string
+	}{
+		{
+			name:     "SudoOnSys",
+			diff:     &internal.RSoPDifferential{Added: internal.RSoPCapMap{"sys/raw": capabilities("ops", internal.Sudo)}},
+			severity: internal.SeverityCritical,
+			reason:   "sudo on sys/",
+		},
+		{
+			name:     "SudoEverywhere",
+			diff:     &internal.RSoPDifferential{Added: internal.RSoPCapMap{"+/*": capabilities("ops", internal.Sudo)}},
+			severity: internal.SeverityCritical,
+			reason:   "sudo on sys/",
+		},
+		{
+			name:     "BareGlob",
+			diff:     &internal.RSoPDifferential{Added: internal.RSoPCapMap{"*": capabilities("ops", internal.Read)}},
+			severity: internal.SeverityCritical,
+			reason:   "grants everything",
+		},
+		{
+			name:     "PolicyWrite",
+			diff:     &internal.RSoPDifferential{Added: internal.RSoPCapMap{"sys/policies/acl/+": capabilities("ops", internal.Update)}},
+			severity: internal.SeverityHigh,
+			reason:   "can rewrite policies",
+		},
+		{
+			name:     "PolicyRead",
+			diff:     &internal.RSoPDifferential{Added: internal.RSoPCapMap{"sys/policies/acl/devs": capabilities("ops", internal.Read)}},
+			severity: internal.SeverityLow,
+			reason:   "capability added",
+		},
+		{
+			name:     "AuthRoleWrite",
+			diff:     &internal.RSoPDifferential{Added: internal.RSoPCapMap{"auth/kubernetes/role/*": capabilities("ops", internal.Create)}},
+			severity: internal.SeverityHigh,
+			reason:   "can change what auth roles grant",
+		},
+		{
+			name:     "AuthMountGlobWrite",
+			diff:     &internal.RSoPDifferential{Added: internal.RSoPCapMap{"auth/gcp/*": capabilities("ops", internal.Update)}},
+			severity: internal.SeverityHigh,
+			reason:   "can change what auth roles grant",
+		},
+		{
+			name:     "AuthMountWildcardSudo",
+			diff:     &internal.RSoPDifferential{Added: internal.RSoPCapMap{"auth/gcp/+/*": capabilities("ops", internal.Sudo)}},
+			severity: internal.SeverityHigh,
+			reason:   "can change what auth roles grant",
+		},
+		{
+			name:     "PolicyDirectoryGlobWrite",
+			diff:     &internal.RSoPDifferential{Added: internal.RSoPCapMap{"sys/pol*": capabilities("ops", internal.Delete)}},
+			severity: internal.SeverityHigh,
+			reason:   "can rewrite policies",
+		},
+		{
+			name:     "SysWildcardWrite",
+			diff:     &internal.RSoPDifferential{Added: internal.RSoPCapMap{"sys/+": capabilities("ops", internal.Update)}},
+			severity: internal.SeverityMedium,
+			reason:   "wildcard grants a whole level",
+		},
+		{
+			name:     "DenyRemoved",
+			diff:     &internal.RSoPDifferential{Removed: internal.RSoPCapMap{"secret/prod": capabilities("guard", internal.Deny)}},
+			severity: internal.SeverityHigh,
+			reason:   "deny removed",
+		},
+		{
+			name:     "SubtreeGlob",
+			diff:     &internal.RSoPDifferential{Added: internal.RSoPCapMap{"secret/*": capabilities("devs", internal.Read)}},
+			severity: internal.SeverityMedium,
+			reason:   "glob grants a whole subtree",
+		},
+		{
+			name: "ConstraintRemoved",
+			diff: &internal.RSoPDifferential{Removed: internal.RSoPCapMap{"secret/prod": {
+				MFAMethods: map[string][]string{"totp": {"guard"}},
+			}}},
+			severity: internal.SeverityMedium,
+			reason:   "constraint removed",
+		},
+		{
+			name:     "CapabilityRemoved",
+			diff:     &internal.RSoPDifferential{Removed: internal.RSoPCapMap{"secret/prod": capabilities("devs", internal.Read)}},
+			severity: internal.SeverityNone,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if severity := test.diff.MaxSeverity(); severity != test.severity {
+				t.Fatalf("expected %s, got %s: %+v", test.severity, severity, test.diff.Risks())
+			}
+			risks := test.diff.Risks()
+			if test.severity == internal.SeverityNone {
+				if len(risks) != 0 {
+					t.Fatalf("expected no risks, got %+v", risks)
+				}
+				return
+			}
+			if risks[0].Reason != test.reason {
+				t.Fatalf("expected reason %q, got %q", test.reason, risks[0].Reason)
+			}
+			if table := test.diff.MarkdownTable(); !strings.Contains(table, test.severity.String()) {
+				t.Fatalf("expected %s in the risk column:\n%s", test.severity, table)
+			}
+		})
+	}
+}
+
+func TestParseSeverity(t *testing.T) {
+	severity, err := internal.ParseSeverity("High")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if severity != internal.SeverityHigh {
+		t.Fatalf("expected high, got %s", severity)
+	}
+	if _, err := internal.ParseSeverity("severe"); err == nil {
+		t.Fatal("expected an error for an unknown severity")
+	}
+}
@@ -2,8 +2,12 @@ package internal
 
 import (
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/hashicorp/hcl/v2/hclwrite"
 	"github.com/rs/zerolog"
@@ -13,11 +17,8 @@ import (
 //
 // This struct is basically a container for functions that operate on a slice of Policy objects.
 type RSoP struct {
-	// Policies should be a slice sorted by Policy.Name.
+	// Policies should be a slice sorted by Policy.QualifiedName().
 	Policies []*Policy
-
-	// generated by GetCapabilityMap
-	// preemptions map[string]CapabilityPreemption
 }
 
 // MarshalZerologObject implements zerolog.LogObjectMarshaler.
@@ -31,52 +32,240 @@ func (r *RSoP) MarshalZerologObject(e *zerolog.Event) {
 
 // GetCapabilityMap generates a map of path -> capability -> policies that grant it.
 //
-// It essentially inverts each Policy.
+// It essentially inverts each Policy. Parameter constraints are merged the way Vault merges them.
 func (r *RSoP) GetCapabilityMap() RSoPCapMap {
-	capmap := make(map[string]map[Capability][]string)
+	capmap := make(RSoPCapMap)
 	// 1st pass: slam them all into the data structure
 	for i := range r.Policies {
-		policy := r.Policies[i]
+		var (
+			policy     = r.Policies[i]
+			policyName = policy.QualifiedName()
+		)
 		for j := range policy.Paths {
-			path := policy.Paths[j]
-			if capmap[path.Path] == nil {
-				capmap[path.Path] = make(map[Capability][]string)
+			var (
+				path = policy.Paths[j]
+				// paths in a namespaced policy are relative to the namespace
+				fullPath = policy.Namespace + path.Path
+				entry    = capmap[fullPath]
+			)
+			if entry == nil {
+				entry = &RSoPPath{Capabilities: make(map[Capability][]string)}
+				capmap[fullPath] = entry
 			}
 			for k := range path.Capabilities {
 				cap := path.Capabilities[k]
-				capmap[path.Path][cap] = append(capmap[path.Path][cap], policy.Name)
+				entry.Capabilities[cap] = appendPolicy(entry.Capabilities[cap], policyName)
+			}
+			entry.AllowedParameters = mergeParameters(entry.AllowedParameters, path.AllowedParameters, policyName)
+			entry.DeniedParameters = mergeParameters(entry.DeniedParameters, path.DeniedParameters, policyName)
+			for _, param := range path.RequiredParameters {
+				if entry.RequiredParameters == nil {
+					entry.RequiredParameters = make(map[string][]string)
+				}
+				entry.RequiredParameters[param] = appendPolicy(entry.RequiredParameters[param], policyName)
+			}
+			entry.MinWrappingTTL = mergeDuration(entry.MinWrappingTTL, path.MinWrappingTTL, policyName, false)
+			entry.MaxWrappingTTL = mergeDuration(entry.MaxWrappingTTL, path.MaxWrappingTTL, policyName, true)
+			for _, method := range path.MFAMethods {
+				if entry.MFAMethods == nil {
+					entry.MFAMethods = make(map[string][]string)
+				}
+				entry.MFAMethods[method] = appendPolicy(entry.MFAMethods[method], policyName)
 			}
+			entry.ControlGroup = mergeControlGroup(entry.ControlGroup, path.ControlGroup, policyName)
 		}
 	}
-	// 2nd pass: effect deny by deleting other declarations
-	for path, caps := range capmap {
-		if len(caps) > 1 {
-			if deniers := caps[Deny]; len(deniers) > 0 {
-				// TODO: catalog preempted
-				capmap[path] = map[Capability][]string{
-					Deny: deniers,
+	// root ignores deny, so nothing is cancelled
+	if r.IsRoot() {
+		return capmap
+	}
+	// 2nd pass: effect deny by deleting other declarations, but remember what they were
+	for path, entry := range capmap {
+		if deniers := entry.Capabilities[Deny]; len(deniers) > 0 {
+			var preempted map[Capability]*RSoPPreemption
+			for cap, policies := range entry.Capabilities {
+				if cap == Deny {
+					continue
 				}
+				if preempted == nil {
+					preempted = make(map[Capability]*RSoPPreemption)
+				}
+				preempted[cap] = &RSoPPreemption{Policies: policies, Deniers: deniers}
+			}
+			capmap[path] = &RSoPPath{
+				Capabilities: map[Capability][]string{
+					Deny: deniers,
+				},
+				Preempted: preempted,
 			}
 		}
 	}
 	return capmap
 }
 
+// Merges incoming allowed_parameters or denied_parameters into existing ones.
+//
+// This mirrors Vault, where the first policy to declare parameters restricts the path, an empty
+// list of values for a key wins over any other values, and values are otherwise combined.
+func mergeParameters(existing map[string]*RSoPParameter, incoming map[string][]string, policyName string) map[string]*RSoPParameter {
+	if len(incoming) == 0 {
+		return existing
+	}
+	if existing == nil {
+		existing = make(map[string]*RSoPParameter, len(incoming))
+	}
+	for key, values := range incoming {
+		param := existing[key]
+		if param == nil {
+			param = &RSoPParameter{Values: append([]string{}, values...)}
+			existing[key] = param
+		} else if len(values) == 0 || len(param.Values) == 0 {
+			param.Values = []string{}
+		} else {
+			for _, value := range values {
+				if !contains(value, param.Values...) {
+					param.Values = append(param.Values, value)
+				}
+			}
+		}
+		sort.StringSlice(param.Values).Sort()
+		param.Policies = appendPolicy(param.Policies, policyName)
+	}
+	return existing
+}
+
+// Merges a wrapping TTL, where Vault keeps the lowest minimum and highest maximum.
+func mergeDuration(existing *RSoPDuration, incoming time.Duration, policyName string, keepHighest bool) *RSoPDuration {
+	switch {
+	case incoming <= 0:
+		return existing
+	case existing == nil,
+		keepHighest && incoming > existing.Duration,
+		!keepHighest && incoming < existing.Duration:
+		return &RSoPDuration{Duration: incoming, Policies: []string{policyName}}
+	case incoming == existing.Duration:
+		existing.Policies = appendPolicy(existing.Policies, policyName)
+	}
+	return existing
+}
+
+// Merges control groups, where Vault keeps the first TTL and accumulates every factor.
+func mergeControlGroup(existing *RSoPControlGroup, incoming *ControlGroup, policyName string) *RSoPControlGroup {
+	if incoming == nil || len(incoming.Factors) == 0 {
+		return existing
+	}
+	if existing == nil {
+		existing = &RSoPControlGroup{}
+		if incoming.TTL > 0 {
+			existing.TTL = &RSoPDuration{Duration: incoming.TTL, Policies: []string{policyName}}
+		}
+	}
+FACTORS:
+	for _, factor := range incoming.Factors {
+		for _, existingFactor := range existing.Factors {
+			if existingFactor.Equal(factor) {
+				existingFactor.Policies = appendPolicy(existingFactor.Policies, policyName)
+				continue FACTORS
+			}
+		}
+		existing.Factors = append(existing.Factors, &RSoPControlGroupFactor{
+			ControlGroupFactor: factor,
+			Policies:           []string{policyName},
+		})
+	}
+	return existing
+}
+
+// appends a policy name if it's not already present, since a policy can repeat a path
+func appendPolicy(policies []string, name string) []string {
+	if contains(name, policies...) {
+		return policies
+	}
+	return append(policies, name)
+}
+
 const rsopPolicyTemplateRaw = `
-{{- range $path, $capabilities := .}}
+{{- range $path, $entry := .}}
+{{- if templated $path }}
+# templated, rendered per identity
+{{- end }}
 path "{{ $path }}" {
 	capabilities = [
-	{{- range $cap, $policies := $capabilities }}
+	{{- range $cap, $policies := $entry.Capabilities }}
 		"{{ $cap }}", # from: {{ join $policies ", " -}}
 	{{ end }}
 	]
+	{{- with $entry.AllowedParameters }}
+	allowed_parameters = {
+	{{- range $name, $param := . }}
+		{{ printf "%q" $name }} = [{{ join $param.Values ", " }}] # from: {{ join $param.Policies ", " -}}
+	{{ end }}
+	}
+	{{- end }}
+	{{- with $entry.DeniedParameters }}
+	denied_parameters = {
+	{{- range $name, $param := . }}
+		{{ printf "%q" $name }} = [{{ join $param.Values ", " }}] # from: {{ join $param.Policies ", " -}}
+	{{ end }}
+	}
+	{{- end }}
+	{{- with $entry.RequiredParameters }}
+	required_parameters = [
+	{{- range $name, $policies := . }}
+		{{ printf "%q" $name }}, # from: {{ join $policies ", " -}}
+	{{ end }}
+	]
+	{{- end }}
+	{{- with $entry.MinWrappingTTL }}
+	min_wrapping_ttl = "{{ .Duration }}" # from: {{ join .Policies ", " }}
+	{{- end }}
+	{{- with $entry.MaxWrappingTTL }}
+	max_wrapping_ttl = "{{ .Duration }}" # from: {{ join .Policies ", " }}
+	{{- end }}
+	{{- with $entry.MFAMethods }}
+	mfa_methods = [
+	{{- range $name, $policies := . }}
+		{{ printf "%q" $name }}, # from: {{ join $policies ", " -}}
+	{{ end }}
+	]
+	{{- end }}
+	{{- with $entry.ControlGroup }}
+	control_group {
+		{{- with .TTL }}
+		ttl = "{{ .Duration }}" # from: {{ join .Policies ", " }}
+		{{- end }}
+		{{- range .Factors }}
+		# from: {{ join .Policies ", " }}
+		factor {{ printf "%q" .Name }} {
+			{{- with .ControlledCapabilities }}
+			controlled_capabilities = [{{ range $i, $cap := . }}{{ if $i }}, {{ end }}"{{ $cap }}"{{ end }}]
+			{{- end }}
+			identity {
+				{{- with .GroupIDs }}
+				group_ids = [{{ range $i, $id := . }}{{ if $i }}, {{ end }}{{ printf "%q" $id }}{{ end }}]
+				{{- end }}
+				{{- with .GroupNames }}
+				group_names = [{{ range $i, $name := . }}{{ if $i }}, {{ end }}{{ printf "%q" $name }}{{ end }}]
+				{{- end }}
+				approvals = {{ .Approvals }}
+			}
+		}
+		{{- end }}
+	}
+	{{- end }}
+	{{- with $entry.Preempted }}
+	# preempted by deny:
+	{{- range $cap, $preemption := . }}
+	#   "{{ $cap }}" from: {{ join $preemption.Policies ", " }} (denied by: {{ join $preemption.Deniers ", " }})
+	{{- end }}
+	{{- end }}
 }
 {{ end }}`
 
 var (
 	rsopPolicyTemplate = template.Must(
 		template.New("policyPath").
-			Funcs(template.FuncMap{"join": join}).
+			Funcs(template.FuncMap{"join": join, "templated": IsTemplatedPath}).
 			Parse(strings.TrimSpace(rsopPolicyTemplateRaw)),
 	)
 )
@@ -86,13 +275,103 @@ func join(elems []string, sep string) string {
 	return strings.Join(elems, sep)
 }
 
-// A map of path -> capabilities -> policies that grant it.
-type RSoPCapMap map[string]map[Capability][]string
+// A map of path -> what the RSoP grants on it.
+type RSoPCapMap map[string]*RSoPPath
+
+// RSoPPath is the merged result of every path block declared for the same path.
+type RSoPPath struct {
+	// Capability -> policies that grant it.
+	Capabilities map[Capability][]string `json:"capabilities"`
+	// Parameter name -> allowed values and the policies that declare them.
+	AllowedParameters map[string]*RSoPParameter `json:"allowed_parameters,omitempty"`
+	// Parameter name -> denied values and the policies that declare them.
+	DeniedParameters map[string]*RSoPParameter `json:"denied_parameters,omitempty"`
+	// Parameter name -> policies that require it.
+	RequiredParameters map[string][]string `json:"required_parameters,omitempty"`
+	// Lowest min_wrapping_ttl declared.
+	MinWrappingTTL *RSoPDuration `json:"min_wrapping_ttl,omitempty"`
+	// Highest max_wrapping_ttl declared.
+	MaxWrappingTTL *RSoPDuration `json:"max_wrapping_ttl,omitempty"`
+	// MFA method name -> policies that require it.
+	MFAMethods map[string][]string `json:"mfa_methods,omitempty"`
+	// Every control group factor declared.
+	ControlGroup *RSoPControlGroup `json:"control_group,omitempty"`
+	// Capabilities that were declared but cancelled by deny.
+	Preempted map[Capability]*RSoPPreemption `json:"preempted,omitempty"`
+}
+
+// RSoPPreemption is a capability that policies grant but other policies deny.
+type RSoPPreemption struct {
+	// Policies whose grant was cancelled.
+	Policies []string `json:"policies"`
+	// Policies that declare deny.
+	Deniers []string `json:"deniers"`
+}
+
+// RSoPDuration is a merged duration and the policies that declare that exact value.
+type RSoPDuration struct {
+	Duration time.Duration `json:"duration"`
+	Policies []string      `json:"policies"`
+}
+
+// MarshalJSON encodes the duration as a Go duration string like "1h30m0s" instead of nanoseconds.
+func (d RSoPDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Duration string   `json:"duration"`
+		Policies []string `json:"policies"`
+	}{d.Duration.String(), d.Policies})
+}
+
+// RSoPControlGroup is the merge of every control_group block for a path.
+type RSoPControlGroup struct {
+	// The TTL of the first control group, which Vault keeps.
+	TTL     *RSoPDuration             `json:"ttl,omitempty"`
+	Factors []*RSoPControlGroupFactor `json:"factors"`
+}
+
+// RSoPControlGroupFactor is a control group factor and the policies that declare it.
+type RSoPControlGroupFactor struct {
+	ControlGroupFactor
+	Policies []string `json:"policies"`
+}
+
+// RSoPParameter is a merged allowed_parameters or denied_parameters entry.
+type RSoPParameter struct {
+	// JSON-encoded values, sorted. Empty means any value.
+	Values []string `json:"values"`
+	// Policies that declare the parameter.
+	Policies []string `json:"policies"`
+}
+
+const hclHeader = "# generated by hvresult\n"
+
+// Emits the capability map as HCL, preceded by warnings and how each policy was attached if that's known.
+func (r *RSoP) HCL() string {
+	var header strings.Builder
+	for _, warning := range r.Warnings() {
+		fmt.Fprintf(&header, "# %s\n", warning)
+	}
+	for _, policy := range r.Policies {
+		if len(policy.Sources) == 0 {
+			continue
+		}
+		strs := make([]string, len(policy.Sources))
+		for i, source := range policy.Sources {
+			strs[i] = source.String()
+		}
+		fmt.Fprintf(&header, "# policy %q from: %s\n", policy.QualifiedName(), strings.Join(strs, ", "))
+	}
+	capmapHCL := r.GetCapabilityMap().HCL()
+	if header.Len() == 0 {
+		return capmapHCL
+	}
+	return hclHeader + "#\n" + header.String() + strings.TrimPrefix(capmapHCL, hclHeader)
+}
 
 // Emits as HCL with inline comments of the responsible policies.
 func (r RSoPCapMap) HCL() string {
 	var buf bytes.Buffer
-	buf.WriteString("# generated by hvresult\n")
+	buf.WriteString(hclHeader)
 	if err := rsopPolicyTemplate.Execute(&buf, r); err != nil {
 		panic(err)
 	}
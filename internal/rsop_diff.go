@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"fmt"
+	"slices"
 	"sort"
 	"strings"
 
@@ -11,6 +13,10 @@ import (
 type RSoPDifferential struct {
 	Added   RSoPCapMap
 	Removed RSoPCapMap
+	// Whether the newer RSoP has the root policy, which makes the capabilities moot.
+	Root bool
+	// The newer RSoP's Warnings.
+	Warnings []string
 }
 
 // Whether there are any effective changes.
@@ -26,7 +32,43 @@ func (p *RSoPDifferential) MarkdownTable() string {
 	if p.Empty() {
 		return ""
 	}
-	// emit paths in ascending lexical order, added first and removed second
+	var (
+		builder = mdtf.NewTableFormatterBuilder().
+			WithPrettyPrint().
+			Build("Path", "Change", "Capability", "Policy / Policies", "Risk")
+		rows [][]string
+	)
+	for _, path := range p.paths() {
+		pathColumn := path
+		if IsTemplatedPath(path) {
+			pathColumn = path + " (templated)"
+		}
+		for _, row := range changesetRows(path, p.Added[path], p.Removed[path]) {
+			risk := ""
+			if row.severity != SeverityNone {
+				risk = row.severity.String()
+			}
+			rows = append(rows, []string{
+				pathColumn,
+				row.change,
+				row.what,
+				// `pol1`, `pol2`
+				strings.Join(row.policies, "` , `"),
+				risk,
+			})
+			// only the first row of a path has it
+			pathColumn = ""
+		}
+	}
+	table, err := builder.Format(rows)
+	if err != nil {
+		panic(err)
+	}
+	return table
+}
+
+// Every changed path in ascending lexical order.
+func (p *RSoPDifferential) paths() []string {
 	var paths []string
 	pathHits := map[string]bool{}
 	for path := range p.Added {
@@ -39,33 +81,67 @@ func (p *RSoPDifferential) MarkdownTable() string {
 		}
 	}
 	sort.StringSlice(paths).Sort()
-	var (
-		builder = mdtf.NewTableFormatterBuilder().
-			WithPrettyPrint().
-			Build("Path", "Change", "Capability", "Policy / Policies")
-		rows = make([][]string, 0, len(paths))
-	)
-	for _, path := range paths {
-		rows = append(rows, getChangesetRows(builder, path, p.Added[path], p.Removed[path])...)
+	return paths
+}
+
+// Describes capabilities newly cancelled by deny, e.g.
+// "deny added to `secret/foo` by `denier`: create/read from `granter` no longer effective".
+func (p *RSoPDifferential) PreemptionSummary() []string {
+	if p == nil {
+		return nil
 	}
-	table, err := builder.Format(rows)
-	if err != nil {
-		panic(err)
+	var lines []string
+	for _, path := range sortedKeys(p.Added) {
+		entry := p.Added[path]
+		// policy that lost capabilities -> deniers -> capabilities
+		lost := map[string]map[string][]string{}
+		for _, cap := range sortedCapabilities(entry.Preempted) {
+			preemption := entry.Preempted[cap]
+			deniers := strings.Join(preemption.Deniers, "`, `")
+			for _, policy := range preemption.Policies {
+				if lost[policy] == nil {
+					lost[policy] = map[string][]string{}
+				}
+				lost[policy][deniers] = append(lost[policy][deniers], string(cap))
+			}
+		}
+		format := "deny added to `%s` by `%s`: %s from `%s` no longer effective"
+		if len(entry.Capabilities[Deny]) == 0 {
+			format = "existing deny on `%s` by `%s`: %s from `%s` has no effect"
+		}
+		for _, policy := range sortedKeys(lost) {
+			for _, deniers := range sortedKeys(lost[policy]) {
+				lines = append(lines, fmt.Sprintf(format, path, deniers, strings.Join(lost[policy][deniers], "/"), policy))
+			}
+		}
 	}
-	return table
+	return lines
 }
 
 // Returns changeset metrics like the total count of changes.
 func (p *RSoPDifferential) Metrics() RSoPDiffMetrics {
 	var metrics RSoPDiffMetrics
-	for _, added := range p.Added {
-		for policy := range added {
-			metrics.CapabilityChanges += len(added[policy])
-		}
-	}
-	for _, removed := range p.Removed {
-		for policy := range removed {
-			metrics.CapabilityChanges += len(removed[policy])
+	for _, changes := range []RSoPCapMap{p.Added, p.Removed} {
+		for _, entry := range changes {
+			for cap := range entry.Capabilities {
+				metrics.CapabilityChanges += len(entry.Capabilities[cap])
+			}
+			metrics.ConstraintChanges += len(entry.AllowedParameters) +
+				len(entry.DeniedParameters) +
+				len(entry.RequiredParameters) +
+				len(entry.MFAMethods)
+			for _, duration := range []*RSoPDuration{entry.MinWrappingTTL, entry.MaxWrappingTTL} {
+				if duration != nil {
+					metrics.ConstraintChanges++
+				}
+			}
+			if cg := entry.ControlGroup; cg != nil {
+				metrics.ConstraintChanges += len(cg.Factors)
+				if cg.TTL != nil {
+					metrics.ConstraintChanges++
+				}
+			}
+			metrics.PreemptionChanges += len(entry.Preempted)
 		}
 	}
 	return metrics
@@ -73,51 +149,98 @@ func (p *RSoPDifferential) Metrics() RSoPDiffMetrics {
 
 type RSoPDiffMetrics struct {
 	// Total amount of capabilities modified
-	CapabilityChanges int
+	CapabilityChanges int `json:"capability_changes"`
+	// Total amount of parameter, wrapping TTL, MFA, and control group constraints modified
+	ConstraintChanges int `json:"constraint_changes"`
+	// Total amount of capabilities that started or stopped being cancelled by deny.
+	//
+	// These aren't effective changes on their own, since the capability is already counted.
+	PreemptionChanges int `json:"preemption_changes"`
 }
 
-func getChangesetRows(
-	builder mdtf.TableFormatter,
-	path string,
-	added, removed map[Capability][]string,
-) [][]string {
-	var (
-		pathEmitted bool
-		rows        [][]string
-	)
-	emitRows := func(caps map[Capability][]string, added bool) {
-		// sort keys
-		capKeys := make([]Capability, 0, len(caps))
-		for cap := range caps {
-			capKeys = append(capKeys, cap)
-		}
-		sort.Slice(capKeys, func(i, j int) bool {
-			return capKeys[i].Less(capKeys[j])
-		})
-		for _, cap := range capKeys {
-			row := make([]string, 0, 4)
-			// path
-			if pathEmitted {
-				row = append(row, "")
-			} else {
-				row = append(row, path)
-				pathEmitted = true
+// Total amount of effective changes.
+func (m RSoPDiffMetrics) Total() int {
+	return m.CapabilityChanges + m.ConstraintChanges
+}
+
+// A row of MarkdownTable.
+type changesetRow struct {
+	// ➕, ➖, or a preemption marker
+	change   string
+	what     string
+	policies []string
+	risk     riskRow
+	severity Severity
+	reason   string
+}
+
+// Returns the rows for a path, added first and removed second.
+func changesetRows(path string, added, removed *RSoPPath) []changesetRow {
+	var rows []changesetRow
+	emitRows := func(entry *RSoPPath, added bool) {
+		if entry == nil {
+			return
+		}
+		change, preemptedChange := "➖", "➖🚫"
+		if added {
+			change, preemptedChange = "➕", "🚫"
+		}
+		emitRow := func(change, what string, policies []string, risk riskRow) {
+			risk.path, risk.removed = path, !added
+			severity, reason := classifyRisk(risk)
+			rows = append(rows, changesetRow{
+				change:   change,
+				what:     what,
+				policies: policies,
+				risk:     risk,
+				severity: severity,
+				reason:   reason,
+			})
+		}
+		constraint := riskRow{constraint: true}
+		for _, cap := range sortedCapabilities(entry.Capabilities) {
+			emitRow(change, string(cap), entry.Capabilities[cap], riskRow{capability: cap})
+		}
+		for _, kind := range []struct {
+			name   string
+			params map[string]*RSoPParameter
+		}{
+			{"allowed_parameters", entry.AllowedParameters},
+			{"denied_parameters", entry.DeniedParameters},
+		} {
+			for _, name := range sortedKeys(kind.params) {
+				param := kind.params[name]
+				emitRow(change, fmt.Sprintf("%s %q = [%s]", kind.name, name, strings.Join(param.Values, ", ")), param.Policies, constraint)
 			}
-			// change
-			if added {
-				row = append(row, "➕")
-			} else {
-				row = append(row, "➖")
+		}
+		for _, name := range sortedKeys(entry.RequiredParameters) {
+			emitRow(change, fmt.Sprintf("required_parameters %q", name), entry.RequiredParameters[name], constraint)
+		}
+		if ttl := entry.MinWrappingTTL; ttl != nil {
+			emitRow(change, fmt.Sprintf("min_wrapping_ttl = %s", ttl.Duration), ttl.Policies, constraint)
+		}
+		if ttl := entry.MaxWrappingTTL; ttl != nil {
+			emitRow(change, fmt.Sprintf("max_wrapping_ttl = %s", ttl.Duration), ttl.Policies, constraint)
+		}
+		for _, name := range sortedKeys(entry.MFAMethods) {
+			emitRow(change, fmt.Sprintf("mfa_methods %q", name), entry.MFAMethods[name], constraint)
+		}
+		if cg := entry.ControlGroup; cg != nil {
+			if cg.TTL != nil {
+				emitRow(change, fmt.Sprintf("control_group ttl = %s", cg.TTL.Duration), cg.TTL.Policies, constraint)
+			}
+			for _, factor := range cg.Factors {
+				emitRow(change, "control_group factor "+factor.String(), factor.Policies, constraint)
 			}
-			policies := caps[cap]
-			row = append(
-				row,
-				// capability
+		}
+		for _, cap := range sortedCapabilities(entry.Preempted) {
+			preemption := entry.Preempted[cap]
+			emitRow(
+				preemptedChange,
 				string(cap),
-				// `pol1`, `pol2`
-				strings.Join(policies, "` , `"),
+				[]string{strings.Join(preemption.Policies, "` , `") + " (denied by: " + strings.Join(preemption.Deniers, ", ") + ")"},
+				riskRow{capability: cap, preempted: true},
 			)
-			rows = append(rows, row)
 		}
 	}
 	emitRows(added, true)
@@ -125,6 +248,33 @@ func getChangesetRows(
 	return rows
 }
 
+func sortedCapabilities[T any](m map[Capability]T) []Capability {
+	keys := make([]Capability, 0, len(m))
+	for cap := range m {
+		keys = append(keys, cap)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Less(keys[j])
+	})
+	return keys
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.StringSlice(keys).Sort()
+	return keys
+}
+
+// Generates a differential between 2 RSoPs, with the warnings of the newer one.
+func (r *RSoP) Diff(newer *RSoP) *RSoPDifferential {
+	diff := r.GetCapabilityMap().Diff(newer.GetCapabilityMap())
+	diff.Root, diff.Warnings = newer.IsRoot(), newer.Warnings()
+	return diff
+}
+
 // Generates a differential between 2 policy sets.
 func (r RSoPCapMap) Diff(other RSoPCapMap) *RSoPDifferential {
 	// deleted
@@ -137,34 +287,14 @@ func (r RSoPCapMap) Diff(other RSoPCapMap) *RSoPDifferential {
 		Added:   make(RSoPCapMap),
 		Removed: make(RSoPCapMap),
 	}
-	for path, caps := range r {
-		if otherCaps := other[path]; len(otherCaps) == 0 {
-			diff.Removed[path] = caps
-		} else {
-			// go through our caps and add misses in other to Removed
-			for cap, policyNames := range caps {
-				if _, exists := otherCaps[cap]; !exists {
-					if diff.Removed[path] == nil {
-						diff.Removed[path] = map[Capability][]string{cap: policyNames}
-					}
-					diff.Removed[path][cap] = policyNames
-				}
-			}
+	for path, entry := range r {
+		if removed := entry.subtract(other[path]); removed != nil {
+			diff.Removed[path] = removed
 		}
 	}
-	for path, caps := range other {
-		if ourCaps := r[path]; len(ourCaps) == 0 {
-			diff.Added[path] = caps
-		} else {
-			// go through other caps and add misses in ours to Added
-			for cap, policyNames := range caps {
-				if _, exists := ourCaps[cap]; !exists {
-					if diff.Added[path] == nil {
-						diff.Added[path] = map[Capability][]string{cap: policyNames}
-					}
-					diff.Added[path][cap] = policyNames
-				}
-			}
+	for path, entry := range other {
+		if added := entry.subtract(r[path]); added != nil {
+			diff.Added[path] = added
 		}
 	}
 	// TODO: optimize if this turns out to be some sort of problem
@@ -176,3 +306,116 @@ func (r RSoPCapMap) Diff(other RSoPCapMap) *RSoPDifferential {
 	}
 	return diff
 }
+
+// Returns everything in p that isn't in other, or nil if there's nothing.
+func (p *RSoPPath) subtract(other *RSoPPath) *RSoPPath {
+	if other == nil {
+		return p
+	}
+	var (
+		result  RSoPPath
+		changed bool
+	)
+	for cap, policyNames := range p.Capabilities {
+		if _, exists := other.Capabilities[cap]; !exists {
+			if result.Capabilities == nil {
+				result.Capabilities = make(map[Capability][]string)
+			}
+			result.Capabilities[cap] = policyNames
+			changed = true
+		}
+	}
+	result.AllowedParameters = subtractParameters(p.AllowedParameters, other.AllowedParameters)
+	result.DeniedParameters = subtractParameters(p.DeniedParameters, other.DeniedParameters)
+	for name, policyNames := range p.RequiredParameters {
+		if _, exists := other.RequiredParameters[name]; !exists {
+			if result.RequiredParameters == nil {
+				result.RequiredParameters = make(map[string][]string)
+			}
+			result.RequiredParameters[name] = policyNames
+		}
+	}
+	if p.MinWrappingTTL != nil && !p.MinWrappingTTL.sameDuration(other.MinWrappingTTL) {
+		result.MinWrappingTTL = p.MinWrappingTTL
+	}
+	if p.MaxWrappingTTL != nil && !p.MaxWrappingTTL.sameDuration(other.MaxWrappingTTL) {
+		result.MaxWrappingTTL = p.MaxWrappingTTL
+	}
+	for name, policyNames := range p.MFAMethods {
+		if _, exists := other.MFAMethods[name]; !exists {
+			if result.MFAMethods == nil {
+				result.MFAMethods = make(map[string][]string)
+			}
+			result.MFAMethods[name] = policyNames
+		}
+	}
+	result.ControlGroup = p.ControlGroup.subtract(other.ControlGroup)
+	for cap, preemption := range p.Preempted {
+		if _, exists := other.Preempted[cap]; !exists {
+			if result.Preempted == nil {
+				result.Preempted = make(map[Capability]*RSoPPreemption)
+			}
+			result.Preempted[cap] = preemption
+		}
+	}
+	changed = changed ||
+		result.AllowedParameters != nil ||
+		result.DeniedParameters != nil ||
+		result.RequiredParameters != nil ||
+		result.MinWrappingTTL != nil ||
+		result.MaxWrappingTTL != nil ||
+		result.MFAMethods != nil ||
+		result.ControlGroup != nil ||
+		result.Preempted != nil
+	if !changed {
+		return nil
+	}
+	return &result
+}
+
+// Whether both durations are set to the same value.
+func (d *RSoPDuration) sameDuration(other *RSoPDuration) bool {
+	return d != nil && other != nil && d.Duration == other.Duration
+}
+
+// Returns the TTL and factors in cg that aren't in other, or nil if there's nothing.
+func (cg *RSoPControlGroup) subtract(other *RSoPControlGroup) *RSoPControlGroup {
+	if cg == nil {
+		return nil
+	}
+	if other == nil {
+		return cg
+	}
+	var result RSoPControlGroup
+	if cg.TTL != nil && !cg.TTL.sameDuration(other.TTL) {
+		result.TTL = cg.TTL
+	}
+FACTORS:
+	for _, factor := range cg.Factors {
+		for _, otherFactor := range other.Factors {
+			if factor.Equal(otherFactor.ControlGroupFactor) {
+				continue FACTORS
+			}
+		}
+		result.Factors = append(result.Factors, factor)
+	}
+	if result.TTL == nil && result.Factors == nil {
+		return nil
+	}
+	return &result
+}
+
+// Returns parameters in params that are missing from or have different values in other.
+func subtractParameters(params, other map[string]*RSoPParameter) map[string]*RSoPParameter {
+	var result map[string]*RSoPParameter
+	for name, param := range params {
+		if otherParam, exists := other[name]; exists && slices.Equal(param.Values, otherParam.Values) {
+			continue
+		}
+		if result == nil {
+			result = make(map[string]*RSoPParameter)
+		}
+		result[name] = param
+	}
+	return result
+}
@@ -1,7 +1,10 @@
 package internal_test
 
 import (
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/threatkey-oss/hvresult/internal"
@@ -52,8 +55,8 @@ func TestRsopDiff(t *testing.T) {
 		pdiff := before.GetCapabilityMap().Diff(after.GetCapabilityMap())
 		expected := &internal.RSoPDifferential{
 			Added: internal.RSoPCapMap{
-				"modified": {"delete": {"after"}},
-				"new":      {"sudo": {"after"}},
+				"modified": {Capabilities: map[internal.Capability][]string{"delete": {"after"}}},
+				"new":      {Capabilities: map[internal.Capability][]string{"sudo": {"after"}}},
 			},
 		}
 		if diff := cmp.Diff(expected, pdiff); diff != "" {
@@ -93,11 +96,11 @@ func TestRsopDiff(t *testing.T) {
 		pdiff := before.GetCapabilityMap().Diff(after.GetCapabilityMap())
 		expected := &internal.RSoPDifferential{
 			Removed: internal.RSoPCapMap{
-				"modified": {"list": {"before"}},
-				"removed": {
+				"modified": {Capabilities: map[internal.Capability][]string{"list": {"before"}}},
+				"removed": {Capabilities: map[internal.Capability][]string{
 					"subscribe": {"before2"},
 					"sudo":      {"before2"},
-				},
+				}},
 			},
 		}
 		if diff := cmp.Diff(expected, pdiff); diff != "" {
@@ -105,3 +108,103 @@ func TestRsopDiff(t *testing.T) {
 		}
 	})
 }
+
+func TestRsopDiffParameters(t *testing.T) {
+	policy := func(values ...string) *internal.RSoP {
+		return &internal.RSoP{Policies: []*internal.Policy{{
+			Name: "params",
+			Paths: []internal.PathConfig{{
+				Path:              "secret/params",
+				Capabilities:      []internal.Capability{"create"},
+				AllowedParameters: map[string][]string{"foo": values},
+			}},
+		}}}
+	}
+	// narrowing allowed values is a change even though capabilities are the same
+	pdiff := policy(`"a"`, `"b"`).GetCapabilityMap().Diff(policy(`"a"`).GetCapabilityMap())
+	expected := &internal.RSoPDifferential{
+		Added: internal.RSoPCapMap{
+			"secret/params": {AllowedParameters: map[string]*internal.RSoPParameter{
+				"foo": {Values: []string{`"a"`}, Policies: []string{"params"}},
+			}},
+		},
+		Removed: internal.RSoPCapMap{
+			"secret/params": {AllowedParameters: map[string]*internal.RSoPParameter{
+				"foo": {Values: []string{`"a"`, `"b"`}, Policies: []string{"params"}},
+			}},
+		},
+	}
+	if diff := cmp.Diff(expected, pdiff); diff != "" {
+		t.Fatal(diff)
+	}
+	if metrics := pdiff.Metrics(); metrics.ConstraintChanges != 2 || metrics.CapabilityChanges != 0 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+}
+
+func TestRsopDiffConstraints(t *testing.T) {
+	policy := func(maxTTL time.Duration, mfa ...string) *internal.RSoP {
+		return &internal.RSoP{Policies: []*internal.Policy{{
+			Name: "wrapped",
+			Paths: []internal.PathConfig{{
+				Path:           "secret/wrapped",
+				Capabilities:   []internal.Capability{"read"},
+				MaxWrappingTTL: maxTTL,
+				MFAMethods:     mfa,
+			}},
+		}}}
+	}
+	pdiff := policy(time.Hour).GetCapabilityMap().Diff(policy(time.Minute, "totp").GetCapabilityMap())
+	expected := &internal.RSoPDifferential{
+		Added: internal.RSoPCapMap{
+			"secret/wrapped": {
+				MaxWrappingTTL: &internal.RSoPDuration{Duration: time.Minute, Policies: []string{"wrapped"}},
+				MFAMethods:     map[string][]string{"totp": {"wrapped"}},
+			},
+		},
+		Removed: internal.RSoPCapMap{
+			"secret/wrapped": {
+				MaxWrappingTTL: &internal.RSoPDuration{Duration: time.Hour, Policies: []string{"wrapped"}},
+			},
+		},
+	}
+	if diff := cmp.Diff(expected, pdiff); diff != "" {
+		t.Fatal(diff)
+	}
+	if metrics := pdiff.Metrics(); metrics.ConstraintChanges != 3 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+	if table := pdiff.MarkdownTable(); !strings.Contains(table, `mfa_methods "totp"`) {
+		t.Fatalf("expected MFA row in table:\n%s", table)
+	}
+}
+
+func TestRsopDiffPreempted(t *testing.T) {
+	reader := &internal.Policy{
+		Name:  "reader",
+		Paths: []internal.PathConfig{{Path: "secret/locked", Capabilities: []internal.Capability{"read", "list"}}},
+	}
+	denier := &internal.Policy{
+		Name:  "denier",
+		Paths: []internal.PathConfig{{Path: "secret/locked", Capabilities: []internal.Capability{"deny"}}},
+	}
+	before := (&internal.RSoP{Policies: []*internal.Policy{reader}}).GetCapabilityMap()
+	after := (&internal.RSoP{Policies: []*internal.Policy{reader, denier}}).GetCapabilityMap()
+	pdiff := before.Diff(after)
+	preempted := pdiff.Added["secret/locked"].Preempted
+	if len(preempted) != 2 || !slices.Equal(preempted[internal.Read].Deniers, []string{"denier"}) {
+		t.Fatalf("unexpected preemptions: %+v", preempted)
+	}
+	metrics := pdiff.Metrics()
+	if metrics.PreemptionChanges != 2 {
+		t.Fatalf("unexpected metrics: %+v", metrics)
+	}
+	summary := pdiff.PreemptionSummary()
+	expected := []string{"deny added to `secret/locked` by `denier`: read/list from `reader` no longer effective"}
+	if !slices.Equal(summary, expected) {
+		t.Fatalf("unexpected summary: %q", summary)
+	}
+	if table := pdiff.MarkdownTable(); !strings.Contains(table, "🚫") || !strings.Contains(table, "(denied by: denier)") {
+		t.Fatalf("expected preempted rows in table:\n%s", table)
+	}
+}
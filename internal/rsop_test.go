@@ -2,6 +2,7 @@ package internal
 
 import (
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 )
@@ -130,7 +131,7 @@ path "test/simple/multiple" {
 	)
 	// so there's no question about whether it generated correctly
 	capmap := r.GetCapabilityMap()
-	expectedCapmap := RSoPCapMap(map[string]map[Capability][]string{
+	expectedCapmap := capsOnly(map[string]map[Capability][]string{
 		"test/simple": {
 			Read: {"simple"},
 		},
@@ -155,11 +156,234 @@ path "test/simple/multiple" {
 	}
 }
 
+// tests that parameters merge the way Vault merges them and render with attribution
+func TestRSoPParameters(t *testing.T) {
+	t.Parallel()
+	r := &RSoP{Policies: []*Policy{
+		{
+			Name: "first",
+			Paths: []PathConfig{
+				{
+					Path:               "secret/params",
+					Capabilities:       []Capability{Create},
+					AllowedParameters:  map[string][]string{"foo": {`"a"`}, "bar": {`"x"`}},
+					DeniedParameters:   map[string][]string{"baz": {}},
+					RequiredParameters: []string{"foo"},
+				},
+				{
+					Path:             "secret/denied",
+					Capabilities:     []Capability{Create},
+					DeniedParameters: map[string][]string{"baz": {}},
+				},
+			},
+		},
+		{
+			Name: "second",
+			Paths: []PathConfig{
+				{
+					Path:               "secret/params",
+					Capabilities:       []Capability{Update},
+					AllowedParameters:  map[string][]string{"foo": {`"b"`}, "bar": {}},
+					RequiredParameters: []string{"foo", "zip"},
+				},
+				{
+					Path:         "secret/denied",
+					Capabilities: []Capability{Deny},
+				},
+			},
+		},
+	}}
+	capmap := r.GetCapabilityMap()
+	expected := RSoPCapMap{
+		"secret/params": {
+			Capabilities: map[Capability][]string{
+				Create: {"first"},
+				Update: {"second"},
+			},
+			AllowedParameters: map[string]*RSoPParameter{
+				"foo": {Values: []string{`"a"`, `"b"`}, Policies: []string{"first", "second"}},
+				// an empty list allows anything and wins
+				"bar": {Values: []string{}, Policies: []string{"first", "second"}},
+			},
+			DeniedParameters: map[string]*RSoPParameter{
+				"baz": {Values: []string{}, Policies: []string{"first"}},
+			},
+			RequiredParameters: map[string][]string{
+				"foo": {"first", "second"},
+				"zip": {"second"},
+			},
+		},
+		// deny throws away parameters too
+		"secret/denied": {
+			Capabilities: map[Capability][]string{Deny: {"second"}},
+			Preempted: map[Capability]*RSoPPreemption{
+				Create: {Policies: []string{"first"}, Deniers: []string{"second"}},
+			},
+		},
+	}
+	if diff := cmp.Diff(expected, capmap); diff != "" {
+		t.Fatal(diff)
+	}
+	expectedHCL := `# generated by hvresult
+
+path "secret/denied" {
+  capabilities = [
+    "deny", # from: second
+  ]
+  # preempted by deny:
+  #   "create" from: first (denied by: second)
+}
+
+path "secret/params" {
+  capabilities = [
+    "create", # from: first
+    "update", # from: second
+  ]
+  allowed_parameters = {
+    "bar" = []         # from: first, second
+    "foo" = ["a", "b"] # from: first, second
+  }
+  denied_parameters = {
+    "baz" = [] # from: first
+  }
+  required_parameters = [
+    "foo", # from: first, second
+    "zip", # from: second
+  ]
+}
+`
+	if diff := cmp.Diff(expectedHCL, capmap.HCL()); diff != "" {
+		t.Logf("got: %s", capmap.HCL())
+		t.Fatal(diff)
+	}
+}
+
+// tests that wrapping TTLs, MFA, and control groups merge and render
+func TestRSoPConstraints(t *testing.T) {
+	t.Parallel()
+	factor := ControlGroupFactor{Name: "approvers", GroupNames: []string{"managers"}, Approvals: 1}
+	r := &RSoP{Policies: []*Policy{
+		{
+			Name: "first",
+			Paths: []PathConfig{{
+				Path:           "secret/wrapped",
+				Capabilities:   []Capability{Read},
+				MinWrappingTTL: time.Minute,
+				MaxWrappingTTL: time.Hour,
+				MFAMethods:     []string{"totp"},
+				ControlGroup:   &ControlGroup{TTL: time.Hour, Factors: []ControlGroupFactor{factor}},
+			}},
+		},
+		{
+			Name: "second",
+			Paths: []PathConfig{{
+				Path:           "secret/wrapped",
+				Capabilities:   []Capability{Read},
+				MinWrappingTTL: time.Second,
+				MaxWrappingTTL: time.Hour,
+				MFAMethods:     []string{"duo", "totp"},
+				ControlGroup:   &ControlGroup{TTL: time.Minute, Factors: []ControlGroupFactor{factor}},
+			}},
+		},
+	}}
+	capmap := r.GetCapabilityMap()
+	expected := RSoPCapMap{
+		"secret/wrapped": {
+			Capabilities:   map[Capability][]string{Read: {"first", "second"}},
+			MinWrappingTTL: &RSoPDuration{Duration: time.Second, Policies: []string{"second"}},
+			MaxWrappingTTL: &RSoPDuration{Duration: time.Hour, Policies: []string{"first", "second"}},
+			MFAMethods: map[string][]string{
+				"duo":  {"second"},
+				"totp": {"first", "second"},
+			},
+			ControlGroup: &RSoPControlGroup{
+				TTL: &RSoPDuration{Duration: time.Hour, Policies: []string{"first"}},
+				Factors: []*RSoPControlGroupFactor{
+					{ControlGroupFactor: factor, Policies: []string{"first", "second"}},
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(expected, capmap); diff != "" {
+		t.Fatal(diff)
+	}
+	expectedHCL := `# generated by hvresult
+
+path "secret/wrapped" {
+  capabilities = [
+    "read", # from: first, second
+  ]
+  min_wrapping_ttl = "1s"     # from: second
+  max_wrapping_ttl = "1h0m0s" # from: first, second
+  mfa_methods = [
+    "duo",  # from: second
+    "totp", # from: first, second
+  ]
+  control_group {
+    ttl = "1h0m0s" # from: first
+    # from: first, second
+    factor "approvers" {
+      identity {
+        group_names = ["managers"]
+        approvals   = 1
+      }
+    }
+  }
+}
+`
+	hcl := capmap.HCL()
+	if diff := cmp.Diff(expectedHCL, hcl); diff != "" {
+		t.Logf("got: %s", hcl)
+		t.Fatal(diff)
+	}
+	// the output should be a valid policy
+	if _, err := ParsePolicy(hcl, "roundtrip"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// tests that policy sources are emitted as comments
+func TestRSoPSourcesHCL(t *testing.T) {
+	t.Parallel()
+	r := &RSoP{Policies: []*Policy{
+		{
+			Name: "devs",
+			Sources: []PolicySource{
+				{Kind: SourceEntity, Via: []string{"alice"}},
+				{Kind: SourceGroup, Via: []string{"devs", "eng"}},
+			},
+			Paths: []PathConfig{{Path: "secret/devs", Capabilities: []Capability{Read}}},
+		},
+	}}
+	expected := `# generated by hvresult
+#
+# policy "devs" from: entity alice, group devs -> eng
+
+path "secret/devs" {
+  capabilities = [
+    "read", # from: devs
+  ]
+}
+`
+	if diff := cmp.Diff(expected, r.HCL()); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
 func testRSoPResult(t *testing.T, policies []*Policy, expected map[string]map[Capability][]string) {
 	t.Helper()
 	r := &RSoP{Policies: policies}
 	capmap := r.GetCapabilityMap()
-	if diff := cmp.Diff(RSoPCapMap(expected), capmap); diff != "" {
+	if diff := cmp.Diff(capsOnly(expected), capmap); diff != "" {
 		t.Fatal(diff)
 	}
 }
+
+// builds an RSoPCapMap without any parameter constraints
+func capsOnly(caps map[string]map[Capability][]string) RSoPCapMap {
+	capmap := make(RSoPCapMap, len(caps))
+	for path := range caps {
+		capmap[path] = &RSoPPath{Capabilities: caps[path]}
+	}
+	return capmap
+}
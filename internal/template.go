@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrInvalidTemplate = errors.New("invalid identity template")
+	// Vault drops a templated path from the ACL when this happens.
+	ErrTemplateValueNotFound = errors.New("identity template value not found")
+)
+
+var reTemplate = regexp.MustCompile(`\{\{([^{}]*)\}\}`)
+
+// Whether a policy path contains identity templating like {{identity.entity.id}}.
+//
+// https://developer.hashicorp.com/vault/docs/concepts/policies#templated-policies
+func IsTemplatedPath(path string) bool {
+	return reTemplate.MatchString(path)
+}
+
+// Checks the syntax of every template in a policy path.
+func validateTemplates(path string) error {
+	for _, match := range reTemplate.FindAllStringSubmatch(path, -1) {
+		if _, err := parseTemplate(match[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RenderPath replaces every template in a policy path with values from the identity.
+func (c *IdentityContext) RenderPath(path string) (string, error) {
+	var firstErr error
+	rendered := reTemplate.ReplaceAllStringFunc(path, func(template string) string {
+		expr := reTemplate.FindStringSubmatch(template)[1]
+		ref, err := parseTemplate(expr)
+		if err == nil {
+			value, found := c.lookup(ref)
+			if found {
+				return value
+			}
+			err = fmt.Errorf("%w: '%s'", ErrTemplateValueNotFound, expr)
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("error rendering '%s': %w", path, err)
+		}
+		return ""
+	})
+	return rendered, firstErr
+}
+
+// a parsed template expression like "identity.groups.names.devs.id"
+type templateRef struct {
+	// "entity", "alias", or "group"
+	scope string
+	// alias mount accessor or group ID/name
+	key         string
+	groupByName bool
+	// "id", "name", "metadata", or "custom_metadata"
+	field       string
+	metadataKey string
+}
+
+func parseTemplate(expr string) (templateRef, error) {
+	var (
+		ref   templateRef
+		rest  []string
+		parts = strings.Split(strings.TrimSpace(expr), ".")
+	)
+	invalid := fmt.Errorf("%w: '%s'", ErrInvalidTemplate, expr)
+	if len(parts) < 3 || parts[0] != "identity" {
+		return ref, invalid
+	}
+	switch {
+	case parts[1] == "entity" && parts[2] == "aliases" && len(parts) >= 5:
+		ref.scope, ref.key, rest = "alias", parts[3], parts[4:]
+	case parts[1] == "entity":
+		ref.scope, rest = "entity", parts[2:]
+	case parts[1] == "groups" && len(parts) >= 5 && (parts[2] == "ids" || parts[2] == "names"):
+		ref.scope, ref.key, ref.groupByName, rest = "group", parts[3], parts[2] == "names", parts[4:]
+	default:
+		return ref, invalid
+	}
+	switch {
+	case len(rest) == 1 && rest[0] == "id" && (ref.scope != "group" || ref.groupByName),
+		len(rest) == 1 && rest[0] == "name" && (ref.scope != "group" || !ref.groupByName):
+		ref.field = rest[0]
+	// metadata keys can contain dots, so everything after the field is the key
+	case len(rest) >= 2 && (rest[0] == "metadata" || (ref.scope == "alias" && rest[0] == "custom_metadata")):
+		ref.field, ref.metadataKey = rest[0], strings.Join(rest[1:], ".")
+	default:
+		return ref, invalid
+	}
+	return ref, nil
+}
+
+func (c *IdentityContext) lookup(ref templateRef) (string, bool) {
+	var (
+		id, name                 string
+		metadata, customMetadata map[string]string
+		found                    bool
+	)
+	switch ref.scope {
+	case "entity":
+		id, name, metadata, found = c.Entity.ID, c.Entity.Name, c.Entity.Metadata, true
+	case "alias":
+		for _, alias := range c.Entity.Aliases {
+			if alias.MountAccessor == ref.key {
+				id, name, metadata, customMetadata, found = alias.ID, alias.Name, alias.Metadata, alias.CustomMetadata, true
+			}
+		}
+	case "group":
+		for _, group := range c.Groups {
+			if (ref.groupByName && group.Name == ref.key) || (!ref.groupByName && group.ID == ref.key) {
+				id, name, metadata, found = group.ID, group.Name, group.Metadata, true
+			}
+		}
+	}
+	if !found {
+		return "", false
+	}
+	var value string
+	switch ref.field {
+	case "id":
+		value = id
+	case "name":
+		value = name
+	case "metadata":
+		value = metadata[ref.metadataKey]
+	case "custom_metadata":
+		value = customMetadata[ref.metadataKey]
+	}
+	return value, value != ""
+}
+
+// RenderTemplates returns a copy of the RSoP with templated paths rendered for an identity.
+//
+// Like Vault, paths that can't be rendered are dropped; they're returned as "policy: path" strings.
+func (r *RSoP) RenderTemplates(identity *IdentityContext) (*RSoP, []string) {
+	var (
+		rendered = &RSoP{Policies: make([]*Policy, len(r.Policies))}
+		dropped  []string
+	)
+	for i, policy := range r.Policies {
+		copied := *policy
+		copied.Paths = make([]PathConfig, 0, len(policy.Paths))
+		for _, path := range policy.Paths {
+			if IsTemplatedPath(path.Path) {
+				renderedPath, err := identity.RenderPath(path.Path)
+				if err != nil {
+					dropped = append(dropped, policy.QualifiedName()+": "+path.Path)
+					continue
+				}
+				path.Path = renderedPath
+			}
+			copied.Paths = append(copied.Paths, path)
+		}
+		sort.Slice(copied.Paths, func(i, j int) bool {
+			return copied.Paths[i].Path < copied.Paths[j].Path
+		})
+		rendered.Policies[i] = &copied
+	}
+	return rendered, dropped
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var testIdentity = &IdentityContext{
+	Entity: IdentityEntity{
+		ID:       "entity-id",
+		Name:     "alice",
+		Metadata: map[string]string{"team": "infra", "example.com/cost-center": "42"},
+		Aliases: []IdentityAlias{{
+			ID:             "alias-id",
+			Name:           "alice@example.com",
+			MountAccessor:  "auth_oidc_1234",
+			CustomMetadata: map[string]string{"org": "eng"},
+		}},
+	},
+	Groups: []IdentityGroup{{
+		ID:       "group-id",
+		Name:     "devs",
+		Metadata: map[string]string{"env": "dev"},
+	}},
+}
+
+func TestRenderPath(t *testing.T) {
+	t.Parallel()
+	for template, expected := range map[string]string{
+		"secret/data/{{identity.entity.id}}/*":                                  "secret/data/entity-id/*",
+		"secret/{{ identity.entity.name }}":                                     "secret/alice",
+		"secret/{{identity.entity.metadata.team}}":                              "secret/infra",
+		"secret/{{identity.entity.metadata.example.com/cost-center}}":           "secret/42",
+		"secret/{{identity.entity.aliases.auth_oidc_1234.name}}":                "secret/alice@example.com",
+		"secret/{{identity.entity.aliases.auth_oidc_1234.custom_metadata.org}}": "secret/eng",
+		"secret/{{identity.groups.names.devs.id}}/+":                            "secret/group-id/+",
+		"secret/{{identity.groups.ids.group-id.name}}":                          "secret/devs",
+		"secret/{{identity.groups.ids.group-id.metadata.env}}":                  "secret/dev",
+	} {
+		if !IsTemplatedPath(template) {
+			t.Errorf("%s: expected to be templated", template)
+		}
+		rendered, err := testIdentity.RenderPath(template)
+		if err != nil {
+			t.Errorf("%s: %v", template, err)
+		} else if rendered != expected {
+			t.Errorf("%s: expected %q, got %q", template, expected, rendered)
+		}
+	}
+	if _, err := testIdentity.RenderPath("secret/{{identity.groups.names.admins.id}}"); !errors.Is(err, ErrTemplateValueNotFound) {
+		t.Errorf("expected ErrTemplateValueNotFound, got %v", err)
+	}
+	for _, invalid := range []string{
+		"{{identity.entity}}",
+		"{{identity.entity.nope}}",
+		"{{identity.groups.ids.group-id.id}}",
+		"{{something.else}}",
+	} {
+		if _, err := testIdentity.RenderPath(invalid); !errors.Is(err, ErrInvalidTemplate) {
+			t.Errorf("%s: expected ErrInvalidTemplate, got %v", invalid, err)
+		}
+		if _, err := ParsePolicy(`path "`+invalid+`" { capabilities = ["read"] }`, "invalid"); err != nil {
+			t.Errorf("%s: expected the policy to parse, got %v", invalid, err)
+		}
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	t.Parallel()
+	r := &RSoP{Policies: []*Policy{{
+		Name: "templated",
+		Paths: []PathConfig{
+			{Path: "secret/{{identity.entity.name}}", Capabilities: []Capability{Read}},
+			{Path: "secret/{{identity.groups.names.admins.id}}", Capabilities: []Capability{Sudo}},
+			{Path: "secret/{{identity.entity.nope}}", Capabilities: []Capability{Sudo}},
+			{Path: "static", Capabilities: []Capability{List}},
+		},
+	}}}
+	if hcl := r.GetCapabilityMap().HCL(); !strings.Contains(hcl, "# templated, rendered per identity\npath \"secret/{{identity.entity.name}}\"") {
+		t.Fatalf("expected templated paths to be marked:\n%s", hcl)
+	}
+	rendered, dropped := r.RenderTemplates(testIdentity)
+	if diff := cmp.Diff([]string{
+		"templated: secret/{{identity.groups.names.admins.id}}",
+		"templated: secret/{{identity.entity.nope}}",
+	}, dropped); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := cmp.Diff(capsOnly(map[string]map[Capability][]string{
+		"secret/alice": {Read: {"templated"}},
+		"static":       {List: {"templated"}},
+	}), rendered.GetCapabilityMap()); diff != "" {
+		t.Fatal(diff)
+	}
+	// the original is untouched
+	if len(r.Policies[0].Paths) != 4 {
+		t.Fatal("RenderTemplates modified the original RSoP")
+	}
+}